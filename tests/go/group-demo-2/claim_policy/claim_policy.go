@@ -0,0 +1,239 @@
+package claim_policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const defaultGroupsClaim = "groups"
+
+// protectedClaims are the claims the verifiers of a re-signed token need. They
+// are always kept and cannot be denied, renamed or overridden.
+var protectedClaims = map[string]bool{
+	"iss": true,
+	"aud": true,
+	"exp": true,
+	"iat": true,
+	"nbf": true,
+	"jti": true,
+}
+
+// Policy filters and transforms the claims of a resolved token before it is
+// re-signed, so that only the claims the relying parties need are passed on.
+// The steps are applied in order:
+//
+//  1. Derive computes new claims from the groups.
+//  2. Allow and Deny filter the claims, including the derived claims.
+//  3. Rename renames the remaining claims.
+//  4. Static adds the static claims, overriding any claim of the same name.
+//
+// An example policy in YAML:
+//
+//	allow: [sub, username, groups]
+//	rename:
+//	  username: preferred_username
+//	static:
+//	  cluster: demo
+//	derive:
+//	- claim: tenant
+//	  groupPrefix: "tenant:"
+type Policy struct {
+	// Allow are the claims to keep. If empty, all the claims are kept except
+	// those in Deny.
+	Allow []string `json:"allow,omitempty"`
+	// Deny are the claims to drop.
+	Deny []string `json:"deny,omitempty"`
+	// Rename maps the names of claims to their new names.
+	Rename map[string]string `json:"rename,omitempty"`
+	// Static are the claims added to every token.
+	Static map[string]json.RawMessage `json:"static,omitempty"`
+	// GroupsClaim is the claim the groups are derived from. The default is
+	// "groups".
+	GroupsClaim string `json:"groupsClaim,omitempty"`
+	// Derive are the claims derived from the groups.
+	Derive []DerivedClaim `json:"derive,omitempty"`
+}
+
+// DerivedClaim is a claim derived from the groups with a prefix, e.g., the
+// tenant "acme" from the group "tenant:acme".
+type DerivedClaim struct {
+	// Claim is the name of the derived claim.
+	Claim string `json:"claim"`
+	// GroupPrefix selects the groups that start with the prefix. The value of
+	// the claim is the rest of the group name.
+	GroupPrefix string `json:"groupPrefix"`
+	// Multiple makes the claim the list of the values of all the selected
+	// groups. Otherwise it is the value of the first selected group.
+	Multiple bool `json:"multiple,omitempty"`
+}
+
+// ParsePolicy parses a policy in YAML or JSON.
+func ParsePolicy(data []byte) (*Policy, error) {
+	j, err := yaml.ToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to parse the claim policy: %v", err)
+	}
+	p := &Policy{}
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.DisallowUnknownFields()
+	if err := d.Decode(p); err != nil {
+		return nil, fmt.Errorf("Fail to parse the claim policy: %v", err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadPolicyFromFile reads a policy from a YAML or JSON file.
+func LoadPolicyFromFile(filePath string) (*Policy, error) {
+	d, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read the claim policy file: %v", err)
+	}
+	p, err := ParsePolicy(d)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filePath, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	for _, c := range p.Deny {
+		if protectedClaims[c] {
+			return fmt.Errorf("Invalid claim policy: the claim %q cannot be denied", c)
+		}
+	}
+	renamed := map[string]string{}
+	for from, to := range p.Rename {
+		if protectedClaims[from] || protectedClaims[to] {
+			return fmt.Errorf("Invalid claim policy: the claim %q cannot be renamed to %q", from, to)
+		}
+		if to == "" {
+			return fmt.Errorf("Invalid claim policy: the claim %q is renamed to an empty name", from)
+		}
+		if other, ok := renamed[to]; ok {
+			return fmt.Errorf("Invalid claim policy: both the claims %q and %q are renamed to %q", other, from, to)
+		}
+		renamed[to] = from
+	}
+	for name, v := range p.Static {
+		if protectedClaims[name] {
+			return fmt.Errorf("Invalid claim policy: the static claim %q is protected", name)
+		}
+		if !json.Valid(v) {
+			return fmt.Errorf("Invalid claim policy: the static claim %q is not valid JSON", name)
+		}
+	}
+	for _, d := range p.Derive {
+		if d.Claim == "" || d.GroupPrefix == "" {
+			return fmt.Errorf("Invalid claim policy: a derived claim needs a claim and a groupPrefix: %+v", d)
+		}
+		if protectedClaims[d.Claim] {
+			return fmt.Errorf("Invalid claim policy: the derived claim %q is protected", d.Claim)
+		}
+	}
+	return nil
+}
+
+// Apply returns the claims transformed by the policy. The claims are not
+// modified. A nil policy keeps all the claims.
+func (p *Policy) Apply(claims map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	if p == nil {
+		return claims, nil
+	}
+	out := map[string]json.RawMessage{}
+	for name, v := range claims {
+		out[name] = v
+	}
+
+	// 1. Derive the claims from the groups
+	if len(p.Derive) > 0 {
+		groups, err := p.groups(claims)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range p.Derive {
+			var values []string
+			for _, g := range groups {
+				if strings.HasPrefix(g, d.GroupPrefix) {
+					values = append(values, strings.TrimPrefix(g, d.GroupPrefix))
+				}
+			}
+			if len(values) == 0 {
+				continue
+			}
+			var v interface{} = values[0]
+			if d.Multiple {
+				v = values
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("Fail to encode the derived claim %q: %v", d.Claim, err)
+			}
+			out[d.Claim] = b
+		}
+	}
+
+	// 2. Filter the claims
+	if len(p.Allow) > 0 {
+		allowed := map[string]bool{}
+		for _, c := range p.Allow {
+			allowed[c] = true
+		}
+		for name := range out {
+			if !allowed[name] && !protectedClaims[name] {
+				delete(out, name)
+			}
+		}
+	}
+	for _, c := range p.Deny {
+		delete(out, c)
+	}
+
+	// 3. Rename the claims. The claims are renamed at once, so that two
+	// claims may swap their names.
+	renamed := map[string]json.RawMessage{}
+	for from, to := range p.Rename {
+		if v, ok := out[from]; ok {
+			renamed[to] = v
+			delete(out, from)
+		}
+	}
+	for name, v := range renamed {
+		out[name] = v
+	}
+
+	// 4. Add the static claims
+	for name, v := range p.Static {
+		out[name] = v
+	}
+	return out, nil
+}
+
+// groups returns the groups in the groups claim, which is a list of strings
+// or a string.
+func (p *Policy) groups(claims map[string]json.RawMessage) ([]string, error) {
+	name := p.GroupsClaim
+	if name == "" {
+		name = defaultGroupsClaim
+	}
+	raw, ok := claims[name]
+	if !ok {
+		return nil, nil
+	}
+	var groups []string
+	if err := json.Unmarshal(raw, &groups); err == nil {
+		return groups, nil
+	}
+	var group string
+	if err := json.Unmarshal(raw, &group); err != nil {
+		return nil, fmt.Errorf("The groups claim %q is neither a string nor a list of strings", name)
+	}
+	return []string{group}, nil
+}
@@ -0,0 +1,151 @@
+package claim_policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// update rewrites the golden files with the claims of the policies:
+// go test ./claim_policy -update
+var update = flag.Bool("update", false, "update the golden files")
+
+const (
+	testdataDir = "../testdata/claim_policy"
+	goldenFile  = "claims.golden.json"
+)
+
+// TestApplyGolden applies the policy in each directory of testdataDir to
+// claims.json and compares the claims with the golden file of the directory.
+func TestApplyGolden(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(testdataDir, "claims.json"))
+	if err != nil {
+		t.Fatalf("Failed to read the claims: %v", err)
+	}
+	policies, err := filepath.Glob(filepath.Join(testdataDir, "*", "policy.*"))
+	if err != nil || len(policies) == 0 {
+		t.Fatalf("Failed to find the policies: %v, %v", policies, err)
+	}
+	for _, policyFile := range policies {
+		dir := filepath.Dir(policyFile)
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			p, err := LoadPolicyFromFile(policyFile)
+			if err != nil {
+				t.Fatalf("Failed to load the policy: %v", err)
+			}
+			claims := map[string]json.RawMessage{}
+			if err := json.Unmarshal(data, &claims); err != nil {
+				t.Fatalf("Failed to parse the claims: %v", err)
+			}
+			out, err := p.Apply(claims)
+			if err != nil {
+				t.Fatalf("Apply() failed: %v", err)
+			}
+			got, err := json.MarshalIndent(out, "", "  ")
+			if err != nil {
+				t.Fatalf("Failed to encode the claims: %v", err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join(dir, goldenFile)
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatalf("Failed to update the golden file: %v", err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Failed to read the golden file: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("claims =\n%s\nwant the golden claims of %v =\n%s", got, golden, want)
+			}
+
+			// The input claims are not modified.
+			var in map[string]json.RawMessage
+			if err := json.Unmarshal(data, &in); err != nil {
+				t.Fatalf("Failed to parse the claims: %v", err)
+			}
+			if len(claims) != len(in) {
+				t.Errorf("Apply() modified the input claims: %v", claims)
+			}
+		})
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+	claims := map[string]json.RawMessage{"email": json.RawMessage(`"test-user@example.com"`)}
+	out, err := p.Apply(claims)
+	if err != nil || len(out) != 1 {
+		t.Errorf("Apply() = %v, %v, want the claims unchanged", out, err)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy string
+	}{
+		{
+			name:   "not yaml",
+			policy: "allow: [",
+		},
+		{
+			name:   "unknown field",
+			policy: "alow: [sub]",
+		},
+		{
+			name:   "deny a protected claim",
+			policy: "deny: [exp]",
+		},
+		{
+			name:   "rename a protected claim",
+			policy: "rename: {iss: issuer}",
+		},
+		{
+			name:   "rename to a protected claim",
+			policy: "rename: {client: aud}",
+		},
+		{
+			name:   "rename two claims to the same name",
+			policy: "rename: {username: name, email: name}",
+		},
+		{
+			name:   "override a protected claim",
+			policy: "static: {exp: 0}",
+		},
+		{
+			name:   "derive without a prefix",
+			policy: "derive: [{claim: tenant}]",
+		},
+		{
+			name:   "derive a protected claim",
+			policy: "derive: [{claim: aud, groupPrefix: 'aud:'}]",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if p, err := ParsePolicy([]byte(tc.policy)); err == nil {
+				t.Errorf("ParsePolicy() = %+v, want an error", p)
+			}
+		})
+	}
+}
+
+func TestApplyInvalidGroups(t *testing.T) {
+	p, err := ParsePolicy([]byte("derive: [{claim: tenant, groupPrefix: 'tenant:'}]"))
+	if err != nil {
+		t.Fatalf("Failed to parse the policy: %v", err)
+	}
+	if _, err := p.Apply(map[string]json.RawMessage{"groups": json.RawMessage(`{"tenant":"acme"}`)}); err == nil {
+		t.Errorf("Apply() with groups of an object succeeded, want an error")
+	}
+	out, err := p.Apply(map[string]json.RawMessage{"groups": json.RawMessage(`"tenant:acme"`)})
+	if err != nil || string(out["tenant"]) != `"acme"` {
+		t.Errorf("Apply() with a group of a string = %v, %v, want the tenant acme", out, err)
+	}
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"flag"
 	"github.com/golang/glog"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/claim_policy"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/unverified_jwt"
 	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
 	"gopkg.in/square/go-jose.v2"
+	"strings"
 )
 
 var (
 	tokenServiceIssuer = `"token-service"`
-	testKeyId = "DHFbpoIUqrY8t2zpA2qXfCmr5VO5ZEr4RzHU_-envvQ"
 )
 
 
@@ -17,26 +19,77 @@ var (
 //3. authorize the resigned JWT with group array (follow the user guide for groups claim)
 //4. write script to run the demo
 //5. create the detailed message flow slide
-//6. currently only resolve the "groups" claim. May extend to support any distributed claim.
 func main() {
 	var tlsCertPath string
 	var jwt string
-	flag.StringVar(&tlsCertPath, "tls-cert-path", "", "path to the root CA certificate")
+	var distributedClaims string
+	var trustedIssuerPatterns string
+	var trustedIssuersFile string
+	var claimPolicyFile string
+	flag.StringVar(&tlsCertPath, "tls-cert-path", "", "path to the root CA certificate of the trusted issuers")
 	flag.StringVar(&jwt, "jwt", "", "the JWT to authenticate")
+	flag.StringVar(&distributedClaims, "distributed-claims", "groups",
+		"comma-separated names of the distributed claims to resolve, or \"*\" for all distributed claims")
+	flag.StringVar(&trustedIssuerPatterns, "trusted-issuers", "",
+		"comma-separated patterns of the trusted JWT issuers, e.g., https://127.0.0.1:*")
+	flag.StringVar(&trustedIssuersFile, "trusted-issuers-file", "",
+		"path to a JSON file of the trusted JWT issuers and their root CA certificates")
+	flag.StringVar(&claimPolicyFile, "claim-policy-file", "",
+		"path to a YAML or JSON policy that filters and transforms the claims of the re-signed tokens")
 	flag.Parse()
-	if len(tlsCertPath) == 0 {
-		glog.Fatalf("Must specify the path to the root CA certificate --tls-cert-path.")
-	}
 	if len(jwt) == 0 {
 		glog.Fatalf("Must specify the JWT to authenticate --jwt.")
 	}
+	// The JWT is parsed once, and verified when it is resolved
+	token, err := unverified_jwt.ParseUnverified(jwt)
+	if err != nil {
+		glog.Fatalf("Failed to parse the JWT: %v", err)
+	}
+	iss, err := token.Issuer()
+	if err != nil {
+		glog.Fatalf("Failed to parse the JWT: %v", err)
+	}
+	dist, err := token.DistributedClaims()
+	if err != nil {
+		glog.Fatalf("Failed to parse the distributed claims of the JWT: %v", err)
+	}
+	glog.Infof("The unverified JWT of %v is signed with %v by the key %q", iss, token.Header.Algorithm, token.Header.KeyID)
+	if dist != nil {
+		for name := range dist.Names {
+			src, _ := dist.Source(name)
+			glog.V(2).Infof("The distributed claim %v is at %v", name, src.URL)
+		}
+	}
 
-	// Resolve the distributed groups claim
+	var trustedIssuers utils.TrustedIssuers
+	if len(trustedIssuersFile) > 0 {
+		trustedIssuers, err = utils.LoadTrustedIssuersFromFile(trustedIssuersFile)
+	} else {
+		if len(tlsCertPath) == 0 {
+			glog.Fatalf("Must specify the path to the root CA certificate --tls-cert-path.")
+		}
+		trustedIssuers, err = utils.ParseTrustedIssuers(trustedIssuerPatterns, tlsCertPath)
+	}
+	if err != nil {
+		glog.Fatalf("Failed to load the trusted issuers: %v", err)
+	}
+	if len(trustedIssuers) == 0 {
+		glog.Fatalf("Must specify the trusted issuers --trusted-issuers or --trusted-issuers-file.")
+	}
+	var policy *claim_policy.Policy
+	if len(claimPolicyFile) > 0 {
+		policy, err = claim_policy.LoadPolicyFromFile(claimPolicyFile)
+		if err != nil {
+			glog.Fatalf("Failed to load the claim policy: %v", err)
+		}
+	}
+
+	// Resolve the distributed claims
 	glog.Infof("1. Resolve the JWT ...")
-	userInfo, claims, err := utils.ResolveDistributedGroupToken("test-client-id", "groups",
-		"", "username",	tlsCertPath, jwt)
+	userInfo, claims, err := utils.ResolveDistributedClaimsParsedToken("test-client-id",
+		strings.Split(distributedClaims, ","), "groups", "", "username", trustedIssuers, token)
 	if err != nil {
-		glog.Fatalf("Failed to resolve the distributed group token: %v", err)
+		glog.Fatalf("Failed to resolve the distributed claims token: %v", err)
 	}
 	glog.Infof("The resolved groups is: %+v", userInfo.GetGroups())
 	glog.V(5).Infof("The claims are: %+v", claims)
@@ -47,15 +100,18 @@ func main() {
 	if err != nil {
 		glog.Fatalf("Failed to load signing key: %v", err)
 	}
-	// Key id needs to be consistent with the JWT issuer's key id
+	// The key id is the RFC 7638 thumbprint of the key, which is the key id in
 	// https://raw.githubusercontent.com/istio/istio/master/security/tools/jwt/samples/jwks.json
-	privKey.KeyID = testKeyId
+	// and in the /jwks of the token service
 	glog.V(5).Infof("public key is: %+v", privKey.Public())
-	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(jose.RS256),
-		Key: privKey}, nil)
+	signer, err := utils.NewJwtSigner(privKey)
 	if err != nil {
 		glog.Fatalf("Failed to create a signer: %v", err)
 	}
+	claims, err = policy.Apply(claims)
+	if err != nil {
+		glog.Fatalf("Failed to apply the claim policy: %v", err)
+	}
 	jwtResolved, err := utils.CreateJwtWithClaims(tokenServiceIssuer, signer, claims)
 	if err != nil {
 		glog.Fatalf("Failed to create a JWT with the resolved claims: %v", err)
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/golang/glog"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/claim_policy"
+	oidc "github.com/lei-tang/dev/tests/go/group-demo-2/oidc_library"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// authorizationHeader is the header of the bearer token. Envoy passes the
+	// header names in lower case.
+	authorizationHeader = "authorization"
+	bearerPrefix        = "Bearer "
+)
+
+// authzServer is an Envoy ext_authz server. It resolves the distributed claims
+// of the bearer token of a request and replaces the token with a token of the
+// resolved claims signed by the token service, so that the JWT authentication
+// and the RBAC of Istio can check the resolved groups.
+type authzServer struct {
+	// resolver resolves the distributed claims with the authenticators of
+	// the trusted issuers.
+	resolver *utils.DistributedClaimsResolver
+	// jwtOptions are the issuer, audience and lifetime of the re-signed tokens.
+	jwtOptions utils.JwtOptions
+	// policy filters and transforms the claims of the re-signed tokens.
+	policy *claim_policy.Policy
+	signer jose.Signer
+}
+
+var _ authv3.AuthorizationServer = &authzServer{}
+
+// Check implements authv3.AuthorizationServer. The token is verified with the
+// authenticator of its trusted issuer. A verified token without the
+// distributed claims is passed on unchanged. A token that fails the
+// verification or the resolution is denied.
+func (s *authzServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	header := req.GetAttributes().GetRequest().GetHttp().GetHeaders()[authorizationHeader]
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return deniedResponse(code.Code_UNAUTHENTICATED, typev3.StatusCode_Unauthorized, "no bearer token"), nil
+	}
+	jwt := strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix))
+
+	_, claims, resolved, err := s.resolver.Authenticate(ctx, jwt)
+	if err != nil {
+		glog.V(4).Infof("Failed to authenticate the token: %v", err)
+		rpcCode, httpCode, msg := deniedStatus(err)
+		return deniedResponse(rpcCode, httpCode, msg), nil
+	}
+	if !resolved {
+		glog.V(4).Infof("The token has no distributed claims to resolve")
+		return okResponse(nil), nil
+	}
+
+	claims, err = s.policy.Apply(claims)
+	if err != nil {
+		glog.V(4).Infof("Failed to apply the claim policy: %v", err)
+		return deniedResponse(code.Code_UNAUTHENTICATED, typev3.StatusCode_Unauthorized,
+			"the claims are denied by the claim policy"), nil
+	}
+	resigned, err := utils.CreateJwtWithOptions(s.signer, claims, s.jwtOptions)
+	if err != nil {
+		glog.Errorf("Failed to create a JWT with the resolved claims: %v", err)
+		return deniedResponse(code.Code_INTERNAL, typev3.StatusCode_InternalServerError,
+			"failed to sign the resolved token"), nil
+	}
+	return okResponse([]*corev3.HeaderValueOption{{
+		Header: &corev3.HeaderValue{
+			Key:   authorizationHeader,
+			Value: bearerPrefix + resigned,
+		},
+		AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}}), nil
+}
+
+// deniedStatus maps an error of the resolution to the status and the message
+// of the denied response: the failures of the issuer or of a claim source are
+// reported as unavailable so that they can be retried, an untrusted issuer or
+// claim source as forbidden, and the other failures as unauthenticated. The
+// message is fixed so that the details of the error, e.g., the URLs of the
+// issuers, are only logged.
+func deniedStatus(err error) (code.Code, typev3.StatusCode, string) {
+	switch {
+	case errors.Is(err, oidc.ErrVerifierNotReady),
+		errors.Is(err, oidc.ErrKeysUnavailable),
+		errors.Is(err, oidc.ErrClaimSourceUnavailable):
+		return code.Code_UNAVAILABLE, typev3.StatusCode_ServiceUnavailable, "the token cannot be verified now"
+	case errors.Is(err, oidc.ErrUntrustedIssuer),
+		errors.Is(err, oidc.ErrUntrustedClaimSource):
+		return code.Code_PERMISSION_DENIED, typev3.StatusCode_Forbidden, "the token issuer is not trusted"
+	default:
+		return code.Code_UNAUTHENTICATED, typev3.StatusCode_Unauthorized, "the token failed the authentication"
+	}
+}
+
+func okResponse(headers []*corev3.HeaderValueOption) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(code.Code_OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{Headers: headers},
+		},
+	}
+}
+
+func deniedResponse(rpcCode code.Code, httpCode typev3.StatusCode, msg string) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(rpcCode), Message: msg},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status: &typev3.HttpStatus{Code: httpCode},
+				Body:   msg,
+			},
+		},
+	}
+}
+
+// newAuthzServer creates an authzServer that signs the resolved tokens with
+// the key in signingKeyFile.
+func newAuthzServer(clientID string, distributedClaims []string, groupsClaim, usernameClaim string,
+	trustedIssuers utils.TrustedIssuers, jwtOptions utils.JwtOptions, policy *claim_policy.Policy,
+	signingKeyFile, keyID string) (*authzServer, error) {
+	privKey, err := utils.LoadJSONWebPrivateKeyFromFile(signingKeyFile, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the signing key: %v", err)
+	}
+	// The key id defaults to the RFC 7638 thumbprint of the key
+	if len(keyID) > 0 {
+		privKey.KeyID = keyID
+	}
+	signer, err := utils.NewJwtSigner(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a signer: %v", err)
+	}
+	return &authzServer{
+		resolver: utils.NewDistributedClaimsResolver(utils.ResolverOptions{
+			ClientID:          clientID,
+			DistributedClaims: distributedClaims,
+			GroupsClaim:       groupsClaim,
+			UsernameClaim:     usernameClaim,
+			TrustedIssuers:    trustedIssuers,
+		}),
+		jwtOptions: jwtOptions,
+		policy:     policy,
+		signer:     signer,
+	}, nil
+}
+
+// registerHealthServer registers the gRPC health service, which reports the
+// server as serving once the authenticators of the trusted issuers are ready.
+func registerHealthServer(grpcServer *grpc.Server, s *authzServer) *health.Server {
+	h := health.NewServer()
+	h.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, h)
+	go func() {
+		if err := s.resolver.WaitReady(context.Background()); err != nil {
+			glog.Errorf("The ext_authz server is not ready: %v", err)
+			return
+		}
+		h.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	}()
+	return h
+}
+
+func main() {
+	var listenAddress string
+	var tlsCertPath string
+	var trustedIssuerPatterns string
+	var trustedIssuersFile string
+	var clientID string
+	var distributedClaims string
+	var groupsClaim string
+	var usernameClaim string
+	var issuer string
+	var claimPolicyFile string
+	var audience string
+	var maxTokenLifetime time.Duration
+	var signingKeyFile string
+	var keyID string
+	flag.StringVar(&listenAddress, "listen-address", ":9001", "the address to serve the ext_authz gRPC API on")
+	flag.StringVar(&tlsCertPath, "tls-cert-path", "", "path to the root CA certificate of the trusted issuers")
+	flag.StringVar(&trustedIssuerPatterns, "trusted-issuers", "",
+		"comma-separated patterns of the trusted JWT issuers, e.g., https://127.0.0.1:*")
+	flag.StringVar(&trustedIssuersFile, "trusted-issuers-file", "",
+		"path to a JSON file of the trusted JWT issuers and their root CA certificates")
+	flag.StringVar(&clientID, "client-id", "test-client-id", "the client id the tokens must be issued for")
+	flag.StringVar(&distributedClaims, "distributed-claims", "groups",
+		"comma-separated names of the distributed claims to resolve, or \"*\" for all distributed claims")
+	flag.StringVar(&groupsClaim, "groups-claim", "groups", "the claim to use as the groups")
+	flag.StringVar(&usernameClaim, "username-claim", "username", "the claim to use as the user name")
+	flag.StringVar(&issuer, "issuer", "token-service", "the issuer of the re-signed tokens")
+	flag.StringVar(&claimPolicyFile, "claim-policy-file", "",
+		"path to a YAML or JSON policy that filters and transforms the claims of the re-signed tokens")
+	flag.StringVar(&audience, "audience", "",
+		"comma-separated audiences of the re-signed tokens, defaults to the audience of the incoming tokens")
+	flag.DurationVar(&maxTokenLifetime, "max-token-lifetime", 0,
+		"the max lifetime of the re-signed tokens, which never outlive the incoming tokens; 0 keeps their expiry")
+	flag.StringVar(&signingKeyFile, "signing-key-file", "../testdata/token_service_signing_key.pem",
+		"path to the private key to sign the resolved tokens, e.g., an Ed25519 key to sign with EdDSA")
+	flag.StringVar(&keyID, "key-id", "",
+		"the key id of the signing key in the JWKS of the issuer, defaults to the RFC 7638 thumbprint of the key")
+	flag.Parse()
+
+	var trustedIssuers utils.TrustedIssuers
+	var err error
+	if len(trustedIssuersFile) > 0 {
+		trustedIssuers, err = utils.LoadTrustedIssuersFromFile(trustedIssuersFile)
+	} else {
+		if len(tlsCertPath) == 0 {
+			glog.Fatalf("Must specify the path to the root CA certificate --tls-cert-path.")
+		}
+		trustedIssuers, err = utils.ParseTrustedIssuers(trustedIssuerPatterns, tlsCertPath)
+	}
+	if err != nil {
+		glog.Fatalf("Failed to load the trusted issuers: %v", err)
+	}
+	if len(trustedIssuers) == 0 {
+		glog.Fatalf("Must specify the trusted issuers --trusted-issuers or --trusted-issuers-file.")
+	}
+
+	var policy *claim_policy.Policy
+	if len(claimPolicyFile) > 0 {
+		policy, err = claim_policy.LoadPolicyFromFile(claimPolicyFile)
+		if err != nil {
+			glog.Fatalf("Failed to load the claim policy: %v", err)
+		}
+	}
+	jwtOptions := utils.JwtOptions{
+		Issuer:        issuer,
+		MaxLifetime:   maxTokenLifetime,
+		ResetIssuedAt: true,
+		NewID:         true,
+	}
+	if len(audience) > 0 {
+		jwtOptions.Audience = strings.Split(audience, ",")
+	}
+	s, err := newAuthzServer(clientID, strings.Split(distributedClaims, ","), groupsClaim, usernameClaim,
+		trustedIssuers, jwtOptions, policy, signingKeyFile, keyID)
+	if err != nil {
+		glog.Fatalf("Failed to create the ext_authz server: %v", err)
+	}
+	lis, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		glog.Fatalf("Failed to listen on %v: %v", listenAddress, err)
+	}
+	grpcServer := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(grpcServer, s)
+	// The server is not serving until the trusted issuers are discovered
+	s.resolver.WarmUp()
+	registerHealthServer(grpcServer, s)
+	glog.Infof("Serving the ext_authz gRPC API on %v", lis.Addr())
+	if err := grpcServer.Serve(lis); err != nil {
+		glog.Fatalf("Failed to serve the ext_authz gRPC API: %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils/test_idp"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	testPlainClaims = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "username": "test-user-name",
+	  "groups": ["group1"],
+	  "exp": 10413792000
+	}`
+
+	testExpiredPlainClaims = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "username": "test-user-name",
+	  "groups": ["group1"],
+	  "exp": 1000000000
+	}`
+)
+
+// startAuthzServer serves s on a local listener and returns a client of it.
+func startAuthzServer(t *testing.T, s authv3.AuthorizationServer) (authv3.AuthorizationClient, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(grpcServer, s)
+	go grpcServer.Serve(lis)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		grpcServer.Stop()
+		t.Fatalf("Failed to create a gRPC client: %v", err)
+	}
+	return authv3.NewAuthorizationClient(conn), func() {
+		conn.Close()
+		grpcServer.Stop()
+	}
+}
+
+func newCheckRequest(headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  "GET",
+					Path:    "/ip",
+					Headers: headers,
+				},
+			},
+		},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	s, err := newAuthzServer(test_idp.ClientID, []string{"groups"}, "groups", "username", idp.TrustedIssuers(t),
+		utils.JwtOptions{Issuer: "token-service", ResetIssuedAt: true, NewID: true}, nil,
+		"../testdata/token_service_signing_key.pem", "")
+	if err != nil {
+		t.Fatalf("Failed to create the ext_authz server: %v", err)
+	}
+	client, stop := startAuthzServer(t, s)
+	defer stop()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	untrustedSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: priv}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	bearer := func(jwt string) map[string]string {
+		return map[string]string{"authorization": "Bearer " + jwt}
+	}
+	plain := idp.Sign(t, idp.Signer, idp.Server.URL, testPlainClaims)
+
+	testCases := []struct {
+		name     string
+		headers  map[string]string
+		wantCode code.Code
+		// wantHTTP is the status of a denied response.
+		wantHTTP typev3.StatusCode
+		// wantGroups are the groups of the re-signed token, if any.
+		wantGroups []string
+	}{
+		{
+			name:       "distributed groups",
+			headers:    bearer(idp.Sign(t, idp.Signer, idp.Server.URL, test_idp.DistributedClaims)),
+			wantCode:   code.Code_OK,
+			wantGroups: []string{"group1", "group2"},
+		},
+		{
+			name:     "no distributed claims",
+			headers:  bearer(plain),
+			wantCode: code.Code_OK,
+		},
+		{
+			name:     "no token",
+			headers:  map[string]string{},
+			wantCode: code.Code_UNAUTHENTICATED,
+			wantHTTP: typev3.StatusCode_Unauthorized,
+		},
+		{
+			name:     "not a bearer token",
+			headers:  map[string]string{"authorization": "Basic dXNlcjpwYXNz"},
+			wantCode: code.Code_UNAUTHENTICATED,
+			wantHTTP: typev3.StatusCode_Unauthorized,
+		},
+		{
+			name:     "bad signature",
+			headers:  bearer(idp.Sign(t, untrustedSigner, idp.Server.URL, test_idp.DistributedClaims)),
+			wantCode: code.Code_UNAUTHENTICATED,
+			wantHTTP: typev3.StatusCode_Unauthorized,
+		},
+		{
+			name:     "forged token without distributed claims",
+			headers:  bearer(idp.Sign(t, untrustedSigner, idp.Server.URL, testPlainClaims)),
+			wantCode: code.Code_UNAUTHENTICATED,
+			wantHTTP: typev3.StatusCode_Unauthorized,
+		},
+		{
+			name:     "expired token without distributed claims",
+			headers:  bearer(idp.Sign(t, idp.Signer, idp.Server.URL, testExpiredPlainClaims)),
+			wantCode: code.Code_UNAUTHENTICATED,
+			wantHTTP: typev3.StatusCode_Unauthorized,
+		},
+		{
+			name:     "untrusted issuer without distributed claims",
+			headers:  bearer(idp.Sign(t, idp.Signer, "https://untrusted.example.com", testPlainClaims)),
+			wantCode: code.Code_PERMISSION_DENIED,
+			wantHTTP: typev3.StatusCode_Forbidden,
+		},
+		{
+			name:     "malformed token",
+			headers:  bearer("not.a.jwt"),
+			wantCode: code.Code_UNAUTHENTICATED,
+			wantHTTP: typev3.StatusCode_Unauthorized,
+		},
+		{
+			name:     "untrusted issuer",
+			headers:  bearer(idp.Sign(t, idp.Signer, "https://untrusted.example.com", test_idp.DistributedClaims)),
+			wantCode: code.Code_PERMISSION_DENIED,
+			wantHTTP: typev3.StatusCode_Forbidden,
+		},
+		{
+			name:     "claim source unavailable",
+			headers:  bearer(idp.Sign(t, idp.Signer, idp.Server.URL, test_idp.WrongAccessToken)),
+			wantCode: code.Code_UNAVAILABLE,
+			wantHTTP: typev3.StatusCode_ServiceUnavailable,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client.Check(context.Background(), newCheckRequest(tc.headers))
+			if err != nil {
+				t.Fatalf("Check() failed: %v", err)
+			}
+			if got := code.Code(resp.GetStatus().GetCode()); got != tc.wantCode {
+				t.Fatalf("Check() code = %v (%v), want %v", got, resp.GetStatus().GetMessage(), tc.wantCode)
+			}
+			if tc.wantCode != code.Code_OK {
+				denied := resp.GetDeniedResponse()
+				if denied == nil {
+					t.Fatalf("Check() response = %v, want a denied response", resp)
+				}
+				if got := denied.GetStatus().GetCode(); got != tc.wantHTTP {
+					t.Errorf("denied response status = %v, want %v", got, tc.wantHTTP)
+				}
+				// The details of the error are only logged
+				if body := denied.GetBody(); strings.Contains(body, "127.0.0.1") || strings.Contains(body, "example.com") ||
+					body != resp.GetStatus().GetMessage() {
+					t.Errorf("denied response body = %q, status message = %q, want a fixed message",
+						body, resp.GetStatus().GetMessage())
+				}
+				return
+			}
+
+			ok := resp.GetOkResponse()
+			if ok == nil {
+				t.Fatalf("Check() response = %v, want an ok response", resp)
+			}
+			if tc.wantGroups == nil {
+				if len(ok.GetHeaders()) != 0 {
+					t.Errorf("ok response headers = %v, want none", ok.GetHeaders())
+				}
+				return
+			}
+			if len(ok.GetHeaders()) != 1 {
+				t.Fatalf("ok response headers = %v, want the authorization header", ok.GetHeaders())
+			}
+			h := ok.GetHeaders()[0]
+			if h.GetHeader().GetKey() != "authorization" ||
+				h.GetAppendAction() != corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD {
+				t.Errorf("ok response header = %v, want to overwrite the authorization header", h)
+			}
+			value := h.GetHeader().GetValue()
+			if !strings.HasPrefix(value, "Bearer ") {
+				t.Fatalf("authorization header = %q, want a bearer token", value)
+			}
+			claims := test_idp.VerifyResigned(t, strings.TrimPrefix(value, "Bearer "))
+			if got := string(claims["iss"]); got != `"token-service"` {
+				t.Errorf("re-signed token iss = %v, want \"token-service\"", got)
+			}
+			var groups []string
+			if err := json.Unmarshal(claims["groups"], &groups); err != nil {
+				t.Fatalf("Failed to parse the groups of the re-signed token: %v", err)
+			}
+			if !reflect.DeepEqual(groups, tc.wantGroups) {
+				t.Errorf("re-signed token groups = %v, want %v", groups, tc.wantGroups)
+			}
+			if _, ok := claims["_claim_names"]; ok {
+				t.Errorf("re-signed token has _claim_names, want the resolved claims only")
+			}
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	newServer := func(trustedIssuers utils.TrustedIssuers) *authzServer {
+		s, err := newAuthzServer(test_idp.ClientID, []string{"groups"}, "groups", "username", trustedIssuers,
+			utils.JwtOptions{Issuer: "token-service"}, nil, "../testdata/token_service_signing_key.pem", "")
+		if err != nil {
+			t.Fatalf("Failed to create the ext_authz server: %v", err)
+		}
+		s.resolver.WarmUp()
+		return s
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The trusted issuer can't be discovered
+	unreachable := newServer(utils.TrustedIssuers{{Pattern: "https://127.0.0.1:1"}})
+	defer unreachable.resolver.Close()
+	h := registerHealthServer(grpc.NewServer(), unreachable)
+	if resp, err := h.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil ||
+		resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("health = %v, %v before the issuer is discovered, want NOT_SERVING", resp, err)
+	}
+
+	s := newServer(idp.TrustedIssuers(t))
+	defer s.resolver.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	registerHealthServer(grpcServer, s)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create a gRPC client: %v", err)
+	}
+	defer conn.Close()
+	watch, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Failed to watch the health: %v", err)
+	}
+	for {
+		resp, err := watch.Recv()
+		if err != nil {
+			t.Fatalf("The server is not serving after the issuer is discovered: %v", err)
+		}
+		if resp.Status == healthpb.HealthCheckResponse_SERVING {
+			break
+		}
+	}
+}
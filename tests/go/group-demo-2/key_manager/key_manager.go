@@ -0,0 +1,419 @@
+package key_manager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"gopkg.in/square/go-jose.v2"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// KeyState is the state of a signing key.
+type KeyState string
+
+const (
+	// StatePending is the state of the next key: it is published, so that
+	// the verifiers fetch it before it signs any token, but does not sign.
+	StatePending KeyState = "pending"
+	// StateActive is the state of the key that signs the tokens.
+	StateActive KeyState = "active"
+	// StateRetiring is the state of a former active key: it no longer signs,
+	// but is published until the tokens it signed expire.
+	StateRetiring KeyState = "retiring"
+)
+
+const (
+	defaultRotationPeriod = 24 * time.Hour
+	defaultCheckInterval  = time.Minute
+	keySize               = 2048
+)
+
+// Options configures a KeyManager.
+type Options struct {
+	// File is the path of the file the keys are persisted in, so that a
+	// restart keeps the keys of the tokens already issued. It is created if it
+	// does not exist.
+	File string
+
+	// RotationPeriod is how long a key is active before it is rotated by
+	// Run. The default is 24 hours.
+	RotationPeriod time.Duration
+
+	// RetirementPeriod is how long a key is published after it is rotated.
+	// It must be at least the lifetime of the tokens it signed. The default is
+	// the RotationPeriod.
+	RetirementPeriod time.Duration
+
+	// CheckInterval is how often Run checks whether a rotation is due. The
+	// default is one minute.
+	CheckInterval time.Duration
+
+	// Algorithm is the signature algorithm of the generated keys: RS256,
+	// ES256 or EdDSA. The default is RS256. The keys already in File keep
+	// their algorithms.
+	Algorithm jose.SignatureAlgorithm
+
+	now         func() time.Time
+	generateKey func(alg jose.SignatureAlgorithm) (*jose.JSONWebKey, error)
+}
+
+// managedKey is a signing key and its state, as persisted in the key file.
+type managedKey struct {
+	State KeyState `json:"state"`
+	// Since is when the key entered its state.
+	Since time.Time       `json:"since"`
+	Key   jose.JSONWebKey `json:"key"`
+
+	signer jose.Signer
+}
+
+// keyFile is the content of the key file.
+type keyFile struct {
+	Keys []*managedKey `json:"keys"`
+}
+
+// KeyManager holds the signing keys of an issuer. It signs with the active
+// key, publishes all the keys that are not expired and rotates the keys:
+// the pending key becomes active, the active key retiring and a new pending
+// key is generated. It implements jose.Signer.
+type KeyManager struct {
+	file             string
+	rotationPeriod   time.Duration
+	retirementPeriod time.Duration
+	checkInterval    time.Duration
+	algorithm        jose.SignatureAlgorithm
+	now              func() time.Time
+	generateKey      func(alg jose.SignatureAlgorithm) (*jose.JSONWebKey, error)
+
+	m    sync.RWMutex
+	keys []*managedKey
+}
+
+var _ jose.Signer = &KeyManager{}
+
+// NewKeyManager loads the keys persisted in opts.File, or generates an active
+// and a pending key if there are none.
+func NewKeyManager(opts Options) (*KeyManager, error) {
+	if opts.File == "" {
+		return nil, fmt.Errorf("no key file")
+	}
+	m := &KeyManager{
+		file:             opts.File,
+		rotationPeriod:   opts.RotationPeriod,
+		retirementPeriod: opts.RetirementPeriod,
+		checkInterval:    opts.CheckInterval,
+		algorithm:        opts.Algorithm,
+		now:              opts.now,
+		generateKey:      opts.generateKey,
+	}
+	if m.rotationPeriod <= 0 {
+		m.rotationPeriod = defaultRotationPeriod
+	}
+	if m.retirementPeriod <= 0 {
+		m.retirementPeriod = m.rotationPeriod
+	}
+	if m.checkInterval <= 0 {
+		m.checkInterval = defaultCheckInterval
+	}
+	if m.algorithm == "" {
+		m.algorithm = jose.RS256
+	}
+	if m.now == nil {
+		m.now = time.Now
+	}
+	if m.generateKey == nil {
+		m.generateKey = generateKey
+	}
+	// Fail now rather than at the first rotation
+	switch m.algorithm {
+	case jose.RS256, jose.ES256, jose.EdDSA:
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %v", m.algorithm)
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	if m.activeKey() == nil {
+		// Rotate twice so that there are both an active and a pending key.
+		if err := m.rotateLocked(); err != nil {
+			return nil, err
+		}
+		if err := m.rotateLocked(); err != nil {
+			return nil, err
+		}
+	} else if err := m.pruneLocked(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Sign implements jose.Signer with the active key.
+func (m *KeyManager) Sign(payload []byte) (*jose.JSONWebSignature, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	k := m.activeKey()
+	if k == nil {
+		return nil, fmt.Errorf("no active signing key")
+	}
+	return k.signer.Sign(payload)
+}
+
+// Options implements jose.Signer.
+func (m *KeyManager) Options() jose.SignerOptions {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	if k := m.activeKey(); k != nil {
+		return k.signer.Options()
+	}
+	return jose.SignerOptions{}
+}
+
+// ActiveKeyID returns the key id of the active key.
+func (m *KeyManager) ActiveKeyID() string {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	if k := m.activeKey(); k != nil {
+		return k.Key.KeyID
+	}
+	return ""
+}
+
+// PublicKeys returns the public keys of the pending, the active and the
+// retiring keys that are not expired.
+func (m *KeyManager) PublicKeys() jose.JSONWebKeySet {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	now := m.now()
+	var jwks jose.JSONWebKeySet
+	for _, k := range m.keys {
+		if m.expired(k, now) {
+			continue
+		}
+		pub := k.Key.Public()
+		pub.Use = "sig"
+		jwks.Keys = append(jwks.Keys, pub)
+	}
+	return jwks
+}
+
+// Rotate rotates the keys now and persists them.
+func (m *KeyManager) Rotate() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.rotateLocked()
+}
+
+// Run rotates the keys every RotationPeriod until stopCh is closed.
+func (m *KeyManager) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := m.rotateIfDue(); err != nil {
+			glog.Errorf("Failed to rotate the signing keys: %v", err)
+		}
+	}, m.checkInterval, stopCh)
+}
+
+// rotateIfDue rotates the keys if the active key is older than the
+// RotationPeriod, and drops the expired keys.
+func (m *KeyManager) rotateIfDue() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if k := m.activeKey(); k == nil || !m.now().Before(k.Since.Add(m.rotationPeriod)) {
+		return m.rotateLocked()
+	}
+	return m.pruneLocked()
+}
+
+func (m *KeyManager) rotateLocked() error {
+	key, err := m.generateKey(m.algorithm)
+	if err != nil {
+		return fmt.Errorf("failed to generate a signing key: %v", err)
+	}
+	now := m.now()
+	next, err := newManagedKey(key, StatePending, now)
+	if err != nil {
+		return err
+	}
+
+	// Build the rotated keys aside so that the keys are unchanged if they
+	// cannot be persisted.
+	keys := make([]*managedKey, 0, len(m.keys)+1)
+	for _, k := range m.keys {
+		switch k.State {
+		case StateActive:
+			retiring := *k
+			retiring.State, retiring.Since = StateRetiring, now
+			k = &retiring
+		case StatePending:
+			active := *k
+			active.State, active.Since = StateActive, now
+			k = &active
+		}
+		keys = append(keys, k)
+	}
+	keys = m.unexpired(append(keys, next), now)
+	if err := m.save(keys); err != nil {
+		return err
+	}
+	m.keys = keys
+	glog.Infof("Rotated the signing keys, the active key is %q", m.activeKeyID())
+	return nil
+}
+
+// pruneLocked drops the expired keys and persists the keys if any was
+// dropped.
+func (m *KeyManager) pruneLocked() error {
+	keys := m.unexpired(m.keys, m.now())
+	if len(keys) == len(m.keys) {
+		return nil
+	}
+	if err := m.save(keys); err != nil {
+		return err
+	}
+	m.keys = keys
+	return nil
+}
+
+// unexpired returns a new slice of the keys that are not expired at now.
+func (m *KeyManager) unexpired(keys []*managedKey, now time.Time) []*managedKey {
+	var kept []*managedKey
+	for _, k := range keys {
+		if m.expired(k, now) {
+			glog.Infof("Dropping the expired signing key %q", k.Key.KeyID)
+			continue
+		}
+		kept = append(kept, k)
+	}
+	return kept
+}
+
+func (m *KeyManager) expired(k *managedKey, now time.Time) bool {
+	return k.State == StateRetiring && !now.Before(k.Since.Add(m.retirementPeriod))
+}
+
+func (m *KeyManager) activeKey() *managedKey {
+	for _, k := range m.keys {
+		if k.State == StateActive {
+			return k
+		}
+	}
+	return nil
+}
+
+func (m *KeyManager) activeKeyID() string {
+	if k := m.activeKey(); k != nil {
+		return k.Key.KeyID
+	}
+	return ""
+}
+
+// load reads the key file, if it exists.
+func (m *KeyManager) load() error {
+	data, err := ioutil.ReadFile(m.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the key file: %v", err)
+	}
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("failed to parse the key file %v: %v", m.file, err)
+	}
+	for _, k := range f.Keys {
+		loaded, err := newManagedKey(&k.Key, k.State, k.Since)
+		if err != nil {
+			return fmt.Errorf("invalid key %q in the key file %v: %v", k.Key.KeyID, m.file, err)
+		}
+		m.keys = append(m.keys, loaded)
+	}
+	return nil
+}
+
+// save writes the keys to a temporary file and renames it to the key file, so
+// that the key file is never partially written.
+func (m *KeyManager) save(keys []*managedKey) error {
+	data, err := json.MarshalIndent(&keyFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the keys: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(m.file), filepath.Base(m.file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create the key file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to create the key file: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write the key file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write the key file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), m.file); err != nil {
+		return fmt.Errorf("failed to write the key file: %v", err)
+	}
+	return nil
+}
+
+func newManagedKey(key *jose.JSONWebKey, state KeyState, since time.Time) (*managedKey, error) {
+	switch state {
+	case StatePending, StateActive, StateRetiring:
+	default:
+		return nil, fmt.Errorf("unknown key state %q", state)
+	}
+	if key.IsPublic() {
+		return nil, fmt.Errorf("not a private key")
+	}
+	signer, err := utils.NewJwtSigner(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a signer: %v", err)
+	}
+	return &managedKey{State: state, Since: since, Key: *key, signer: signer}, nil
+}
+
+// generateKey generates a key for alg whose key id is its RFC 7638
+// thumbprint, like the keys of utils.LoadJSONWebPrivateKeyFromFile.
+func generateKey(alg jose.SignatureAlgorithm) (*jose.JSONWebKey, error) {
+	var priv interface{}
+	var err error
+	switch alg {
+	case jose.RS256:
+		priv, err = rsa.GenerateKey(rand.Reader, keySize)
+	case jose.ES256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.EdDSA:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported key algorithm %v", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := &jose.JSONWebKey{Key: priv, Algorithm: string(alg)}
+	hash, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	key.KeyID = base64.RawURLEncoding.EncodeToString(hash)
+	return key, nil
+}
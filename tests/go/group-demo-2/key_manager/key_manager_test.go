@@ -0,0 +1,291 @@
+package key_manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// fakeClock is a clock the tests advance by hand.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestKeyManager(t *testing.T, file string, clock *fakeClock) *KeyManager {
+	m, err := NewKeyManager(Options{
+		File:             file,
+		RotationPeriod:   time.Hour,
+		RetirementPeriod: 2 * time.Hour,
+		now:              clock.Now,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a key manager: %v", err)
+	}
+	return m
+}
+
+// states returns the states of the keys by key id.
+func states(m *KeyManager) map[string]KeyState {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	s := map[string]KeyState{}
+	for _, k := range m.keys {
+		s[k.Key.KeyID] = k.State
+	}
+	return s
+}
+
+// keyIDs returns the key ids of a JWKS.
+func keyIDs(jwks jose.JSONWebKeySet) map[string]bool {
+	ids := map[string]bool{}
+	for _, key := range jwks.Keys {
+		ids[key.KeyID] = true
+	}
+	return ids
+}
+
+// sign signs a payload with m and returns the JWS.
+func sign(t *testing.T, m *KeyManager) string {
+	jws, err := m.Sign([]byte(`{"iss":"token-service"}`))
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	s, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize the JWS: %v", err)
+	}
+	return s
+}
+
+// verify verifies jwt with the published keys of m.
+func verify(m *KeyManager, jwt string) error {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return err
+	}
+	jwks := m.PublicKeys()
+	keys := jwks.Key(jws.Signatures[0].Header.KeyID)
+	if len(keys) != 1 {
+		return jose.ErrCryptoFailure
+	}
+	_, err = jws.Verify(keys[0])
+	return err
+}
+
+func TestKeyManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "key_manager")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys.json")
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+
+	m := newTestKeyManager(t, file, clock)
+	first := m.ActiveKeyID()
+	s := states(m)
+	if len(s) != 2 || s[first] != StateActive {
+		t.Fatalf("new key manager states = %v, want an active and a pending key", s)
+	}
+	var pending string
+	for kid, state := range s {
+		if state == StatePending {
+			pending = kid
+		}
+	}
+	if pending == "" {
+		t.Fatalf("new key manager states = %v, want a pending key", s)
+	}
+	if ids := keyIDs(m.PublicKeys()); !reflect.DeepEqual(ids, map[string]bool{first: true, pending: true}) {
+		t.Errorf("published keys = %v, want the active and the pending keys", ids)
+	}
+	for _, key := range m.PublicKeys().Keys {
+		if !key.IsPublic() || key.Use != "sig" {
+			t.Errorf("published key = %+v, want a public signing key", key)
+		}
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file = %v, %v, want a file of mode 0600", info, err)
+	}
+	token := sign(t, m)
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("Failed to parse the JWS: %v", err)
+	}
+	if kid := jws.Signatures[0].Header.KeyID; kid != first {
+		t.Errorf("JWS kid = %q, want the active key %q", kid, first)
+	}
+
+	// A restart keeps the keys.
+	m = newTestKeyManager(t, file, clock)
+	if got := states(m); !reflect.DeepEqual(got, s) {
+		t.Errorf("reloaded states = %v, want %v", got, s)
+	}
+	if err := verify(m, token); err != nil {
+		t.Errorf("Failed to verify a token signed before the restart: %v", err)
+	}
+
+	// A rotation is not due before the RotationPeriod.
+	clock.now = clock.now.Add(59 * time.Minute)
+	if err := m.rotateIfDue(); err != nil {
+		t.Fatalf("rotateIfDue() failed: %v", err)
+	}
+	if m.ActiveKeyID() != first {
+		t.Errorf("active key = %q before the rotation period, want %q", m.ActiveKeyID(), first)
+	}
+
+	// The pending key becomes active and the active key retiring.
+	clock.now = clock.now.Add(time.Minute)
+	if err := m.rotateIfDue(); err != nil {
+		t.Fatalf("rotateIfDue() failed: %v", err)
+	}
+	if m.ActiveKeyID() != pending {
+		t.Errorf("active key = %q after the rotation, want the pending key %q", m.ActiveKeyID(), pending)
+	}
+	s = states(m)
+	if len(s) != 3 || s[first] != StateRetiring {
+		t.Errorf("rotated states = %v, want the first key retiring and a new pending key", s)
+	}
+	if err := verify(m, token); err != nil {
+		t.Errorf("Failed to verify a token of a retiring key: %v", err)
+	}
+	if jws, err := jose.ParseSigned(sign(t, m)); err != nil || jws.Signatures[0].Header.KeyID != pending {
+		t.Errorf("rotated JWS = %v, %v, want the kid %q", jws, err, pending)
+	}
+
+	// A rotation on command retires the second key; the first key expires
+	// at the end of the RetirementPeriod.
+	clock.now = clock.now.Add(time.Hour)
+	if err := m.Rotate(); err != nil {
+		t.Fatalf("Rotate() failed: %v", err)
+	}
+	if err := verify(m, token); err != nil {
+		t.Errorf("Failed to verify a token of a retiring key: %v", err)
+	}
+	clock.now = clock.now.Add(time.Hour)
+	if err := m.Rotate(); err != nil {
+		t.Fatalf("Rotate() failed: %v", err)
+	}
+	if _, ok := states(m)[first]; ok {
+		t.Errorf("states = %v, want the first key dropped after the retirement period", states(m))
+	}
+	if err := verify(m, token); err == nil {
+		t.Errorf("verified a token of an expired key, want an error")
+	}
+	m = newTestKeyManager(t, file, clock)
+	if _, ok := states(m)[first]; ok {
+		t.Errorf("reloaded states = %v, want the expired key dropped", states(m))
+	}
+}
+
+func TestKeyManagerRotateSaveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "key_manager")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	m := newTestKeyManager(t, filepath.Join(dir, "keys.json"), clock)
+	active := m.ActiveKeyID()
+	s := states(m)
+
+	// The keys cannot be persisted in a directory that does not exist.
+	m.file = filepath.Join(dir, "missing", "keys.json")
+	clock.now = clock.now.Add(3 * time.Hour)
+	if err := m.Rotate(); err == nil {
+		t.Fatalf("Rotate() succeeded, want an error")
+	}
+	if got := states(m); !reflect.DeepEqual(got, s) {
+		t.Errorf("states after a failed rotation = %v, want %v", got, s)
+	}
+	if jws, err := jose.ParseSigned(sign(t, m)); err != nil || jws.Signatures[0].Header.KeyID != active {
+		t.Errorf("JWS after a failed rotation = %v, %v, want the kid %q", jws, err, active)
+	}
+}
+
+func TestKeyManagerInvalidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "key_manager")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "not json",
+			content: "not json",
+		},
+		{
+			name:    "unknown state",
+			content: `{"keys":[{"state":"revoked","since":"2020-09-13T12:26:40Z","key":{"kty":"oct","k":"c2VjcmV0"}}]}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(dir, "keys.json")
+			if err := ioutil.WriteFile(file, []byte(tc.content), 0600); err != nil {
+				t.Fatalf("Failed to write the key file: %v", err)
+			}
+			if _, err := NewKeyManager(Options{File: file}); err == nil {
+				t.Errorf("NewKeyManager() succeeded, want an error")
+			}
+		})
+	}
+	if _, err := NewKeyManager(Options{}); err == nil {
+		t.Errorf("NewKeyManager() without a key file succeeded, want an error")
+	}
+}
+
+func TestKeyManagerAlgorithm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "key_manager")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, alg := range []jose.SignatureAlgorithm{jose.RS256, jose.ES256, jose.EdDSA} {
+		t.Run(string(alg), func(t *testing.T) {
+			file := filepath.Join(dir, string(alg)+".json")
+			m, err := NewKeyManager(Options{File: file, Algorithm: alg})
+			if err != nil {
+				t.Fatalf("Failed to create a key manager: %v", err)
+			}
+			token := sign(t, m)
+			jws, err := jose.ParseSigned(token)
+			if err != nil {
+				t.Fatalf("Failed to parse the JWS: %v", err)
+			}
+			if got := jws.Signatures[0].Header.Algorithm; got != string(alg) {
+				t.Errorf("JWS alg = %v, want %v", got, alg)
+			}
+			for _, key := range m.PublicKeys().Keys {
+				if key.Algorithm != string(alg) {
+					t.Errorf("published key alg = %v, want %v", key.Algorithm, alg)
+				}
+			}
+			// The keys keep their algorithm after a restart.
+			m, err = NewKeyManager(Options{File: file})
+			if err != nil {
+				t.Fatalf("Failed to reload the key manager: %v", err)
+			}
+			if err := verify(m, token); err != nil {
+				t.Errorf("Failed to verify a token signed before the restart: %v", err)
+			}
+		})
+	}
+	if _, err := NewKeyManager(Options{File: filepath.Join(dir, "HS256.json"), Algorithm: jose.HS256}); err == nil {
+		t.Errorf("NewKeyManager() with HS256 succeeded, want an error")
+	}
+}
@@ -0,0 +1,129 @@
+package oidc_library
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClaimCacheStats reports the counters of the cache of resolved distributed
+// claims.
+type ClaimCacheStats struct {
+	// Hits is the number of lookups served from the cache.
+	Hits uint64
+	// Misses is the number of lookups that required a call to the endpoint.
+	Misses uint64
+	// Entries is the number of entries currently in the cache.
+	Entries int
+}
+
+// claimCacheEntry is a verified claim JWT returned by a distributed claims
+// endpoint.
+type claimCacheEntry struct {
+	key    string
+	claims claims
+	expiry time.Time
+}
+
+// claimCache is a bounded, concurrency-safe LRU cache of the verified claims
+// returned by distributed claims endpoints. Entries are keyed on the endpoint
+// URL and a hash of the access token, and expire at the expiry of the claim
+// JWT or after maxTTL, whichever comes first.
+type claimCache struct {
+	maxEntries int
+	maxTTL     time.Duration
+	now        func() time.Time
+
+	hits   uint64
+	misses uint64
+
+	// Guarded by m.
+	entries map[string]*list.Element
+	// lru holds *claimCacheEntry, the most recently used at the front.
+	// Guarded by m.
+	lru *list.List
+
+	m sync.Mutex
+}
+
+// newClaimCache creates a cache holding at most maxEntries entries. A zero
+// maxTTL bounds the lifetime of an entry only by the expiry of its claim JWT.
+func newClaimCache(maxEntries int, maxTTL time.Duration, now func() time.Time) *claimCache {
+	return &claimCache{
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+		now:        now,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// claimCacheKey returns the cache key for a distributed claims endpoint and
+// the access token used to call it. The access token is hashed so that it is
+// not kept in memory longer than needed.
+func claimCacheKey(url, accessToken string) string {
+	hash := sha256.Sum256([]byte(accessToken))
+	return url + "#" + hex.EncodeToString(hash[:])
+}
+
+// get returns the claims cached for key, or false if there are none or they
+// have expired.
+func (c *claimCache) get(key string) (claims, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*claimCacheEntry)
+		if c.now().Before(entry.expiry) {
+			c.lru.MoveToFront(e)
+			atomic.AddUint64(&c.hits, 1)
+			return entry.claims, true
+		}
+		c.remove(e)
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return nil, false
+}
+
+// add caches the claims for key until expiry, or until maxTTL from now if
+// that is earlier. The least recently used entry is evicted when the cache is
+// full.
+func (c *claimCache) add(key string, cl claims, expiry time.Time) {
+	now := c.now()
+	if c.maxTTL > 0 && (expiry.IsZero() || now.Add(c.maxTTL).Before(expiry)) {
+		expiry = now.Add(c.maxTTL)
+	}
+	if !now.Before(expiry) {
+		// Already expired, or no expiry at all.
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&claimCacheEntry{key: key, claims: cl, expiry: expiry})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes an entry. The caller must hold c.m.
+func (c *claimCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*claimCacheEntry).key)
+}
+
+// stats returns the current counters of the cache.
+func (c *claimCache) stats() ClaimCacheStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return ClaimCacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: c.lru.Len(),
+	}
+}
@@ -0,0 +1,112 @@
+package oidc_library
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ClaimSourcePolicy restricts where distributed claims may be resolved from
+// and who may sign the claim JWTs.
+type ClaimSourcePolicy struct {
+	// AllowedEndpointPrefixes are the URL prefixes of the distributed claim
+	// endpoints that may be called, e.g., "https://idp.example.com/claims".
+	// A prefix matches an endpoint with the same scheme and host whose path is
+	// the prefix path or below it. If empty, only endpoints under the issuer
+	// URL of the token may be called.
+	AllowedEndpointPrefixes []string
+
+	// AllowedClaimIssuers maps the issuer of a token to the issuers that may
+	// sign the claim JWTs of its distributed and aggregated claims. A token
+	// issuer without an entry only trusts claim JWTs that it signed itself.
+	AllowedClaimIssuers map[string][]string
+}
+
+// UntrustedClaimEndpointError is returned when a token names a distributed
+// claim endpoint that the ClaimSourcePolicy does not allow.
+type UntrustedClaimEndpointError struct {
+	// Endpoint is the URL of the distributed claim endpoint.
+	Endpoint string
+	// TokenIssuer is the issuer of the token naming the endpoint.
+	TokenIssuer string
+}
+
+func (e *UntrustedClaimEndpointError) Error() string {
+	return fmt.Sprintf("oidc: distributed claim endpoint %q of issuer %q is not allowed", e.Endpoint, e.TokenIssuer)
+}
+
+func (e *UntrustedClaimEndpointError) Is(target error) bool {
+	return target == ErrUntrustedClaimSource
+}
+
+// UntrustedClaimIssuerError is returned when a claim JWT is signed by an
+// issuer that the ClaimSourcePolicy does not allow for the token issuer.
+type UntrustedClaimIssuerError struct {
+	// Issuer is the unverified issuer of the claim JWT.
+	Issuer string
+	// TokenIssuer is the issuer of the token containing the claim.
+	TokenIssuer string
+}
+
+func (e *UntrustedClaimIssuerError) Error() string {
+	return fmt.Sprintf("oidc: claim JWT issuer %q is not allowed for issuer %q", e.Issuer, e.TokenIssuer)
+}
+
+func (e *UntrustedClaimIssuerError) Is(target error) bool {
+	return target == ErrUntrustedClaimSource
+}
+
+// checkEndpoint returns an error if the distributed claim endpoint of a token
+// of tokenIssuer is not allowed.
+func (p *ClaimSourcePolicy) checkEndpoint(tokenIssuer, endpoint string) error {
+	prefixes := p.AllowedEndpointPrefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{tokenIssuer}
+	}
+	for _, prefix := range prefixes {
+		if hasURLPrefix(endpoint, prefix) {
+			return nil
+		}
+	}
+	return &UntrustedClaimEndpointError{Endpoint: endpoint, TokenIssuer: tokenIssuer}
+}
+
+// checkIssuer returns an error if a claim JWT issued by claimIssuer is not
+// allowed in a token of tokenIssuer.
+func (p *ClaimSourcePolicy) checkIssuer(tokenIssuer, claimIssuer string) error {
+	allowed, ok := p.AllowedClaimIssuers[tokenIssuer]
+	if !ok {
+		allowed = []string{tokenIssuer}
+	}
+	for _, iss := range allowed {
+		if iss == claimIssuer {
+			return nil
+		}
+	}
+	return &UntrustedClaimIssuerError{Issuer: claimIssuer, TokenIssuer: tokenIssuer}
+}
+
+// hasURLPrefix returns whether rawURL has the same scheme and host as prefix
+// and a path equal to or below the path of prefix. Unlike a string prefix,
+// "https://a.com" does not match "https://a.com.evil.com".
+func hasURLPrefix(rawURL, prefix string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	p, err := url.Parse(prefix)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != p.Scheme || u.Host != p.Host || u.User != nil {
+		return false
+	}
+	prefixPath := strings.TrimSuffix(p.Path, "/")
+	if prefixPath == "" {
+		return true
+	}
+	// Clean the path so that "/claims/../admin" does not match "/claims".
+	urlPath := path.Clean("/" + u.Path)
+	return urlPath == prefixPath || strings.HasPrefix(urlPath, prefixPath+"/")
+}
@@ -0,0 +1,204 @@
+package oidc_library
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lei-tang/dev/tests/go/group-demo-2/unverified_jwt"
+)
+
+// The errors returned by the authenticators wrap one of these errors, so that
+// the cause of a failure can be told apart with errors.Is, e.g.,
+//
+//	if errors.Is(err, oidc_library.ErrTokenExpired) {
+//		// Ask the client to refresh the token.
+//	}
+var (
+	// ErrMalformedToken is wrapped when a token or a claim JWT can't be parsed.
+	ErrMalformedToken = unverified_jwt.ErrMalformedToken
+
+	// ErrTokenExpired is wrapped when a token or a claim JWT is expired.
+	ErrTokenExpired = errors.New("oidc: token is expired")
+
+	// ErrTokenNotYetValid is wrapped when the "nbf" of a token or of a claim
+	// JWT is in the future.
+	ErrTokenNotYetValid = errors.New("oidc: token is not yet valid")
+
+	// ErrInvalidSignature is wrapped when the signature of a token or of a
+	// claim JWT can't be verified with the keys of its issuer.
+	ErrInvalidSignature = errors.New("oidc: invalid token signature")
+
+	// ErrKeysUnavailable is wrapped when the keys of an issuer can't be
+	// fetched to verify a signature.
+	ErrKeysUnavailable = errors.New("oidc: signing keys unavailable")
+
+	// ErrWrongIssuer is wrapped when a token is not issued by the issuer of
+	// the authenticator.
+	ErrWrongIssuer = errors.New("oidc: wrong token issuer")
+
+	// ErrWrongAudience is wrapped when the audience of a token or of a claim
+	// JWT is not the client id.
+	ErrWrongAudience = errors.New("oidc: wrong token audience")
+
+	// ErrUntrustedIssuer is wrapped when the issuer of a token is not trusted.
+	ErrUntrustedIssuer = errors.New("oidc: untrusted token issuer")
+
+	// ErrVerifierNotReady is wrapped when the verifier of an issuer is not
+	// initialized yet.
+	ErrVerifierNotReady = errors.New("oidc: verifier not initialized")
+
+	// ErrClaimSourceUnavailable is wrapped when a distributed claim endpoint
+	// can't be reached or does not return a claim JWT.
+	ErrClaimSourceUnavailable = errors.New("oidc: claim source unavailable")
+
+	// ErrUntrustedClaimSource is wrapped when a claim endpoint or a claim JWT
+	// issuer is not allowed by the ClaimSourcePolicy.
+	ErrUntrustedClaimSource = errors.New("oidc: untrusted claim source")
+
+	// ErrInvalidClaim is wrapped when a claim of a token is missing or can't
+	// be parsed.
+	ErrInvalidClaim = unverified_jwt.ErrInvalidClaim
+
+	// ErrRequiredClaimMismatch is wrapped when a required claim is missing or
+	// has a different value.
+	ErrRequiredClaimMismatch = errors.New("oidc: required claim mismatch")
+)
+
+// VerificationError is returned when a token or a claim JWT fails the
+// verification of go-oidc. Kind is the sentinel error of the failure, or nil
+// if the failure is not classified.
+type VerificationError struct {
+	Kind error
+	Err  error
+}
+
+func (e *VerificationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *VerificationError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// newVerificationError classifies an error of oidc.IDTokenVerifier.Verify.
+// go-oidc v2 only returns formatted errors, so this is the one place where
+// they are told apart by their messages.
+func newVerificationError(err error) *VerificationError {
+	msg := err.Error()
+	var kind error
+	switch {
+	case strings.Contains(msg, "malformed jwt"):
+		kind = ErrMalformedToken
+	case strings.Contains(msg, "token is expired"):
+		kind = ErrTokenExpired
+	case strings.Contains(msg, "before the nbf"):
+		kind = ErrTokenNotYetValid
+	case strings.Contains(msg, "issued by a different provider"):
+		kind = ErrWrongIssuer
+	case strings.Contains(msg, "expected audience"):
+		kind = ErrWrongAudience
+	case strings.Contains(msg, "fetching keys"):
+		kind = ErrKeysUnavailable
+	case strings.Contains(msg, "failed to verify signature"),
+		strings.Contains(msg, "not signed"),
+		strings.Contains(msg, "multiple signatures"),
+		strings.Contains(msg, "unsupported algorithm"):
+		kind = ErrInvalidSignature
+	}
+	return &VerificationError{Kind: kind, Err: err}
+}
+
+// NotReadyError is returned when the verifier of an issuer is not initialized.
+// Err, if not nil, is the error of the context the caller waited with.
+type NotReadyError struct {
+	Issuer string
+	Err    error
+}
+
+func (e *NotReadyError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("verifier not initialized for issuer: %q: %v", e.Issuer, e.Err)
+	}
+	return fmt.Sprintf("verifier not initialized for issuer: %q", e.Issuer)
+}
+
+func (e *NotReadyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *NotReadyError) Is(target error) bool {
+	return target == ErrVerifierNotReady
+}
+
+// UntrustedIssuerError is returned when the issuer of a token is not one of
+// the trusted issuers.
+type UntrustedIssuerError struct {
+	// Issuer is the unverified issuer of the token.
+	Issuer string
+	// Trusted are the trusted issuers, if known.
+	Trusted []string
+}
+
+func (e *UntrustedIssuerError) Error() string {
+	if len(e.Trusted) > 0 {
+		return fmt.Sprintf("oidc: token issuer %q is not one of the trusted issuers %v", e.Issuer, e.Trusted)
+	}
+	return fmt.Sprintf("oidc: token issuer %q is not a trusted issuer", e.Issuer)
+}
+
+func (e *UntrustedIssuerError) Is(target error) bool {
+	return target == ErrUntrustedIssuer
+}
+
+// ClaimSourceError is returned when the distributed or aggregated claims of a
+// claim source can't be resolved. Err tells why, e.g., it wraps
+// ErrClaimSourceUnavailable if the endpoint can't be reached.
+type ClaimSourceError struct {
+	// Claims are the names of the claims of the source.
+	Claims []string
+	// Endpoint is the URL of the distributed claim endpoint, or empty for an
+	// aggregated claim.
+	Endpoint string
+	Err      error
+}
+
+func (e *ClaimSourceError) Error() string {
+	if e.Endpoint == "" {
+		return fmt.Sprintf("while getting aggregated claims %q: %v", e.Claims, e.Err)
+	}
+	return fmt.Sprintf("while getting distributed claims %q from endpoint %v: %v", e.Claims, e.Endpoint, e.Err)
+}
+
+func (e *ClaimSourceError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidClaimError is returned when a claim of a token is missing or can't be
+// parsed, including the distributed claims of an unverified token.
+type InvalidClaimError = unverified_jwt.InvalidClaimError
+
+// RequiredClaimError is returned when a required claim is missing from a
+// token or has a different value.
+type RequiredClaimError struct {
+	Claim string
+	Want  string
+	// Got is the value of the claim, or empty if Missing.
+	Got     string
+	Missing bool
+}
+
+func (e *RequiredClaimError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("oidc: required claim %s not present in ID token", e.Claim)
+	}
+	return fmt.Sprintf("oidc: required claim %s value does not match. Got = %s, want = %s", e.Claim, e.Got, e.Want)
+}
+
+func (e *RequiredClaimError) Is(target error) bool {
+	return target == ErrRequiredClaimMismatch
+}
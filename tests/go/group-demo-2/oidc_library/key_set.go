@@ -0,0 +1,294 @@
+package oidc_library
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// defaultKeyRefreshInterval is how often the JWKS is refetched when the
+	// response has no Cache-Control max-age.
+	defaultKeyRefreshInterval = time.Hour
+	// defaultMinKeyRefreshInterval bounds how often a token with an unknown
+	// key id may trigger a refetch of the JWKS.
+	defaultMinKeyRefreshInterval = 10 * time.Second
+	// defaultRetiredKeyGracePeriod is how long a key removed from the JWKS is
+	// still accepted.
+	defaultRetiredKeyGracePeriod = 24 * time.Hour
+)
+
+// KeySetOptions configures a RotatingKeySet.
+type KeySetOptions struct {
+	// RefreshInterval is how often the JWKS is refetched in the background
+	// when the response does not carry a Cache-Control max-age. Defaults to
+	// one hour.
+	RefreshInterval time.Duration
+
+	// MinRefreshInterval is the minimum time between two fetches of the JWKS.
+	// It rate limits the refetches triggered by tokens with an unknown key id
+	// and bounds a short Cache-Control max-age. Defaults to 10 seconds.
+	MinRefreshInterval time.Duration
+
+	// RetiredKeyGracePeriod is how long a key that is no longer published in
+	// the JWKS is still accepted. Defaults to 24 hours.
+	RetiredKeyGracePeriod time.Duration
+}
+
+// rotatingKey is a key of a RotatingKeySet.
+type rotatingKey struct {
+	key jose.JSONWebKey
+	// retired is when the key was found missing from the JWKS, or zero if it
+	// is still published.
+	retired time.Time
+}
+
+// RotatingKeySet implements oidc.KeySet for an issuer that rotates its keys.
+// It fetches the JWKS in the background, honoring the Cache-Control max-age of
+// the response, and refetches it when a token is signed with an unknown key.
+// Keys removed from the JWKS are accepted for a grace period so that tokens
+// signed before a rotation remain valid.
+type RotatingKeySet struct {
+	jwksURL string
+	client  *http.Client
+	opts    KeySetOptions
+	now     func() time.Time
+
+	// fetchM serializes the fetches of the JWKS.
+	fetchM sync.Mutex
+
+	m sync.RWMutex
+	// keys maps the id and the RFC 7638 thumbprint of a key to the key, so
+	// that keys without a key id, or published under the same key id, are
+	// kept apart.
+	// Guarded by m.
+	keys map[string]*rotatingKey
+	// lastFetch is when the JWKS was last fetched.
+	// Guarded by m.
+	lastFetch time.Time
+	// nextRefresh is when the JWKS is due to be refetched in the background.
+	// Guarded by m.
+	nextRefresh time.Time
+}
+
+// NewRotatingKeySet creates a key set for the JWKS at jwksURL and starts
+// refreshing it in the background until ctx is canceled.
+func NewRotatingKeySet(ctx context.Context, client *http.Client, jwksURL string, opts KeySetOptions) *RotatingKeySet {
+	return newRotatingKeySet(ctx, client, jwksURL, opts, time.Now)
+}
+
+func newRotatingKeySet(ctx context.Context, client *http.Client, jwksURL string, opts KeySetOptions, now func() time.Time) *RotatingKeySet {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = defaultKeyRefreshInterval
+	}
+	if opts.MinRefreshInterval <= 0 {
+		opts.MinRefreshInterval = defaultMinKeyRefreshInterval
+	}
+	if opts.RetiredKeyGracePeriod <= 0 {
+		opts.RetiredKeyGracePeriod = defaultRetiredKeyGracePeriod
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s := &RotatingKeySet{
+		jwksURL: jwksURL,
+		client:  client,
+		opts:    opts,
+		now:     now,
+		keys:    map[string]*rotatingKey{},
+	}
+	go s.run(ctx)
+	return s
+}
+
+// run refreshes the JWKS in the background until ctx is canceled.
+func (s *RotatingKeySet) run(ctx context.Context) {
+	for {
+		if err := s.refresh(ctx); err != nil {
+			glog.Errorf("oidc: refreshing JWKS %v: %v", s.jwksURL, err)
+		}
+		s.m.RLock()
+		wait := s.nextRefresh.Sub(s.now())
+		s.m.RUnlock()
+		if wait < s.opts.MinRefreshInterval {
+			wait = s.opts.MinRefreshInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// VerifySignature verifies the signature of jwt with the key named by its
+// "kid" header, and returns the payload. If the key is unknown, the JWKS is
+// refetched once, subject to MinRefreshInterval.
+func (s *RotatingKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: malformed jwt: %v", err)
+	}
+	if len(jws.Signatures) == 0 {
+		return nil, fmt.Errorf("jwt contained no signatures")
+	}
+	kid := jws.Signatures[0].Header.KeyID
+
+	if payload, ok := s.verify(jws, kid); ok {
+		return payload, nil
+	}
+
+	// The key may have been rotated in since the last fetch.
+	s.m.RLock()
+	canRefetch := s.now().Sub(s.lastFetch) >= s.opts.MinRefreshInterval
+	s.m.RUnlock()
+	if canRefetch {
+		glog.V(4).Infof("oidc: refetching JWKS %v for unknown key id %q", s.jwksURL, kid)
+		if err := s.refresh(ctx); err != nil {
+			return nil, fmt.Errorf("oidc: fetching keys: %v", err)
+		}
+		if payload, ok := s.verify(jws, kid); ok {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to verify id token signature: no valid key with key id %q", kid)
+}
+
+// verify verifies jws with the keys named kid, or with every key if kid is
+// empty. Keys retired for longer than the grace period are not used.
+func (s *RotatingKeySet) verify(jws *jose.JSONWebSignature, kid string) ([]byte, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	now := s.now()
+	for _, k := range s.keys {
+		if kid != "" && k.key.KeyID != kid {
+			continue
+		}
+		if !k.retired.IsZero() && now.Sub(k.retired) > s.opts.RetiredKeyGracePeriod {
+			continue
+		}
+		if payload, err := jws.Verify(&k.key); err == nil {
+			return payload, true
+		}
+	}
+	return nil, false
+}
+
+// refresh fetches the JWKS and updates the keys. Keys missing from the JWKS
+// are retired, and dropped once retired for longer than the grace period.
+func (s *RotatingKeySet) refresh(ctx context.Context) error {
+	s.fetchM.Lock()
+	defer s.fetchM.Unlock()
+
+	s.m.RLock()
+	fetchedRecently := s.now().Sub(s.lastFetch) < s.opts.MinRefreshInterval
+	s.m.RUnlock()
+	if fetchedRecently {
+		// Another caller has just refreshed the keys.
+		return nil
+	}
+
+	keySet, maxAge, err := s.fetch(ctx)
+	now := s.now()
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.lastFetch = now
+	if err != nil {
+		s.nextRefresh = now.Add(s.opts.MinRefreshInterval)
+		return err
+	}
+
+	refresh := s.opts.RefreshInterval
+	if maxAge >= 0 {
+		refresh = maxAge
+	}
+	s.nextRefresh = now.Add(refresh)
+
+	published := map[string]bool{}
+	for _, key := range keySet.Keys {
+		id, err := rotatingKeyID(key)
+		if err != nil {
+			glog.Errorf("oidc: skipping key %q of %v: %v", key.KeyID, s.jwksURL, err)
+			continue
+		}
+		published[id] = true
+		s.keys[id] = &rotatingKey{key: key}
+	}
+	for id, k := range s.keys {
+		if published[id] {
+			continue
+		}
+		if k.retired.IsZero() {
+			glog.V(4).Infof("oidc: key %q is no longer published by %v", id, s.jwksURL)
+			k.retired = now
+		} else if now.Sub(k.retired) > s.opts.RetiredKeyGracePeriod {
+			delete(s.keys, id)
+		}
+	}
+	return nil
+}
+
+// rotatingKeyID returns the id of key in a RotatingKeySet: its key id and its
+// RFC 7638 thumbprint.
+func rotatingKeyID(key jose.JSONWebKey) (string, error) {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("can't compute the thumbprint: %v", err)
+	}
+	return key.KeyID + "/" + base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// fetch gets the JWKS and the max-age of its Cache-Control header, or -1 if
+// the response does not carry one.
+func (s *RotatingKeySet) fetch(ctx context.Context) (*jose.JSONWebKeySet, time.Duration, error) {
+	req, err := http.NewRequest("GET", s.jwksURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't create request: %v", err)
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, fmt.Errorf("fetching keys: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode keys: %v %s", err, body)
+	}
+	return &keySet, cacheMaxAge(resp.Header), nil
+}
+
+// cacheMaxAge returns the max-age of the Cache-Control header, 0 if the
+// response must not be cached, or -1 if the header does not specify it.
+func cacheMaxAge(h http.Header) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,123 @@
+package oidc_library
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/unverified_jwt"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// MultiIssuerAuthenticator authenticates tokens of several issuers. The
+// unverified "iss" claim of a token is read once and the token is routed to
+// the authenticator of that issuer. Tokens of other issuers are rejected.
+type MultiIssuerAuthenticator struct {
+	// authenticators maps an issuer URL to the authenticator of the issuer.
+	authenticators map[string]*Authenticator
+}
+
+// NewMultiIssuerAuthenticator creates an authenticator for each of the
+// options. Every option must have a distinct IssuerURL.
+func NewMultiIssuerAuthenticator(opts []Options) (*MultiIssuerAuthenticator, error) {
+	m := &MultiIssuerAuthenticator{authenticators: map[string]*Authenticator{}}
+	for _, o := range opts {
+		if _, ok := m.authenticators[o.IssuerURL]; ok {
+			m.Close()
+			return nil, fmt.Errorf("oidc: duplicate issuer %q", o.IssuerURL)
+		}
+		a, err := NewAuthenticatorWithIssuerURL(o)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("oidc: creating authenticator for issuer %q: %v", o.IssuerURL, err)
+		}
+		m.authenticators[o.IssuerURL] = a
+	}
+	return m, nil
+}
+
+// Issuers returns the sorted URLs of the issuers trusted by the authenticator.
+func (m *MultiIssuerAuthenticator) Issuers() []string {
+	issuers := make([]string, 0, len(m.authenticators))
+	for iss := range m.authenticators {
+		issuers = append(issuers, iss)
+	}
+	sort.Strings(issuers)
+	return issuers
+}
+
+// Close closes the authenticators of all issuers.
+func (m *MultiIssuerAuthenticator) Close() {
+	for _, a := range m.authenticators {
+		a.Close()
+	}
+}
+
+// Ready returns whether the authenticators of all issuers are ready.
+func (m *MultiIssuerAuthenticator) Ready() bool {
+	for _, a := range m.authenticators {
+		if !a.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitReady blocks until the authenticators of all issuers are ready or ctx
+// is done.
+func (m *MultiIssuerAuthenticator) WaitReady(ctx context.Context) error {
+	for _, a := range m.authenticators {
+		if err := a.WaitReady(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the readiness check of the authenticator.
+func (m *MultiIssuerAuthenticator) Name() string {
+	return "oidc-multi-issuer-authenticator"
+}
+
+// Check returns an error naming the issuers whose authenticators are not
+// ready.
+func (m *MultiIssuerAuthenticator) Check(_ *http.Request) error {
+	var notReady []string
+	for _, iss := range m.Issuers() {
+		if !m.authenticators[iss].Ready() {
+			notReady = append(notReady, iss)
+		}
+	}
+	if len(notReady) > 0 {
+		return fmt.Errorf("%w for issuers: %q", ErrVerifierNotReady, notReady)
+	}
+	return nil
+}
+
+// AuthenticateToken is equivalent to AuthenticateTokenContext with a
+// background context.
+func (m *MultiIssuerAuthenticator) AuthenticateToken(token string) (user.Info, map[string]json.RawMessage, bool, error) {
+	return m.AuthenticateTokenContext(context.Background(), token)
+}
+
+// AuthenticateTokenContext authenticates the token with the authenticator of
+// its issuer. Unlike Authenticator, a token of an unknown issuer is an error.
+func (m *MultiIssuerAuthenticator) AuthenticateTokenContext(ctx context.Context, token string) (user.Info, map[string]json.RawMessage, bool, error) {
+	t, err := unverified_jwt.ParseUnverified(token)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("oidc: reading token issuer: %w", err)
+	}
+	iss, err := t.Issuer()
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("oidc: reading token issuer: %w", err)
+	}
+	a, ok := m.authenticators[iss]
+	if !ok {
+		return nil, nil, false, &UntrustedIssuerError{Issuer: iss, Trusted: m.Issuers()}
+	}
+	glog.V(5).Infof("route the token to the authenticator of issuer %v", iss)
+	return a.authenticate(ctx, token)
+}
@@ -0,0 +1,161 @@
+package oidc_library
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// bundleFile is the format of an offline bundle file. It holds the discovery
+// document and the JWKS of each issuer, e.g.,
+//
+//	{
+//	  "issuers": [
+//	    {
+//	      "discovery": {"issuer": "https://idp.example.com", "jwks_uri": "..."},
+//	      "jwks": {"keys": [{"kty": "RSA", "kid": "...", "n": "...", "e": "AQAB"}]}
+//	    }
+//	  ]
+//	}
+//
+// Only the "issuer" of the discovery document is used; the document is kept
+// in the bundle as served by the issuer so that it can be copied verbatim.
+type bundleFile struct {
+	Issuers []bundleIssuer `json:"issuers"`
+}
+
+// bundleIssuer is the entry of an issuer in an offline bundle file.
+type bundleIssuer struct {
+	Discovery struct {
+		Issuer string `json:"issuer"`
+	} `json:"discovery"`
+	JWKS jose.JSONWebKeySet `json:"jwks"`
+}
+
+// offlineBundle holds the keys of the issuers read from an offline bundle
+// file. The file is re-read when its modification time or size changes.
+type offlineBundle struct {
+	path string
+
+	m sync.RWMutex
+	// modTime and size identify the version of the file that was read.
+	// Guarded by m.
+	modTime time.Time
+	size    int64
+	// keys maps an issuer URL to the keys of the issuer.
+	// Guarded by m.
+	keys map[string]jose.JSONWebKeySet
+}
+
+// newOfflineBundle reads the offline bundle file at path.
+func newOfflineBundle(path string) (*offlineBundle, error) {
+	b := &offlineBundle{path: path}
+	if err := b.reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// reload re-reads the bundle file if it has changed since it was last read.
+// On error the keys previously read are kept.
+func (b *offlineBundle) reload() error {
+	fi, err := os.Stat(b.path)
+	if err != nil {
+		return fmt.Errorf("oidc: reading offline bundle: %v", err)
+	}
+	b.m.RLock()
+	unchanged := b.keys != nil && fi.ModTime().Equal(b.modTime) && fi.Size() == b.size
+	b.m.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	d, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		return fmt.Errorf("oidc: reading offline bundle: %v", err)
+	}
+	var f bundleFile
+	if err := json.Unmarshal(d, &f); err != nil {
+		return fmt.Errorf("oidc: parsing offline bundle %v: %v", b.path, err)
+	}
+	keys := map[string]jose.JSONWebKeySet{}
+	for _, iss := range f.Issuers {
+		if iss.Discovery.Issuer == "" {
+			return fmt.Errorf("oidc: offline bundle %v has a discovery document without an issuer", b.path)
+		}
+		if _, ok := keys[iss.Discovery.Issuer]; ok {
+			return fmt.Errorf("oidc: offline bundle %v has duplicate issuer %q", b.path, iss.Discovery.Issuer)
+		}
+		keys[iss.Discovery.Issuer] = iss.JWKS
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.modTime = fi.ModTime()
+	b.size = fi.Size()
+	b.keys = keys
+	glog.V(4).Infof("oidc: read offline bundle %v with %v issuers", b.path, len(keys))
+	return nil
+}
+
+// hasIssuer returns whether the bundle holds the keys of iss.
+func (b *offlineBundle) hasIssuer(iss string) bool {
+	if err := b.reload(); err != nil {
+		glog.Errorf("%v", err)
+	}
+	b.m.RLock()
+	defer b.m.RUnlock()
+	_, ok := b.keys[iss]
+	return ok
+}
+
+// keySet returns the key set of iss. The keys are looked up in the bundle at
+// every verification so that a rotation in the file takes effect.
+func (b *offlineBundle) keySet(iss string) *bundleKeySet {
+	return &bundleKeySet{bundle: b, issuer: iss}
+}
+
+// bundleKeySet implements oidc.KeySet with the keys of an issuer in an
+// offline bundle.
+type bundleKeySet struct {
+	bundle *offlineBundle
+	issuer string
+}
+
+func (s *bundleKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: malformed jwt: %v", err)
+	}
+	if len(jws.Signatures) == 0 {
+		return nil, fmt.Errorf("jwt contained no signatures")
+	}
+	kid := jws.Signatures[0].Header.KeyID
+
+	if err := s.bundle.reload(); err != nil {
+		glog.Errorf("%v", err)
+	}
+	s.bundle.m.RLock()
+	keySet, ok := s.bundle.keys[s.issuer]
+	s.bundle.m.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("oidc: issuer %q is not in the offline bundle", s.issuer)
+	}
+	for i := range keySet.Keys {
+		key := &keySet.Keys[i]
+		if kid != "" && key.KeyID != kid {
+			continue
+		}
+		if payload, err := jws.Verify(key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to verify id token signature: no valid key with key id %q in the offline bundle", kid)
+}
@@ -30,7 +30,6 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -38,32 +37,30 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strings"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/golang/glog"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/unverified_jwt"
 	"k8s.io/apimachinery/pkg/util/net"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apiserver/pkg/authentication/user"
 	certutil "k8s.io/client-go/util/cert"
 )
 
-var (
-	// synchronizeTokenIDVerifierForTest should be set to true to force a
-	// wait until the token ID verifiers are ready.
-	synchronizeTokenIDVerifierForTest = false
-)
-
 const (
 	// The claim containing a map of endpoint references per claim.
 	// OIDC Connect Core 1.0, section 5.6.2.
-	claimNamesKey = "_claim_names"
+	claimNamesKey = unverified_jwt.ClaimNamesKey
 	// The claim containing endpoint specifications.
 	// OIDC Connect Core 1.0, section 5.6.2.
-	claimSourcesKey = "_claim_sources"
+	claimSourcesKey = unverified_jwt.ClaimSourcesKey
+
+	// AllDistributedClaims, when listed in Options.DistributedClaims, causes
+	// every distributed claim in a token to be resolved.
+	AllDistributedClaims = "*"
 )
 
 type Options struct {
@@ -89,6 +86,12 @@ type Options struct {
 	// Path to a PEM encoded root certificate of the provider.
 	CAFile string
 
+	// Transport, if specified, is used to connect to the provider and to the
+	// distributed claims endpoints instead of a transport of CAFile. It is not
+	// closed with the authenticator, so it may be shared by authenticators,
+	// e.g., one created by NewTransport.
+	Transport http.RoundTripper
+
 	// UsernameClaim is the JWT field to use as the user's username.
 	UsernameClaim string
 
@@ -116,6 +119,48 @@ type Options struct {
 	// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
 	SupportedSigningAlgs []string
 
+	// DistributedClaims, if specified, causes the OIDCAuthenticator to resolve the
+	// listed distributed or aggregated claims (e.g., "roles", "tenants") and merge
+	// them into the returned claims. The value AllDistributedClaims resolves every
+	// claim in "_claim_names". GroupsClaim, if specified, is always resolved.
+	DistributedClaims []string
+
+	// ClaimCacheSize, if positive, enables caching of the claims resolved from
+	// distributed claims endpoints, holding at most this many entries. Entries
+	// are keyed on the endpoint URL and the access token.
+	ClaimCacheSize int
+
+	// ClaimCacheMaxTTL, if positive, bounds how long resolved claims are cached.
+	// Cached claims never outlive the "exp" of the claim JWT.
+	ClaimCacheMaxTTL time.Duration
+
+	// ClaimSourcePolicy, if specified, restricts the distributed claim endpoints
+	// that may be called and the issuers that may sign claim JWTs. Violations
+	// are reported as *UntrustedClaimEndpointError or *UntrustedClaimIssuerError.
+	ClaimSourcePolicy *ClaimSourcePolicy
+
+	// KeySetOptions, if specified, causes the signing keys of the issuer and
+	// of the claim issuers to be managed by a RotatingKeySet, which refreshes
+	// the JWKS in the background and on tokens signed with an unknown key.
+	// Otherwise the keys are cached by go-oidc.
+	KeySetOptions *KeySetOptions
+
+	// OfflineBundleFile, if specified, is the path to a JSON file holding the
+	// discovery document and the JWKS of the issuer and of the claim issuers.
+	// The tokens and the aggregated claim JWTs are then verified with the keys
+	// in the file, which is re-read when it changes, without connecting to the
+	// issuers. Distributed claim endpoints can't be called in this mode.
+	OfflineBundleFile string
+
+	// RetryBackoff configures how the discovery of the issuer and of the claim
+	// issuers is retried until it succeeds.
+	RetryBackoff RetryBackoff
+
+	// VerifierWaitTimeout, if positive, is how long the authentication of a
+	// token waits for the verifier of the issuer or of a claim issuer that is
+	// not yet initialized. Otherwise such a token fails immediately.
+	VerifierWaitTimeout time.Duration
+
 	// RequiredClaims, if specified, causes the OIDCAuthenticator to verify that all the
 	// required claims key value pairs are present in the ID Token.
 	RequiredClaims map[string]string
@@ -126,13 +171,35 @@ type Options struct {
 
 // initVerifier creates a new ID token verifier for the given configuration and issuer URL.  On success, calls setVerifier with the
 // resulting verifier.
-func initVerifier(ctx context.Context, config *oidc.Config, iss string) (*oidc.IDTokenVerifier, error) {
+func initVerifier(ctx context.Context, client *http.Client, keySetOpts *KeySetOptions, config *oidc.Config, iss string) (*oidc.IDTokenVerifier, error) {
 	glog.V(4).Infof("initVerifier: iss=%v, config=%+v", iss, config)
 	provider, err := oidc.NewProvider(ctx, iss)
 	if err != nil {
 		return nil, fmt.Errorf("init verifier failed: %v", err)
 	}
-	return provider.Verifier(config), nil
+	return providerVerifier(ctx, client, keySetOpts, provider, config)
+}
+
+// providerVerifier creates the ID token verifier of a discovered provider. If
+// keySetOpts is nil, the keys are managed by go-oidc. Otherwise the keys are
+// managed by a RotatingKeySet refreshed until ctx is canceled.
+func providerVerifier(ctx context.Context, client *http.Client, keySetOpts *KeySetOptions, provider *oidc.Provider, config *oidc.Config) (*oidc.IDTokenVerifier, error) {
+	if keySetOpts == nil {
+		return provider.Verifier(config), nil
+	}
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return nil, fmt.Errorf("oidc: parse discovery document: %v", err)
+	}
+	now := config.Now
+	if now == nil {
+		now = time.Now
+	}
+	keySet := newRotatingKeySet(ctx, client, discovery.JWKSURL, *keySetOpts, now)
+	return oidc.NewVerifier(discovery.Issuer, keySet, config), nil
 }
 
 // asyncIDTokenVerifier is an ID token verifier that allows async initialization
@@ -144,42 +211,60 @@ type asyncIDTokenVerifier struct {
 	// up until it is eventually initialized.
 	// Guarded by m
 	v *oidc.IDTokenVerifier
+
+	// ready is closed once v is initialized.
+	ready chan struct{}
 }
 
 // newAsyncIDTokenVerifier creates a new asynchronous token verifier.  The
 // verifier is available immediately, but may remain uninitialized for some time
 // after creation.
-func newAsyncIDTokenVerifier(ctx context.Context, c *oidc.Config, iss string) *asyncIDTokenVerifier {
-	t := &asyncIDTokenVerifier{}
+func newAsyncIDTokenVerifier(ctx context.Context, client *http.Client, keySetOpts *KeySetOptions, backoff RetryBackoff, c *oidc.Config, iss string) *asyncIDTokenVerifier {
+	t := &asyncIDTokenVerifier{ready: make(chan struct{})}
 
-	sync := make(chan struct{})
-	// Polls indefinitely in an attempt to initialize the distributed claims
+	// Retries indefinitely in an attempt to initialize the distributed claims
 	// verifier, or until context canceled.
-	initFn := func() (done bool, err error) {
+	initFn := func() bool {
 		glog.V(4).Infof("oidc authenticator: attempting init: iss=%v", iss)
-		v, err := initVerifier(ctx, c, iss)
+		v, err := initVerifier(ctx, client, keySetOpts, c, iss)
 		if err != nil {
 			glog.Errorf("oidc authenticator: async token verifier for issuer: %q: %v", iss, err)
-			return false, nil
+			return false
 		}
 		t.m.Lock()
 		defer t.m.Unlock()
 		t.v = v
-		close(sync)
-		return true, nil
+		close(t.ready)
+		return true
 	}
 
 	go func() {
-		if done, _ := initFn(); !done {
-			go wait.PollUntil(time.Second*10, initFn, ctx.Done())
+		if !initFn() {
+			retryWithBackoff(ctx, backoff, initFn)
 		}
 	}()
 
-	if synchronizeTokenIDVerifierForTest {
-		<-sync
+	return t
+}
+
+// Ready returns whether the verifier is initialized.
+func (a *asyncIDTokenVerifier) Ready() bool {
+	select {
+	case <-a.ready:
+		return true
+	default:
+		return false
 	}
+}
 
-	return t
+// WaitReady blocks until the verifier is initialized or ctx is done.
+func (a *asyncIDTokenVerifier) WaitReady(ctx context.Context) error {
+	select {
+	case <-a.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // verifier returns the underlying ID token verifier, or nil if one is not yet initialized.
@@ -202,14 +287,32 @@ type Authenticator struct {
 	// idTokenVerifier method.
 	verifier atomic.Value
 
+	// ready is closed once the verifier is set.
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// retryBackoff configures the retries of the discovery of the issuer.
+	retryBackoff RetryBackoff
+
+	// verifierWaitTimeout is how long a token waits for the verifier.
+	verifierWaitTimeout time.Duration
+
 	cancel context.CancelFunc
 
+	// client is used to fetch the keys of the issuer.
+	client *http.Client
+
+	// keySetOptions, if not nil, causes the keys of the issuers to be
+	// managed by a RotatingKeySet.
+	keySetOptions *KeySetOptions
+
 	// resolver is used to resolve distributed claims.
 	resolver *claimResolver
 }
 
 func (a *Authenticator) setVerifier(v *oidc.IDTokenVerifier) {
 	a.verifier.Store(v)
+	a.readyOnce.Do(func() { close(a.ready) })
 }
 
 func (a *Authenticator) idTokenVerifier() (*oidc.IDTokenVerifier, bool) {
@@ -223,46 +326,76 @@ func (a *Authenticator) Close() {
 	a.cancel()
 }
 
+// Ready returns whether the verifier of the issuer is initialized, i.e.,
+// whether tokens can be verified.
+func (a *Authenticator) Ready() bool {
+	select {
+	case <-a.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitReady blocks until the verifier of the issuer is initialized or ctx is
+// done.
+func (a *Authenticator) WaitReady(ctx context.Context) error {
+	select {
+	case <-a.ready:
+		return nil
+	case <-ctx.Done():
+		return &NotReadyError{Issuer: a.issuerURL, Err: ctx.Err()}
+	}
+}
+
+// Name returns the name of the readiness check of the authenticator.
+func (a *Authenticator) Name() string {
+	return "oidc-authenticator"
+}
+
+// Check returns an error if the authenticator is not ready.
+func (a *Authenticator) Check(_ *http.Request) error {
+	if !a.Ready() {
+		return &NotReadyError{Issuer: a.issuerURL}
+	}
+	return nil
+}
+
+// initIssuerVerifier attempts to discover the issuer and set the verifier.
+func (a *Authenticator) initIssuerVerifier(ctx context.Context, config *oidc.Config) bool {
+	verifier, err := initVerifier(ctx, a.client, a.keySetOptions, config, a.issuerURL)
+	if err != nil {
+		glog.Errorf("oidc authenticator: initializing plugin: %v", err)
+		return false
+	}
+	a.setVerifier(verifier)
+	glog.V(5).Infof("setVerifier(%+v)", verifier)
+	return true
+}
+
 func New(opts Options) (*Authenticator, error) {
 	return newAuthenticator(opts, func(ctx context.Context, a *Authenticator, config *oidc.Config) {
 		// Asynchronously attempt to initialize the authenticator. This enables
 		// self-hosted providers, providers that run on top of Kubernetes itself.
-
-		glog.Errorf("To call wait.PollUnitl()")
-		go wait.PollUntil(time.Second*10, func() (done bool, err error) {
-			glog.Errorf("Enter wait.PollUnitl()")
-			provider, err := oidc.NewProvider(ctx, a.issuerURL)
-			if err != nil {
-				glog.Errorf("oidc authenticator: initializing plugin: %v", err)
-				return false, nil
+		go func() {
+			if !a.initIssuerVerifier(ctx, config) {
+				retryWithBackoff(ctx, a.retryBackoff, func() bool { return a.initIssuerVerifier(ctx, config) })
 			}
-
-			verifier := provider.Verifier(config)
-			a.setVerifier(verifier)
-			return true, nil
-		}, ctx.Done())
+		}()
 	})
 }
 
 func NewAuthenticatorWithIssuerURL(opts Options) (*Authenticator, error) {
 	return newAuthenticator(opts, func(ctx context.Context, a *Authenticator, config *oidc.Config) {
+		// Initialize the authenticator before returning, and keep retrying in
+		// the background if the issuer can't be discovered yet.
 		glog.V(5).Infof("NewProvider(%v)", a.issuerURL)
-		provider, err := oidc.NewProvider(ctx, a.issuerURL)
-		if err == nil {
-			verifier := provider.Verifier(config)
-			a.setVerifier(verifier)
-			glog.V(5).Infof("setVerifier(%+v)", verifier)
-		} else {
-			glog.Errorf("Failed to create a provider for %v: %v", provider, err)
+		if !a.initIssuerVerifier(ctx, config) {
+			go retryWithBackoff(ctx, a.retryBackoff, func() bool { return a.initIssuerVerifier(ctx, config) })
 		}
 	})
 }
 
-// The verifier may need to be ready by SetSynchronizeTokenIDVerifier(true)
-func SetSynchronizeTokenIDVerifier(sync bool) {
-	synchronizeTokenIDVerifierForTest = sync
-}
-
 // StaticKeySet implements oidc.KeySet.
 type StaticKeySet struct {
 	keys []*jose.JSONWebKey
@@ -287,6 +420,10 @@ func (s *StaticKeySet) VerifySignature(ctx context.Context, jwt string) (payload
 	return nil, fmt.Errorf("no keys matches jwk keyid")
 }
 
+// EdDSA is the JOSE signing algorithm of Ed25519 keys (RFC 8037), which
+// go-oidc does not define.
+const EdDSA = "EdDSA"
+
 // whitelist of signing algorithms to ensure users don't mistakenly pass something
 // goofy.
 var allowedSigningAlgs = map[string]bool{
@@ -299,6 +436,7 @@ var allowedSigningAlgs = map[string]bool{
 	oidc.PS256: true,
 	oidc.PS384: true,
 	oidc.PS512: true,
+	EdDSA:      true,
 }
 
 func newAuthenticator(opts Options, initVerifier func(ctx context.Context, a *Authenticator, config *oidc.Config)) (*Authenticator, error) {
@@ -327,23 +465,13 @@ func newAuthenticator(opts Options, initVerifier func(ctx context.Context, a *Au
 		}
 	}
 
-	var roots *x509.CertPool
-	if opts.CAFile != "" {
-		roots, err = certutil.NewPool(opts.CAFile)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to read the CA file: %v", err)
+	tr := opts.Transport
+	if tr == nil {
+		if tr, err = NewTransport(opts.CAFile); err != nil {
+			return nil, err
 		}
-	} else {
-		glog.Info("OIDC: No x509 certificates provided, will use host's root CA set")
 	}
 
-	// Copied from http.DefaultTransport.
-	tr := net.SetTransportDefaults(&http.Transport{
-		// According to golang's doc, if RootCAs is nil,
-		// TLS uses the host's root CA set.
-		TLSClientConfig: &tls.Config{RootCAs: roots},
-	})
-
 	client := &http.Client{Transport: tr, Timeout: 30 * time.Second}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -360,52 +488,89 @@ func newAuthenticator(opts Options, initVerifier func(ctx context.Context, a *Au
 		Now:                  now,
 	}
 
+	var bundle *offlineBundle
+	if opts.OfflineBundleFile != "" {
+		bundle, err = newOfflineBundle(opts.OfflineBundleFile)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if !bundle.hasIssuer(opts.IssuerURL) {
+			cancel()
+			return nil, fmt.Errorf("oidc: issuer %q is not in the offline bundle %v", opts.IssuerURL, opts.OfflineBundleFile)
+		}
+	}
+
 	var resolver *claimResolver
+	distributedClaims := opts.DistributedClaims
 	if opts.GroupsClaim != "" {
 		glog.V(5).Infof("opts.GroupsClaim: %v", opts.GroupsClaim)
+		distributedClaims = append([]string{opts.GroupsClaim}, distributedClaims...)
+	}
+	if len(distributedClaims) > 0 {
+		glog.V(5).Infof("distributed claims to resolve: %v", distributedClaims)
 		glog.V(5).Infof("verifierConfig is: %+v", verifierConfig)
-		resolver = newClaimResolver(opts.GroupsClaim, client, verifierConfig)
+		resolver = newClaimResolver(ctx, distributedClaims, client, verifierConfig)
+		if opts.ClaimCacheSize > 0 {
+			resolver.cache = newClaimCache(opts.ClaimCacheSize, opts.ClaimCacheMaxTTL, now)
+		}
+		resolver.policy = opts.ClaimSourcePolicy
+		resolver.keySetOptions = opts.KeySetOptions
+		resolver.bundle = bundle
+		resolver.retryBackoff = opts.RetryBackoff
+		resolver.verifierWaitTimeout = opts.VerifierWaitTimeout
 	}
 
 	authenticator := &Authenticator{
-		issuerURL:      opts.IssuerURL,
-		usernameClaim:  opts.UsernameClaim,
-		usernamePrefix: opts.UsernamePrefix,
-		groupsClaim:    opts.GroupsClaim,
-		groupsPrefix:   opts.GroupsPrefix,
-		requiredClaims: opts.RequiredClaims,
-		cancel:         cancel,
-		resolver:       resolver,
+		issuerURL:           opts.IssuerURL,
+		usernameClaim:       opts.UsernameClaim,
+		usernamePrefix:      opts.UsernamePrefix,
+		groupsClaim:         opts.GroupsClaim,
+		groupsPrefix:        opts.GroupsPrefix,
+		requiredClaims:      opts.RequiredClaims,
+		ready:               make(chan struct{}),
+		retryBackoff:        opts.RetryBackoff,
+		cancel:              cancel,
+		client:              client,
+		keySetOptions:       opts.KeySetOptions,
+		resolver:            resolver,
+		verifierWaitTimeout: opts.VerifierWaitTimeout,
 	}
 
+	if bundle != nil {
+		// The keys are read from the bundle, there is nothing to discover.
+		authenticator.setVerifier(oidc.NewVerifier(opts.IssuerURL, bundle.keySet(opts.IssuerURL), verifierConfig))
+		return authenticator, nil
+	}
 	initVerifier(ctx, authenticator, verifierConfig)
 	return authenticator, nil
 }
 
-// untrustedIssuer extracts an untrusted "iss" claim from the given JWT token,
-// or returns an error if the token can not be parsed.  Since the JWT is not
-// verified, the returned issuer should not be trusted.
-func untrustedIssuer(token string) (string, error) {
-	parts := strings.Split(token, ".")
-	if len(parts) != 3 {
-		return "", fmt.Errorf("malformed token")
-	}
-	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
-	if err != nil {
-		return "", fmt.Errorf("error decoding token: %v", err)
-	}
-	claims := struct {
-		// WARNING: this JWT is not verified. Do not trust these claims.
-		Issuer string `json:"iss"`
-	}{}
-	if err := json.Unmarshal(payload, &claims); err != nil {
-		return "", fmt.Errorf("while unmarshaling token: %v", err)
+// NewTransport creates a transport that trusts the PEM encoded root
+// certificates in caFile, or the host's root CA set if caFile is empty.
+func NewTransport(caFile string) (*http.Transport, error) {
+	var roots *x509.CertPool
+	if caFile != "" {
+		var err error
+		roots, err = certutil.NewPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the CA file: %v", err)
+		}
+	} else {
+		glog.Info("OIDC: No x509 certificates provided, will use host's root CA set")
 	}
-	return claims.Issuer, nil
+
+	// Copied from http.DefaultTransport.
+	return net.SetTransportDefaults(&http.Transport{
+		// According to golang's doc, if RootCAs is nil,
+		// TLS uses the host's root CA set.
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}), nil
 }
 
-func hasCorrectIssuer(iss, tokenData string) bool {
-	uiss, err := untrustedIssuer(tokenData)
+// hasCorrectIssuer reports whether the unverified issuer of the token is iss.
+func hasCorrectIssuer(iss string, t *unverified_jwt.Token) bool {
+	uiss, err := t.Issuer()
 	if err != nil {
 		return false
 	}
@@ -415,33 +580,52 @@ func hasCorrectIssuer(iss, tokenData string) bool {
 	return true
 }
 
-// endpoint represents an OIDC distributed claims endpoint.
-type endpoint struct {
-	// URL to use to request the distributed claim.  This URL is expected to be
-	// prefixed by one of the known issuer URLs.
-	URL string `json:"endpoint,omitempty"`
-	// AccessToken is the bearer token to use for access.  If empty, it is
-	// not used.  Access token is optional per the OIDC distributed claims
-	// specification.
-	// See: http://openid.net/specs/openid-connect-core-1_0.html#DistributedExample
-	AccessToken string `json:"access_token,omitempty"`
-	// JWT is the container for aggregated claims.  Not supported at the moment.
-	// See: http://openid.net/specs/openid-connect-core-1_0.html#AggregatedExample
-	JWT string `json:"JWT,omitempty"`
-}
+// endpoint represents an OIDC claim source: either a distributed claims
+// endpoint or an aggregated claims JWT. The JWT of an aggregated claim is
+// verified against the keys of its own issuer, just like a JWT returned by a
+// remote endpoint.
+type endpoint = unverified_jwt.ClaimSource
 
 // claimResolver expands distributed claims by calling respective claim source
-// endpoints.
+// endpoints, and aggregated claims by verifying the embedded claim JWTs.
 type claimResolver struct {
-	// claim is the distributed claim that may be resolved.
-	claim string
+	// claims are the distributed claims that may be resolved.
+	claims map[string]bool
+
+	// allClaims, if true, causes every claim in _claim_names to be resolved.
+	allClaims bool
 
 	// client is the to use for resolving distributed claims
 	client *http.Client
 
+	// ctx is the context in which the verifiers of the claim issuers are
+	// initialized. It is canceled when the authenticator is closed.
+	ctx context.Context
+
 	// config is the OIDC configuration used for resolving distributed claims.
 	config *oidc.Config
 
+	// cache, if not nil, caches the claims resolved at remote endpoints.
+	cache *claimCache
+
+	// policy, if not nil, restricts the claim endpoints and claim issuers.
+	policy *ClaimSourcePolicy
+
+	// keySetOptions, if not nil, causes the keys of the claim issuers to be
+	// managed by a RotatingKeySet.
+	keySetOptions *KeySetOptions
+
+	// bundle, if not nil, holds the keys of the claim issuers. No claim
+	// endpoint is called and no key is fetched.
+	bundle *offlineBundle
+
+	// retryBackoff configures the retries of the discovery of claim issuers.
+	retryBackoff RetryBackoff
+
+	// verifierWaitTimeout is how long a claim JWT waits for the verifier of
+	// its issuer.
+	verifierWaitTimeout time.Duration
+
 	// verifierPerIssuer contains, for each issuer, the appropriate verifier to use
 	// for this claim.  It is assumed that there will be very few entries in
 	// this map.
@@ -451,157 +635,286 @@ type claimResolver struct {
 	m sync.Mutex
 }
 
-// newClaimResolver creates a new resolver for distributed claims.
-func newClaimResolver(claim string, client *http.Client, config *oidc.Config) *claimResolver {
-	return &claimResolver{claim: claim, client: client, config: config, verifierPerIssuer: map[string]*asyncIDTokenVerifier{}}
+// newClaimResolver creates a new resolver for the given distributed claims.
+// If claimNames contains AllDistributedClaims, every distributed claim is
+// resolved.
+func newClaimResolver(ctx context.Context, claimNames []string, client *http.Client, config *oidc.Config) *claimResolver {
+	r := &claimResolver{claims: map[string]bool{}, client: client, ctx: ctx, config: config, verifierPerIssuer: map[string]*asyncIDTokenVerifier{}}
+	for _, name := range claimNames {
+		if name == AllDistributedClaims {
+			r.allClaims = true
+			continue
+		}
+		r.claims[name] = true
+	}
+	return r
+}
+
+// shouldResolve returns whether the distributed claim is to be resolved.
+func (r *claimResolver) shouldResolve(claim string) bool {
+	return r.allClaims || r.claims[claim]
 }
 
 // Verifier returns either the verifier for the specified issuer, or error.
-func (r *claimResolver) Verifier(iss string) (*oidc.IDTokenVerifier, error) {
+// The verifier is initialized in the context of the resolver so that it can be
+// shared by requests; ctx only bounds how long the caller waits for it.
+func (r *claimResolver) Verifier(ctx context.Context, iss string) (*oidc.IDTokenVerifier, error) {
+	if r.bundle != nil {
+		if !r.bundle.hasIssuer(iss) {
+			return nil, fmt.Errorf("oidc: claim issuer %q is not in the offline bundle", iss)
+		}
+		return oidc.NewVerifier(iss, r.bundle.keySet(iss), r.config), nil
+	}
+
 	r.m.Lock()
 	av := r.verifierPerIssuer[iss]
 	if av == nil {
 		// This lazy init should normally be very quick.
-		// TODO: Make this context cancelable.
-		ctx := oidc.ClientContext(context.Background(), r.client)
-		av = newAsyncIDTokenVerifier(ctx, r.config, iss)
+		av = newAsyncIDTokenVerifier(oidc.ClientContext(r.ctx, r.client), r.client, r.keySetOptions, r.retryBackoff, r.config, iss)
 		r.verifierPerIssuer[iss] = av
 	}
 	r.m.Unlock()
 
+	if !av.Ready() && r.verifierWaitTimeout > 0 {
+		ctx, cancel := context.WithTimeout(ctx, r.verifierWaitTimeout)
+		defer cancel()
+		if err := av.WaitReady(ctx); err != nil {
+			return nil, &NotReadyError{Issuer: iss, Err: err}
+		}
+	}
 	v := av.verifier()
 	if v == nil {
-		return nil, fmt.Errorf("verifier not initialized for issuer: %q", iss)
+		return nil, &NotReadyError{Issuer: iss}
 	}
 	return v, nil
 }
 
-// expand extracts the distributed claims from claim names and claim sources.
-// The extracted claim value is pulled up into the supplied claims.
+// expand extracts the distributed and aggregated claims from claim names and
+// claim sources. The extracted claim values are pulled up into the supplied
+// claims. Claims that share a source are resolved with a single request.
 //
-// Distributed claims are of the form as seen below, and are defined in the
-// OIDC Connect Core 1.0, section 5.6.2.
+// Distributed and aggregated claims are of the form as seen below, and are
+// defined in the OIDC Connect Core 1.0, section 5.6.2.
 // See: https://openid.net/specs/openid-connect-core-1_0.html#AggregatedDistributedClaims
 //
 // {
 //   ... (other normal claims)...
 //   "_claim_names": {
-//     "groups": "src1"
+//     "groups": "src1",
+//     "roles": "src1",
+//     "tenants": "src2"
 //   },
 //   "_claim_sources": {
 //     "src1": {
 //       "endpoint": "https://www.example.com",
 //       "access_token": "f005ba11"
 //     },
+//     "src2": {
+//       "JWT": "eyJhbGciOiJSUzI1NiIsImtpZCI6..."
+//     },
 //   },
 // }
-func (r *claimResolver) expand(c claims) error {
-	//const (
-	//	// The claim containing a map of endpoint references per claim.
-	//	// OIDC Connect Core 1.0, section 5.6.2.
-	//	claimNamesKey = "_claim_names"
-	//	// The claim containing endpoint specifications.
-	//	// OIDC Connect Core 1.0, section 5.6.2.
-	//	claimSourcesKey = "_claim_sources"
-	//)
-
-	glog.V(5).Infof("The resolver claim (i.e., r.claim) is: %v", r.claim)
+//
+// tokenIssuer is the verified issuer of the token containing the claims.
+func (r *claimResolver) expand(ctx context.Context, tokenIssuer string, c claims) error {
+	glog.V(5).Infof("The resolver claims are: %v (all claims: %v)", r.claims, r.allClaims)
 	glog.V(5).Infof("claims is: %+v", c)
 
-	_, ok := c[r.claim]
-	if ok {
-		// There already is a normal claim, skip resolving.
-		return nil
+	dist, err := unverified_jwt.ParseDistributedClaims(c)
+	if err != nil {
+		return err
 	}
-	names, ok := c[claimNamesKey]
-	if !ok {
+	if dist == nil {
 		// No _claim_names, no keys to look up.
 		return nil
 	}
-
 	// map from claim name to source name
-	claimToSource := map[string]string{}
-	if err := json.Unmarshal([]byte(names), &claimToSource); err != nil {
-		return fmt.Errorf("oidc: error parsing distributed claim names: %v", err)
-	}
+	claimToSource := dist.Names
 	glog.V(5).Infof("claimToSource map is: %+v", claimToSource)
-
-	rawSources, ok := c[claimSourcesKey]
-	if !ok {
-		// Having _claim_names claim,  but no _claim_sources is not an expected
-		// state.
-		return fmt.Errorf("oidc: no claim sources")
-	}
-
 	// map from source name to source endpoint
-	var sources map[string]endpoint
-	if err := json.Unmarshal([]byte(rawSources), &sources); err != nil {
-		// The claims sources claim is malformed, this is not an expected state.
-		return fmt.Errorf("oidc: could not parse claim sources: %v", err)
-	}
-
+	sources := dist.Sources
 	glog.V(5).Infof("source name to source endpoint map is: %+v", sources)
 
-	// find the source for the claim, e.g., groups
-	src, ok := claimToSource[r.claim]
-	if !ok {
-		// No distributed claim present.
-		return nil
+	// map from source name to the claims to resolve at the source
+	sourceToClaims := map[string][]string{}
+	for claim, src := range claimToSource {
+		if !r.shouldResolve(claim) {
+			continue
+		}
+		if _, ok := c[claim]; ok {
+			// There already is a normal claim, skip resolving.
+			continue
+		}
+		sourceToClaims[src] = append(sourceToClaims[src], claim)
 	}
-	// find the endpoint for the claim
-	ep, ok := sources[src]
-	if !ok {
-		return fmt.Errorf("id token _claim_names contained a source %s missing in _claims_sources", src)
+
+	srcNames := make([]string, 0, len(sourceToClaims))
+	for src := range sourceToClaims {
+		srcNames = append(srcNames, src)
 	}
-	if ep.URL == "" {
-		// This is maybe an aggregated claim (ep.JWT != "").
-		return nil
+	sort.Strings(srcNames)
+	for _, src := range srcNames {
+		claimNames := sourceToClaims[src]
+		sort.Strings(claimNames)
+		// find the endpoint for the claims
+		ep, ok := sources[src]
+		if !ok {
+			return &InvalidClaimError{Claim: claimSourcesKey, Err: fmt.Errorf("id token _claim_names contained a source %s missing in _claims_sources", src)}
+		}
+		var err error
+		if ep.URL == "" {
+			if ep.JWT == "" {
+				return &InvalidClaimError{Claim: claimSourcesKey, Err: fmt.Errorf("id token _claim_sources contained a source %s with neither endpoint nor JWT", src)}
+			}
+			// verify the aggregated claim JWT embedded in the token
+			err = r.aggregate(ctx, tokenIssuer, claimNames, ep, c)
+		} else {
+			// resolve the claims at remote endpoint
+			err = r.resolve(ctx, tokenIssuer, claimNames, ep, c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregate verifies the claim JWT embedded in an aggregated claim source,
+// and inserts the values of claimNames into allClaims.
+func (r *claimResolver) aggregate(ctx context.Context, tokenIssuer string, claimNames []string, endpoint endpoint, allClaims claims) error {
+	glog.V(5).Infof("aggregate the claims %v from the embedded JWT", claimNames)
+	if err := r.mergeClaimJWT(ctx, tokenIssuer, endpoint.JWT, claimNames, allClaims); err != nil {
+		return &ClaimSourceError{Claims: claimNames, Err: err}
 	}
-	// resolve the claim at remote endpoint
-	return r.resolve(ep, c)
+	return nil
 }
 
-// resolve requests distributed claims from all endpoints passed in,
+// resolve requests the distributed claims claimNames from the endpoint,
 // and inserts the lookup results into allClaims.
-func (r *claimResolver) resolve(endpoint endpoint, allClaims claims) error {
-	glog.V(5).Infof("resolve the claims %+v at %+v", allClaims, endpoint)
+func (r *claimResolver) resolve(ctx context.Context, tokenIssuer string, claimNames []string, endpoint endpoint, allClaims claims) error {
+	glog.V(5).Infof("resolve the claims %v at %+v", claimNames, endpoint)
+	if r.bundle != nil {
+		return &ClaimSourceError{Claims: claimNames, Endpoint: endpoint.URL,
+			Err: fmt.Errorf("%w: the endpoint can't be called with an offline bundle", ErrClaimSourceUnavailable)}
+	}
+	if r.policy != nil {
+		if err := r.policy.checkEndpoint(tokenIssuer, endpoint.URL); err != nil {
+			return &ClaimSourceError{Claims: claimNames, Endpoint: endpoint.URL, Err: err}
+		}
+	}
+	var key string
+	if r.cache != nil {
+		key = claimCacheKey(endpoint.URL, endpoint.AccessToken)
+		if distClaims, ok := r.cache.get(key); ok {
+			glog.V(5).Infof("claims resolved at %v are served from the cache", endpoint.URL)
+			if err := mergeClaims(distClaims, claimNames, allClaims); err != nil {
+				return &ClaimSourceError{Claims: claimNames, Endpoint: endpoint.URL, Err: err}
+			}
+			return nil
+		}
+	}
 	// get the claim JWT from remote endpoint
-	// TODO: cache resolved claims.
 	glog.V(5).Infof("getClaimJWT() will be called to get claim JWT")
-	jwt, err := getClaimJWT(r.client, endpoint.URL, endpoint.AccessToken)
+	jwt, err := getClaimJWT(ctx, r.client, endpoint.URL, endpoint.AccessToken)
+	if err != nil {
+		return &ClaimSourceError{Claims: claimNames, Endpoint: endpoint.URL,
+			Err: fmt.Errorf("%w: %v", ErrClaimSourceUnavailable, err)}
+	}
+	distClaims, expiry, err := r.verifyClaimJWT(ctx, tokenIssuer, jwt)
 	if err != nil {
-		return fmt.Errorf("while getting distributed claim %q: %v", r.claim, err)
+		return &ClaimSourceError{Claims: claimNames, Endpoint: endpoint.URL, Err: err}
+	}
+	if r.cache != nil {
+		r.cache.add(key, distClaims, expiry)
+	}
+	if err := mergeClaims(distClaims, claimNames, allClaims); err != nil {
+		return &ClaimSourceError{Claims: claimNames, Endpoint: endpoint.URL, Err: err}
 	}
-	untrustedIss, err := untrustedIssuer(jwt)
+	return nil
+}
+
+// ClaimCacheStats returns the counters of the cache of resolved distributed
+// claims. All counters are zero if the cache is not enabled.
+func (a *Authenticator) ClaimCacheStats() ClaimCacheStats {
+	if a.resolver == nil || a.resolver.cache == nil {
+		return ClaimCacheStats{}
+	}
+	return a.resolver.cache.stats()
+}
+
+// mergeClaimJWT verifies a claim JWT against the keys of its issuer and
+// inserts the values of claimNames into allClaims.
+func (r *claimResolver) mergeClaimJWT(ctx context.Context, tokenIssuer, jwt string, claimNames []string, allClaims claims) error {
+	distClaims, _, err := r.verifyClaimJWT(ctx, tokenIssuer, jwt)
+	if err != nil {
+		return err
+	}
+	return mergeClaims(distClaims, claimNames, allClaims)
+}
+
+// verifyClaimJWT verifies a claim JWT against the keys of its issuer, and
+// returns its claims and expiry. The claim JWT may come either from a
+// distributed claims endpoint or from an aggregated claim in a token issued
+// by tokenIssuer.
+func (r *claimResolver) verifyClaimJWT(ctx context.Context, tokenIssuer, jwt string) (claims, time.Time, error) {
+	unverified, err := unverified_jwt.ParseUnverified(jwt)
 	if err != nil {
-		return fmt.Errorf("getting untrusted issuer from endpoint %v failed for claim %q: %v", endpoint.URL, r.claim, err)
+		return nil, time.Time{}, fmt.Errorf("parsing the claim JWT failed: %w", err)
+	}
+	untrustedIss, err := unverified.Issuer()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("getting untrusted issuer of the claim JWT failed: %w", err)
+	}
+	if r.policy != nil {
+		// Check the issuer before its discovery document is fetched.
+		if err := r.policy.checkIssuer(tokenIssuer, untrustedIss); err != nil {
+			return nil, time.Time{}, err
+		}
 	}
 	glog.V(5).Infof("claim JWT is issued by %v", untrustedIss)
 	glog.V(5).Infof("create a IDTokenVerifier for %v", untrustedIss)
-	v, err := r.Verifier(untrustedIss)
+	v, err := r.Verifier(ctx, untrustedIss)
 	if err != nil {
-		return fmt.Errorf("verifying untrusted issuer %v failed: %v", untrustedIss, err)
+		return nil, time.Time{}, fmt.Errorf("verifying untrusted issuer %v failed: %w", untrustedIss, err)
 	}
-	// verify the claim JWT from remote endpoint
-	t, err := v.Verify(context.Background(), jwt)
+	// verify the claim JWT
+	t, err := v.Verify(ctx, jwt)
 	if err != nil {
-		return fmt.Errorf("verify distributed claim token: %v", err)
+		return nil, time.Time{}, fmt.Errorf("verify claim token: %w", newVerificationError(err))
 	}
 	var distClaims claims
 	if err := t.Claims(&distClaims); err != nil {
-		return fmt.Errorf("could not parse distributed claims for claim %v: %v", r.claim, err)
+		return nil, time.Time{}, fmt.Errorf("%w: could not parse claims in the claim JWT: %v", ErrMalformedToken, err)
 	}
 	glog.V(5).Infof("Verified distributed claims is: %+v", distClaims)
-	value, ok := distClaims[r.claim]
-	if !ok {
-		return fmt.Errorf("jwt returned by distributed claim endpoint %s did not contain claim: %v", endpoint, r.claim)
+	return distClaims, t.Expiry, nil
+}
+
+// mergeClaims inserts the values of claimNames in distClaims into allClaims.
+func mergeClaims(distClaims claims, claimNames []string, allClaims claims) error {
+	for _, name := range claimNames {
+		value, ok := distClaims[name]
+		if !ok {
+			return &InvalidClaimError{Claim: name, Err: errors.New("claim JWT did not contain the claim")}
+		}
+		glog.V(5).Infof("resolved claim name %v has value: %+v", name, string(value))
+		allClaims[name] = value
 	}
-	glog.V(5).Infof("resolved claim name %v has value: %+v", r.claim, string(value))
-	allClaims[r.claim] = value
 	return nil
 }
 
+// AuthenticateToken authenticates the token and resolves its distributed
+// claims. It is equivalent to AuthenticateTokenContext with a background
+// context.
 func (a *Authenticator) AuthenticateToken(token string) (user.Info, map[string]json.RawMessage, bool, error) {
+	return a.AuthenticateTokenContext(context.Background(), token)
+}
+
+// AuthenticateTokenContext authenticates the token and resolves its distributed
+// claims. ctx bounds the whole authentication, including the fetch of the
+// signing keys, the initialization of the verifiers of claim issuers and the
+// calls to distributed claim endpoints.
+func (a *Authenticator) AuthenticateTokenContext(ctx context.Context, token string) (user.Info, map[string]json.RawMessage, bool, error) {
 	glog.V(5).Infof("------------------------------------------------------------")
 	glog.V(5).Infof("Enter AuthenticateToken()")
 	glog.V(5).Infof("Authenticator issuerURL: %v", a.issuerURL)
@@ -622,40 +935,65 @@ func (a *Authenticator) AuthenticateToken(token string) (user.Info, map[string]j
 	//  },
 	//	"exp": 1257897600
 	//}
-	if !hasCorrectIssuer(a.issuerURL, token) {
+	t, err := unverified_jwt.ParseUnverified(token)
+	if err != nil {
+		// Not a token of the authenticator
+		glog.V(5).Infof("Failed to parse the token: %v", err)
 		return nil, nil, false, nil
 	}
+	return a.AuthenticateParsedToken(ctx, t)
+}
+
+// AuthenticateParsedToken is AuthenticateTokenContext for a token already
+// parsed with unverified_jwt.ParseUnverified, e.g., to check its issuer, so
+// that it is not parsed again.
+func (a *Authenticator) AuthenticateParsedToken(ctx context.Context, t *unverified_jwt.Token) (user.Info, map[string]json.RawMessage, bool, error) {
+	if !hasCorrectIssuer(a.issuerURL, t) {
+		return nil, nil, false, nil
+	}
+	return a.authenticate(ctx, t.Raw)
+}
 
+// authenticate verifies a token whose unverified issuer has already been
+// matched against the issuer of the authenticator, and resolves its
+// distributed claims.
+func (a *Authenticator) authenticate(ctx context.Context, token string) (user.Info, map[string]json.RawMessage, bool, error) {
+	if !a.Ready() && a.verifierWaitTimeout > 0 {
+		ctx, cancel := context.WithTimeout(ctx, a.verifierWaitTimeout)
+		defer cancel()
+		if err := a.WaitReady(ctx); err != nil {
+			return nil, nil, false, err
+		}
+	}
 	verifier, ok := a.idTokenVerifier()
 	if !ok {
-		return nil, nil, false, fmt.Errorf("oidc: authenticator not initialized")
+		return nil, nil, false, &NotReadyError{Issuer: a.issuerURL}
 	}
 
-	ctx := context.Background()
 	glog.V(5).Infof("Verify the token ...")
 	idToken, err := verifier.Verify(ctx, token)
 	if err != nil {
-		return nil, nil, false, fmt.Errorf("oidc: verify token: %v", err)
+		return nil, nil, false, fmt.Errorf("oidc: verify token: %w", newVerificationError(err))
 	}
 	glog.V(5).Infof("The idToken returned by Verify() is:")
 	glog.V(5).Infof("%+v", *idToken)
 
 	var c claims
 	if err := idToken.Claims(&c); err != nil {
-		return nil, nil, false, fmt.Errorf("oidc: parse claims: %v", err)
+		return nil, nil, false, fmt.Errorf("%w: parse claims: %v", ErrMalformedToken, err)
 	}
 	glog.V(5).Infof("The idToken claims is:")
 	glog.V(5).Infof("%+v", c)
 
 	if a.resolver != nil {
-		if err := a.resolver.expand(c); err != nil {
-			return nil, nil, false, fmt.Errorf("oidc: could not expand distributed claims: %v", err)
+		if err := a.resolver.expand(ctx, idToken.Issuer, c); err != nil {
+			return nil, nil, false, fmt.Errorf("oidc: could not expand distributed claims: %w", err)
 		}
 	}
 
 	var username string
 	if err := c.unmarshalClaim(a.usernameClaim, &username); err != nil {
-		return nil, nil, false, fmt.Errorf("oidc: parse username claims %q: %v", a.usernameClaim, err)
+		return nil, nil, false, &InvalidClaimError{Claim: a.usernameClaim, Err: err}
 	}
 
 	if a.usernameClaim == "email" {
@@ -664,12 +1002,12 @@ func (a *Authenticator) AuthenticateToken(token string) (user.Info, map[string]j
 		if hasEmailVerified := c.hasClaim("email_verified"); hasEmailVerified {
 			var emailVerified bool
 			if err := c.unmarshalClaim("email_verified", &emailVerified); err != nil {
-				return nil, nil, false, fmt.Errorf("oidc: parse 'email_verified' claim: %v", err)
+				return nil, nil, false, &InvalidClaimError{Claim: "email_verified", Err: err}
 			}
 
 			// If the email_verified claim is present we have to verify it is set to `true`.
 			if !emailVerified {
-				return nil, nil, false, fmt.Errorf("oidc: email not verified")
+				return nil, nil, false, &InvalidClaimError{Claim: "email_verified", Err: errors.New("email not verified")}
 			}
 		}
 	}
@@ -687,7 +1025,7 @@ func (a *Authenticator) AuthenticateToken(token string) (user.Info, map[string]j
 			// See: https://github.com/kubernetes/kubernetes/issues/33290
 			var groups stringOrArray
 			if err := c.unmarshalClaim(a.groupsClaim, &groups); err != nil {
-				return nil, nil, false, fmt.Errorf("oidc: parse groups claim %q: %v", a.groupsClaim, err)
+				return nil, nil, false, &InvalidClaimError{Claim: a.groupsClaim, Err: err}
 			}
 			info.Groups = []string(groups)
 		}
@@ -704,17 +1042,17 @@ func (a *Authenticator) AuthenticateToken(token string) (user.Info, map[string]j
 	// check to ensure all required claims are present in the ID token and have matching values.
 	for claim, value := range a.requiredClaims {
 		if !c.hasClaim(claim) {
-			return nil, nil, false, fmt.Errorf("oidc: required claim %s not present in ID token", claim)
+			return nil, nil, false, &RequiredClaimError{Claim: claim, Want: value, Missing: true}
 		}
 		glog.V(5).Infof("c has claim %v, value=", claim, value)
 
 		// NOTE: Only string values are supported as valid required claim values.
 		var claimValue string
 		if err := c.unmarshalClaim(claim, &claimValue); err != nil {
-			return nil, nil, false, fmt.Errorf("oidc: parse claim %s: %v", claim, err)
+			return nil, nil, false, &RequiredClaimError{Claim: claim, Want: value, Got: string(c[claim])}
 		}
 		if claimValue != value {
-			return nil, nil, false, fmt.Errorf("oidc: required claim %s value does not match. Got = %s, want = %s", claim, claimValue, value)
+			return nil, nil, false, &RequiredClaimError{Claim: claim, Want: value, Got: claimValue}
 		}
 	}
 
@@ -736,12 +1074,9 @@ func (a *Authenticator) AuthenticateToken(token string) (user.Info, map[string]j
 // token as bearer token.  If the access token is "", the authorization header
 // will not be set.
 // TODO: Allow passing in JSON hints to the IDP.
-func getClaimJWT(client *http.Client, url, accessToken string) (string, error) {
+func getClaimJWT(ctx context.Context, client *http.Client, url, accessToken string) (string, error) {
 	glog.V(5).Infof("getClaimJWT(): url=%v, accessToken=%v", url, accessToken)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	// TODO: Allow passing request body with configurable information.
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -755,11 +1090,11 @@ func getClaimJWT(client *http.Client, url, accessToken string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer response.Body.Close()
 	// Report non-OK status code as an error.
 	if response.StatusCode < http.StatusOK || response.StatusCode > http.StatusIMUsed {
 		return "", fmt.Errorf("error while getting distributed claim JWT: %v", response.Status)
 	}
-	defer response.Body.Close()
 	responseBytes, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return "", fmt.Errorf("could not decode distributed claim response")
@@ -0,0 +1,1513 @@
+package oidc_library
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/golang/glog"
+	"gopkg.in/square/go-jose.v2"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+)
+
+const (
+	testClientID    = "test-client-id"
+	testAccessToken = "group_access_token"
+	testKeyFile     = "../testdata/oidc_server_signing_key.pem"
+
+	// testVerifierWaitTimeout bounds how long a test token waits for the
+	// verifiers of the test servers.
+	testVerifierWaitTimeout = 10 * time.Second
+
+	testOidcConfig = `{
+	  "issuer": "{{.ISSUER_URL}}",
+	  "jwks_uri": "{{.ISSUER_URL}}/jwks"
+	}`
+
+	testGroupResp = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "groups": ["group1", "group2"],
+	  "exp": 10413792000
+	}`
+
+	testDistributedClaims = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "username": "test-user-name",
+	  "_claim_names": {
+	    "groups": "group_source_1"
+	  },
+	  "_claim_sources": {
+	    "group_source_1": {
+	      "endpoint": "{{.ISSUER_URL}}/groups",
+	      "access_token": "group_access_token"
+	    }
+	  },
+	  "exp": 10413792000
+	}`
+
+	testAggregatedClaims = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "username": "test-user-name",
+	  "_claim_names": {
+	    "groups": "group_source_1"
+	  },
+	  "_claim_sources": {
+	    "group_source_1": {
+	      "JWT": "{{.CLAIM_JWT}}"
+	    }
+	  },
+	  "exp": 10413792000
+	}`
+
+	testClaimsResp = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "groups": ["group1", "group2"],
+	  "roles": ["admin"],
+	  "entitlements": ["read", "write"],
+	  "exp": 10413792000
+	}`
+
+	testTenantsResp = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "tenants": ["tenant1"],
+	  "exp": 10413792000
+	}`
+
+	testMultipleDistributedClaims = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "username": "test-user-name",
+	  "_claim_names": {
+	    "groups": "claim_source_1",
+	    "roles": "claim_source_1",
+	    "entitlements": "claim_source_1",
+	    "tenants": "claim_source_2"
+	  },
+	  "_claim_sources": {
+	    "claim_source_1": {
+	      "endpoint": "{{.ISSUER_URL}}/claims",
+	      "access_token": "group_access_token"
+	    },
+	    "claim_source_2": {
+	      "JWT": "{{.CLAIM_JWT}}"
+	    }
+	  },
+	  "exp": 10413792000
+	}`
+
+	testEmptyClaimSource = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "username": "test-user-name",
+	  "_claim_names": {
+	    "groups": "group_source_1"
+	  },
+	  "_claim_sources": {
+	    "group_source_1": {}
+	  },
+	  "exp": 10413792000
+	}`
+)
+
+// templateValues are the values substituted into the test claim templates.
+type templateValues struct {
+	ISSUER_URL string
+	CLAIM_JWT  string
+}
+
+// testOidcServer is an OIDC provider serving discovery, JWKS and a groups
+// distributed claim endpoint.
+type testOidcServer struct {
+	httpServer *httptest.Server
+	signer     jose.Signer
+	caFile     string
+
+	// claimRequests counts the requests to the distributed claim endpoints.
+	claimRequests int32
+
+	// unblock is closed to release the requests to blocked paths.
+	unblock chan struct{}
+
+	// jwksRequests counts the requests to the JWKS endpoint.
+	jwksRequests int32
+
+	// discoveryRequests counts the requests to the discovery endpoint.
+	discoveryRequests int32
+	// discoveryFailures is the number of the next discovery requests that
+	// fail.
+	discoveryFailures int32
+
+	m sync.Mutex
+	// jwks is the key set served by the JWKS endpoint.
+	// Guarded by m.
+	jwks jose.JSONWebKeySet
+	// jwksCacheControl is the Cache-Control header of the JWKS response.
+	// Guarded by m.
+	jwksCacheControl string
+}
+
+// newTestOidcServer starts an OIDC provider that signs tokens with the key in
+// testKeyFile. The groups endpoint requires testAccessToken as bearer token.
+// Requests to blockPaths do not complete until the server is closed.
+func newTestOidcServer(t *testing.T, blockPaths ...string) *testOidcServer {
+	return newTestOidcServerWithKey(t, loadTestSigningKey(t, testKeyFile), blockPaths...)
+}
+
+// newTestOidcServerWithKey starts an OIDC provider like newTestOidcServer
+// that signs tokens with privKey.
+func newTestOidcServerWithKey(t *testing.T, privKey *jose.JSONWebKey, blockPaths ...string) *testOidcServer {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(privKey.Algorithm), Key: privKey}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	s := &testOidcServer{signer: signer, unblock: make(chan struct{})}
+	s.jwks = jose.JSONWebKeySet{Keys: []jose.JSONWebKey{privKey.Public()}}
+	blocked := map[string]bool{}
+	for _, path := range blockPaths {
+		blocked[path] = true
+	}
+
+	s.httpServer = httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		glog.V(5).Infof("request: %+v", *req)
+		if blocked[req.URL.Path] {
+			<-s.unblock
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			atomic.AddInt32(&s.discoveryRequests, 1)
+			if atomic.AddInt32(&s.discoveryFailures, -1) >= 0 {
+				resp.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			resp.Header().Set("Content-Type", "application/json")
+			resp.Write([]byte(s.render(t, testOidcConfig, "")))
+		case "/jwks":
+			atomic.AddInt32(&s.jwksRequests, 1)
+			s.m.Lock()
+			jwks, cacheControl := s.jwks, s.jwksCacheControl
+			s.m.Unlock()
+			resp.Header().Set("Content-Type", "application/json")
+			if cacheControl != "" {
+				resp.Header().Set("Cache-Control", cacheControl)
+			}
+			json.NewEncoder(resp).Encode(jwks)
+		case "/groups":
+			atomic.AddInt32(&s.claimRequests, 1)
+			if req.Header.Get("Authorization") != fmt.Sprintf("Bearer %v", testAccessToken) {
+				resp.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			resp.Write([]byte(s.sign(t, s.signer, testGroupResp, "")))
+		case "/claims":
+			atomic.AddInt32(&s.claimRequests, 1)
+			if req.Header.Get("Authorization") != fmt.Sprintf("Bearer %v", testAccessToken) {
+				resp.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			resp.Write([]byte(s.sign(t, s.signer, testClaimsResp, "")))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	caFile, err := ioutil.TempFile("", "temp_ca.cert")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary file: %v", err)
+	}
+	defer caFile.Close()
+	pemBlock := &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.httpServer.TLS.Certificates[0].Certificate[0],
+	}
+	if err := pem.Encode(caFile, pemBlock); err != nil {
+		t.Fatalf("Failed to encode the CA certificate: %v", err)
+	}
+	s.caFile = caFile.Name()
+	return s
+}
+
+// rotateKey replaces the key set served by the server with a new key, and
+// returns a signer for the new key.
+func (s *testOidcServer) rotateKey(t *testing.T, kid string) jose.Signer {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	key := jose.JSONWebKey{Key: priv, KeyID: kid, Algorithm: string(jose.RS256)}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.jwks = jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}}
+	return signer
+}
+
+func (s *testOidcServer) close() {
+	close(s.unblock)
+	s.httpServer.Close()
+	os.Remove(s.caFile)
+}
+
+// render fills in the issuer URL and the claim JWT in a claim template.
+func (s *testOidcServer) render(t *testing.T, claimTemplate, claimJwt string) string {
+	tpl, err := template.New("claims").Parse(claimTemplate)
+	if err != nil {
+		t.Fatalf("Failed to parse the claim template: %v", err)
+	}
+	buffer := bytes.NewBuffer(nil)
+	if err := tpl.Execute(buffer, templateValues{ISSUER_URL: s.httpServer.URL, CLAIM_JWT: claimJwt}); err != nil {
+		t.Fatalf("Failed to execute the claim template: %v", err)
+	}
+	return buffer.String()
+}
+
+// sign renders the claim template and signs it with signer.
+func (s *testOidcServer) sign(t *testing.T, signer jose.Signer, claimTemplate, claimJwt string) string {
+	signed, err := signer.Sign([]byte(s.render(t, claimTemplate, claimJwt)))
+	if err != nil {
+		t.Fatalf("Failed to sign the JWT: %v", err)
+	}
+	jwt, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize the JWT: %v", err)
+	}
+	return jwt
+}
+
+// newAuthenticator creates an authenticator that resolves the groups claim
+// and distributedClaims of tokens issued by the test server.
+func (s *testOidcServer) newAuthenticator(t *testing.T, distributedClaims ...string) *Authenticator {
+	a, err := NewAuthenticatorWithIssuerURL(Options{
+		IssuerURL:           s.httpServer.URL,
+		ClientID:            testClientID,
+		CAFile:              s.caFile,
+		UsernameClaim:       "username",
+		VerifierWaitTimeout: testVerifierWaitTimeout,
+		GroupsClaim:         "groups",
+		DistributedClaims:   distributedClaims,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	return a
+}
+
+// loadTestSigningKey loads a PKCS#1 RSA private key from a PEM file.
+func loadTestSigningKey(t *testing.T, path string) *jose.JSONWebKey {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read key file: %v", err)
+	}
+	p, _ := pem.Decode(d)
+	if p == nil {
+		t.Fatalf("Failed to decode the PEM file %v", path)
+	}
+	priv, err := x509.ParsePKCS1PrivateKey(p.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse private key: %v", err)
+	}
+	return &jose.JSONWebKey{Key: priv, Algorithm: string(jose.RS256)}
+}
+
+// newUntrustedSigner creates a signer with a freshly generated key that is not
+// published by the test server.
+func newUntrustedSigner(t *testing.T) jose.Signer {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: priv}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	return signer
+}
+
+func TestAuthenticateTokenClaimSources(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	a := s.newAuthenticator(t)
+	defer a.Close()
+
+	testCases := []struct {
+		name       string
+		token      func() string
+		wantGroups []string
+		wantErr    bool
+	}{
+		{
+			name: "distributed claim",
+			token: func() string {
+				return s.sign(t, s.signer, testDistributedClaims, "")
+			},
+			wantGroups: []string{"group1", "group2"},
+		},
+		{
+			name: "aggregated claim",
+			token: func() string {
+				claimJwt := s.sign(t, s.signer, testGroupResp, "")
+				return s.sign(t, s.signer, testAggregatedClaims, claimJwt)
+			},
+			wantGroups: []string{"group1", "group2"},
+		},
+		{
+			name: "aggregated claim with an invalid signature",
+			token: func() string {
+				claimJwt := s.sign(t, newUntrustedSigner(t), testGroupResp, "")
+				return s.sign(t, s.signer, testAggregatedClaims, claimJwt)
+			},
+			wantErr: true,
+		},
+		{
+			name: "claim source without endpoint or JWT",
+			token: func() string {
+				return s.sign(t, s.signer, testEmptyClaimSource, "")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, claims, ok, err := a.AuthenticateToken(tc.token())
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("AuthenticateToken() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil || !ok {
+				t.Fatalf("AuthenticateToken() = ok %v, err %v; want ok", ok, err)
+			}
+			if got := info.GetGroups(); !reflect.DeepEqual(got, tc.wantGroups) {
+				t.Errorf("groups = %v, want %v", got, tc.wantGroups)
+			}
+			if _, ok := claims["groups"]; !ok {
+				t.Errorf("resolved claims do not contain groups: %+v", claims)
+			}
+			if _, ok := claims[claimSourcesKey]; ok {
+				t.Errorf("resolved claims still contain %v", claimSourcesKey)
+			}
+		})
+	}
+}
+
+func TestAuthenticateTokenDistributedClaims(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	tenantsJwt := s.sign(t, s.signer, testTenantsResp, "")
+	token := s.sign(t, s.signer, testMultipleDistributedClaims, tenantsJwt)
+
+	testCases := []struct {
+		name              string
+		distributedClaims []string
+		wantClaims        map[string]string
+		wantMissingClaims []string
+	}{
+		{
+			name:              "groups claim only",
+			wantClaims:        map[string]string{"groups": `["group1","group2"]`},
+			wantMissingClaims: []string{"roles", "entitlements", "tenants"},
+		},
+		{
+			name:              "listed claims",
+			distributedClaims: []string{"roles", "tenants"},
+			wantClaims: map[string]string{
+				"groups":  `["group1","group2"]`,
+				"roles":   `["admin"]`,
+				"tenants": `["tenant1"]`,
+			},
+			wantMissingClaims: []string{"entitlements"},
+		},
+		{
+			name:              "all claims",
+			distributedClaims: []string{AllDistributedClaims},
+			wantClaims: map[string]string{
+				"groups":       `["group1","group2"]`,
+				"roles":        `["admin"]`,
+				"entitlements": `["read","write"]`,
+				"tenants":      `["tenant1"]`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := s.newAuthenticator(t, tc.distributedClaims...)
+			defer a.Close()
+			_, claims, ok, err := a.AuthenticateToken(token)
+			if err != nil || !ok {
+				t.Fatalf("AuthenticateToken() = ok %v, err %v; want ok", ok, err)
+			}
+			for name, want := range tc.wantClaims {
+				var v interface{}
+				if err := json.Unmarshal(claims[name], &v); err != nil {
+					t.Fatalf("claim %v is not valid JSON: %v", name, err)
+				}
+				got, _ := json.Marshal(v)
+				if string(got) != want {
+					t.Errorf("claim %v = %s, want %s", name, got, want)
+				}
+			}
+			for _, name := range tc.wantMissingClaims {
+				if _, ok := claims[name]; ok {
+					t.Errorf("claim %v should not be resolved", name)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticateTokenEdDSA(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	s := newTestOidcServerWithKey(t, &jose.JSONWebKey{Key: priv, KeyID: "ed25519-key", Algorithm: EdDSA})
+	defer s.close()
+	newAuthenticator := func(algs ...string) *Authenticator {
+		a, err := NewAuthenticatorWithIssuerURL(Options{
+			IssuerURL:            s.httpServer.URL,
+			ClientID:             testClientID,
+			CAFile:               s.caFile,
+			UsernameClaim:        "username",
+			GroupsClaim:          "groups",
+			SupportedSigningAlgs: algs,
+			VerifierWaitTimeout:  testVerifierWaitTimeout,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create an authenticator: %v", err)
+		}
+		return a
+	}
+
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{
+			// The JWT of the groups endpoint is signed with EdDSA too
+			name:  "distributed claims",
+			token: s.sign(t, s.signer, testDistributedClaims, ""),
+		},
+		{
+			name:  "aggregated claims",
+			token: s.sign(t, s.signer, testAggregatedClaims, s.sign(t, s.signer, testGroupResp, "")),
+		},
+	}
+	a := newAuthenticator(oidc.RS256, EdDSA)
+	defer a.Close()
+	rsaOnly := newAuthenticator()
+	defer rsaOnly.Close()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, _, ok, err := a.AuthenticateToken(tc.token)
+			if err != nil || !ok {
+				t.Fatalf("AuthenticateToken() = ok %v, err %v; want ok", ok, err)
+			}
+			if !reflect.DeepEqual(info.GetGroups(), []string{"group1", "group2"}) {
+				t.Errorf("groups = %v, want [group1 group2]", info.GetGroups())
+			}
+			// RS256 is the default signing algorithm
+			if _, _, ok, err := rsaOnly.AuthenticateToken(tc.token); err == nil || ok {
+				t.Errorf("AuthenticateToken() of an EdDSA token without EdDSA = ok %v, err %v; want an error", ok, err)
+			}
+		})
+	}
+}
+
+func TestClaimCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newClaimCache(2, time.Minute, func() time.Time { return now })
+	groups := claims{"groups": json.RawMessage(`["group1"]`)}
+
+	c.add("k1", groups, now.Add(time.Hour))
+	c.add("k2", groups, now.Add(10*time.Second))
+	if _, ok := c.get("k1"); !ok {
+		t.Errorf("k1 should be cached")
+	}
+	// k3 evicts k2, the least recently used entry.
+	c.add("k3", groups, now.Add(time.Hour))
+	if _, ok := c.get("k2"); ok {
+		t.Errorf("k2 should have been evicted")
+	}
+
+	// k1 is capped at the max TTL.
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get("k1"); ok {
+		t.Errorf("k1 should have expired at the max TTL")
+	}
+
+	// An entry never outlives the expiry of its claim JWT.
+	c.add("k4", groups, now.Add(10*time.Second))
+	now = now.Add(20 * time.Second)
+	if _, ok := c.get("k4"); ok {
+		t.Errorf("k4 should have expired at the claim JWT expiry")
+	}
+
+	// An expired claim JWT is not cached.
+	c.add("k5", groups, now.Add(-time.Second))
+	if _, ok := c.get("k5"); ok {
+		t.Errorf("k5 should not be cached")
+	}
+
+	want := ClaimCacheStats{Hits: 1, Misses: 4, Entries: 1}
+	if got := c.stats(); got != want {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestAuthenticateTokenClaimCache(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	a, err := NewAuthenticatorWithIssuerURL(Options{
+		IssuerURL:           s.httpServer.URL,
+		ClientID:            testClientID,
+		CAFile:              s.caFile,
+		UsernameClaim:       "username",
+		VerifierWaitTimeout: testVerifierWaitTimeout,
+		GroupsClaim:         "groups",
+		DistributedClaims:   []string{"roles"},
+		ClaimCacheSize:      10,
+		ClaimCacheMaxTTL:    time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	defer a.Close()
+
+	token := s.sign(t, s.signer, testDistributedClaims, "")
+	for i := 0; i < 3; i++ {
+		info, _, ok, err := a.AuthenticateToken(token)
+		if err != nil || !ok {
+			t.Fatalf("AuthenticateToken() = ok %v, err %v; want ok", ok, err)
+		}
+		if got, want := info.GetGroups(), []string{"group1", "group2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("groups = %v, want %v", got, want)
+		}
+	}
+	if got := atomic.LoadInt32(&s.claimRequests); got != 1 {
+		t.Errorf("claim endpoint was called %v times, want 1", got)
+	}
+	want := ClaimCacheStats{Hits: 2, Misses: 1, Entries: 1}
+	if got := a.ClaimCacheStats(); got != want {
+		t.Errorf("ClaimCacheStats() = %+v, want %+v", got, want)
+	}
+
+	// A claim missing from the cached claims fails like a claim missing from
+	// a freshly resolved claim JWT.
+	missing := strings.Replace(testDistributedClaims, `"groups": "group_source_1"`, `"roles": "group_source_1"`, 1)
+	_, _, _, err = a.AuthenticateToken(s.sign(t, s.signer, missing, ""))
+	var claimSourceErr *ClaimSourceError
+	if !errors.As(err, &claimSourceErr) {
+		t.Errorf("AuthenticateToken() of a claim missing from the cache error = %v, want a ClaimSourceError", err)
+	}
+	if got := atomic.LoadInt32(&s.claimRequests); got != 1 {
+		t.Errorf("claim endpoint was called %v times, want 1", got)
+	}
+}
+
+func TestAuthenticateTokenContextCancellation(t *testing.T) {
+	testCases := []struct {
+		name string
+		// blockPaths are the paths of the token issuer that never respond.
+		blockPaths []string
+		// claimIssuerBlockPaths are the paths of the claim issuer that never
+		// respond.
+		claimIssuerBlockPaths []string
+	}{
+		{
+			name:       "JWKS fetch",
+			blockPaths: []string{"/jwks"},
+		},
+		{
+			name:       "distributed claim endpoint",
+			blockPaths: []string{"/groups"},
+		},
+		{
+			name:                  "claim issuer verifier init",
+			claimIssuerBlockPaths: []string{"/.well-known/openid-configuration"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestOidcServer(t, tc.blockPaths...)
+			defer s.close()
+			a := s.newAuthenticator(t)
+			defer a.Close()
+
+			token := s.sign(t, s.signer, testDistributedClaims, "")
+			if tc.claimIssuerBlockPaths != nil {
+				claimIssuer := newTestOidcServer(t, tc.claimIssuerBlockPaths...)
+				defer claimIssuer.close()
+				claimJwt := claimIssuer.sign(t, claimIssuer.signer, testGroupResp, "")
+				token = s.sign(t, s.signer, testAggregatedClaims, claimJwt)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				_, _, _, err := a.AuthenticateTokenContext(ctx, token)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatalf("AuthenticateTokenContext() succeeded, want an error")
+				}
+				if ctx.Err() == nil {
+					t.Fatalf("AuthenticateTokenContext() failed before the deadline: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("AuthenticateTokenContext() did not return after the deadline")
+			}
+		})
+	}
+}
+
+func TestMultiIssuerAuthenticator(t *testing.T) {
+	s1 := newTestOidcServer(t)
+	defer s1.close()
+	s2 := newTestOidcServer(t)
+	defer s2.close()
+	unknown := newTestOidcServer(t)
+	defer unknown.close()
+
+	options := func(s *testOidcServer) Options {
+		return Options{
+			IssuerURL:           s.httpServer.URL,
+			ClientID:            testClientID,
+			CAFile:              s.caFile,
+			UsernameClaim:       "username",
+			GroupsClaim:         "groups",
+			VerifierWaitTimeout: testVerifierWaitTimeout,
+		}
+	}
+	m, err := NewMultiIssuerAuthenticator([]Options{options(s1), options(s2)})
+	if err != nil {
+		t.Fatalf("Failed to create a multi-issuer authenticator: %v", err)
+	}
+	defer m.Close()
+
+	for _, s := range []*testOidcServer{s1, s2} {
+		info, _, ok, err := m.AuthenticateToken(s.sign(t, s.signer, testDistributedClaims, ""))
+		if err != nil || !ok {
+			t.Fatalf("AuthenticateToken() for issuer %v = ok %v, err %v; want ok", s.httpServer.URL, ok, err)
+		}
+		if got, want := info.GetGroups(), []string{"group1", "group2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("groups = %v, want %v", got, want)
+		}
+	}
+
+	if _, _, ok, err := m.AuthenticateToken(unknown.sign(t, unknown.signer, testDistributedClaims, "")); !errors.Is(err, ErrUntrustedIssuer) || ok {
+		t.Errorf("AuthenticateToken() for an unknown issuer = ok %v, err %v; want %v", ok, err, ErrUntrustedIssuer)
+	}
+	if _, _, ok, err := m.AuthenticateToken("malformed.token"); !errors.Is(err, ErrMalformedToken) || ok {
+		t.Errorf("AuthenticateToken() for a malformed token = ok %v, err %v; want %v", ok, err, ErrMalformedToken)
+	}
+
+	if _, err := NewMultiIssuerAuthenticator([]Options{options(s1), options(s1)}); err == nil {
+		t.Errorf("NewMultiIssuerAuthenticator() with a duplicate issuer succeeded, want an error")
+	}
+}
+
+// signClaims signs the JSON encoding of c with signer.
+func signClaims(t *testing.T, signer jose.Signer, c map[string]interface{}) string {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("Failed to marshal the claims: %v", err)
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("Failed to sign the JWT: %v", err)
+	}
+	jwt, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize the JWT: %v", err)
+	}
+	return jwt
+}
+
+func TestHasURLPrefix(t *testing.T) {
+	testCases := []struct {
+		url    string
+		prefix string
+		want   bool
+	}{
+		{url: "https://idp.example.com/groups", prefix: "https://idp.example.com", want: true},
+		{url: "https://idp.example.com/claims/groups", prefix: "https://idp.example.com/claims/", want: true},
+		{url: "https://idp.example.com/claims", prefix: "https://idp.example.com/claims", want: true},
+		{url: "https://idp.example.com/claimsx", prefix: "https://idp.example.com/claims", want: false},
+		{url: "https://idp.example.com/claims/../admin", prefix: "https://idp.example.com/claims", want: false},
+		{url: "https://idp.example.com.evil.com/groups", prefix: "https://idp.example.com", want: false},
+		{url: "https://idp.example.com:8443/groups", prefix: "https://idp.example.com", want: false},
+		{url: "http://idp.example.com/groups", prefix: "https://idp.example.com", want: false},
+		{url: "https://user@idp.example.com/groups", prefix: "https://idp.example.com", want: false},
+	}
+	for _, tc := range testCases {
+		if got := hasURLPrefix(tc.url, tc.prefix); got != tc.want {
+			t.Errorf("hasURLPrefix(%q, %q) = %v, want %v", tc.url, tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestClaimSourcePolicy(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	rogue := newTestOidcServer(t)
+	defer rogue.close()
+
+	tokenWithEndpoint := func(endpoint string) string {
+		return signClaims(t, s.signer, map[string]interface{}{
+			"iss":          s.httpServer.URL,
+			"aud":          testClientID,
+			"username":     "test-user-name",
+			"_claim_names": map[string]string{"groups": "src1"},
+			"_claim_sources": map[string]interface{}{
+				"src1": map[string]string{"endpoint": endpoint, "access_token": testAccessToken},
+			},
+			"exp": 10413792000,
+		})
+	}
+
+	testCases := []struct {
+		name          string
+		policy        *ClaimSourcePolicy
+		endpoint      string
+		wantEndpoint  bool
+		wantIssuer    bool
+		wantRogueCall bool
+	}{
+		{
+			name:     "endpoint of the token issuer",
+			policy:   &ClaimSourcePolicy{},
+			endpoint: s.httpServer.URL + "/groups",
+		},
+		{
+			name:         "rogue endpoint",
+			policy:       &ClaimSourcePolicy{},
+			endpoint:     rogue.httpServer.URL + "/groups",
+			wantEndpoint: true,
+		},
+		{
+			name:         "endpoint outside of the allowed prefixes",
+			policy:       &ClaimSourcePolicy{AllowedEndpointPrefixes: []string{s.httpServer.URL + "/claims"}},
+			endpoint:     s.httpServer.URL + "/groups",
+			wantEndpoint: true,
+		},
+		{
+			name:          "allowed endpoint with a rogue claim issuer",
+			policy:        &ClaimSourcePolicy{AllowedEndpointPrefixes: []string{rogue.httpServer.URL}},
+			endpoint:      rogue.httpServer.URL + "/groups",
+			wantIssuer:    true,
+			wantRogueCall: true,
+		},
+		{
+			name: "allowed endpoint and claim issuer",
+			policy: &ClaimSourcePolicy{
+				AllowedEndpointPrefixes: []string{rogue.httpServer.URL},
+				AllowedClaimIssuers:     map[string][]string{s.httpServer.URL: {rogue.httpServer.URL}},
+			},
+			endpoint:      rogue.httpServer.URL + "/groups",
+			wantRogueCall: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&rogue.claimRequests, 0)
+			a, err := NewAuthenticatorWithIssuerURL(Options{
+				IssuerURL:           s.httpServer.URL,
+				ClientID:            testClientID,
+				CAFile:              s.caFile,
+				UsernameClaim:       "username",
+				VerifierWaitTimeout: testVerifierWaitTimeout,
+				GroupsClaim:         "groups",
+				ClaimSourcePolicy:   tc.policy,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create an authenticator: %v", err)
+			}
+			defer a.Close()
+
+			_, _, _, err = a.AuthenticateToken(tokenWithEndpoint(tc.endpoint))
+			var endpointErr *UntrustedClaimEndpointError
+			if got := errors.As(err, &endpointErr); got != tc.wantEndpoint {
+				t.Errorf("AuthenticateToken() error = %v, want UntrustedClaimEndpointError: %v", err, tc.wantEndpoint)
+			}
+			var issuerErr *UntrustedClaimIssuerError
+			if got := errors.As(err, &issuerErr); got != tc.wantIssuer {
+				t.Errorf("AuthenticateToken() error = %v, want UntrustedClaimIssuerError: %v", err, tc.wantIssuer)
+			}
+			if !tc.wantEndpoint && !tc.wantIssuer && err != nil {
+				t.Errorf("AuthenticateToken() failed: %v", err)
+			}
+			if got := atomic.LoadInt32(&rogue.claimRequests) > 0; got != tc.wantRogueCall {
+				t.Errorf("rogue endpoint called: %v, want %v", got, tc.wantRogueCall)
+			}
+		})
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	testCases := []struct {
+		cacheControl string
+		want         time.Duration
+	}{
+		{cacheControl: "", want: -1},
+		{cacheControl: "public, max-age=3600", want: time.Hour},
+		{cacheControl: "Max-Age=60, must-revalidate", want: time.Minute},
+		{cacheControl: "no-cache", want: 0},
+		{cacheControl: "max-age=invalid", want: -1},
+	}
+	for _, tc := range testCases {
+		h := http.Header{}
+		h.Set("Cache-Control", tc.cacheControl)
+		if got := cacheMaxAge(h); got != tc.want {
+			t.Errorf("cacheMaxAge(%q) = %v, want %v", tc.cacheControl, got, tc.want)
+		}
+	}
+}
+
+func TestRotatingKeySet(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	signer1 := s.rotateKey(t, "key-1")
+	s.m.Lock()
+	s.jwksCacheControl = "max-age=3600"
+	s.m.Unlock()
+
+	var m sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		m.Lock()
+		defer m.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		m.Lock()
+		defer m.Unlock()
+		now = now.Add(d)
+	}
+
+	a, err := NewAuthenticatorWithIssuerURL(Options{
+		IssuerURL:           s.httpServer.URL,
+		ClientID:            testClientID,
+		CAFile:              s.caFile,
+		UsernameClaim:       "username",
+		VerifierWaitTimeout: testVerifierWaitTimeout,
+		KeySetOptions: &KeySetOptions{
+			MinRefreshInterval:    time.Minute,
+			RetiredKeyGracePeriod: time.Hour,
+		},
+		now: clock,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	defer a.Close()
+
+	claims := map[string]interface{}{
+		"iss":      s.httpServer.URL,
+		"aud":      testClientID,
+		"username": "test-user-name",
+		"exp":      10413792000,
+	}
+	token1 := signClaims(t, signer1, claims)
+	var signer2 jose.Signer
+
+	steps := []struct {
+		name         string
+		advance      time.Duration
+		rotate       string
+		token        func() string
+		wantOK       bool
+		wantRequests int32
+	}{
+		{
+			name:         "current key",
+			token:        func() string { return token1 },
+			wantOK:       true,
+			wantRequests: 1,
+		},
+		{
+			// The refetch is rate limited right after the last fetch.
+			name:         "rotated key within the min refresh interval",
+			rotate:       "key-2",
+			token:        func() string { return signClaims(t, signer2, claims) },
+			wantOK:       false,
+			wantRequests: 1,
+		},
+		{
+			name:         "rotated key",
+			advance:      2 * time.Minute,
+			token:        func() string { return signClaims(t, signer2, claims) },
+			wantOK:       true,
+			wantRequests: 2,
+		},
+		{
+			name:         "retired key within the grace period",
+			token:        func() string { return token1 },
+			wantOK:       true,
+			wantRequests: 2,
+		},
+		{
+			name:         "retired key after the grace period",
+			advance:      2 * time.Hour,
+			token:        func() string { return token1 },
+			wantOK:       false,
+			wantRequests: 3,
+		},
+	}
+	for _, step := range steps {
+		advance(step.advance)
+		if step.rotate != "" {
+			signer2 = s.rotateKey(t, step.rotate)
+		}
+		_, _, ok, err := a.AuthenticateToken(step.token())
+		if ok != step.wantOK {
+			t.Errorf("%v: AuthenticateToken() = ok %v, err %v; want ok %v", step.name, ok, err, step.wantOK)
+		}
+		if got := atomic.LoadInt32(&s.jwksRequests); got != step.wantRequests {
+			t.Errorf("%v: JWKS requests = %v, want %v", step.name, got, step.wantRequests)
+		}
+	}
+}
+
+func TestRotatingKeySetWithoutKeyIDs(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+
+	// newKey generates a key without a key id, so that its tokens carry no
+	// "kid" header.
+	newKey := func() (jose.JSONWebKey, jose.Signer) {
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("Failed to generate a key: %v", err)
+		}
+		key := jose.JSONWebKey{Key: priv, Algorithm: string(jose.RS256)}
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+		if err != nil {
+			t.Fatalf("Failed to create a signer: %v", err)
+		}
+		return key, signer
+	}
+	key1, signer1 := newKey()
+	key2, signer2 := newKey()
+	key3, signer3 := newKey()
+	publish := func(keys ...jose.JSONWebKey) {
+		s.m.Lock()
+		defer s.m.Unlock()
+		s.jwks.Keys = nil
+		for _, k := range keys {
+			s.jwks.Keys = append(s.jwks.Keys, k.Public())
+		}
+	}
+	publish(key1, key2)
+
+	var m sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		m.Lock()
+		defer m.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		m.Lock()
+		defer m.Unlock()
+		now = now.Add(d)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keySet := newRotatingKeySet(ctx, s.httpServer.Client(), s.httpServer.URL+"/jwks", KeySetOptions{
+		MinRefreshInterval:    time.Minute,
+		RetiredKeyGracePeriod: time.Hour,
+	}, clock)
+
+	claims := map[string]interface{}{"iss": s.httpServer.URL}
+	steps := []struct {
+		name    string
+		advance time.Duration
+		publish []jose.JSONWebKey
+		signer  jose.Signer
+		wantOK  bool
+	}{
+		{name: "first key", signer: signer1, wantOK: true},
+		{name: "second key", signer: signer2, wantOK: true},
+		{name: "rotated key", advance: 2 * time.Minute, publish: []jose.JSONWebKey{key3}, signer: signer3, wantOK: true},
+		{name: "retired first key within the grace period", signer: signer1, wantOK: true},
+		{name: "retired second key within the grace period", signer: signer2, wantOK: true},
+		{name: "retired first key after the grace period", advance: 2 * time.Hour, signer: signer1, wantOK: false},
+		{name: "retired second key after the grace period", signer: signer2, wantOK: false},
+		{name: "current key", signer: signer3, wantOK: true},
+	}
+	for _, step := range steps {
+		advance(step.advance)
+		if step.publish != nil {
+			publish(step.publish...)
+		}
+		_, err := keySet.VerifySignature(context.Background(), signClaims(t, step.signer, claims))
+		if ok := err == nil; ok != step.wantOK {
+			t.Errorf("%v: VerifySignature() error = %v, want ok %v", step.name, err, step.wantOK)
+		}
+	}
+}
+
+// writeBundle writes an offline bundle holding the keys of iss to path.
+func writeBundle(t *testing.T, path, iss string, keys ...jose.JSONWebKey) {
+	var i bundleIssuer
+	i.Discovery.Issuer = iss
+	i.JWKS.Keys = keys
+	d, err := json.Marshal(bundleFile{Issuers: []bundleIssuer{i}})
+	if err != nil {
+		t.Fatalf("Failed to marshal the bundle: %v", err)
+	}
+	if err := ioutil.WriteFile(path, d, 0600); err != nil {
+		t.Fatalf("Failed to write the bundle: %v", err)
+	}
+}
+
+func TestOfflineBundle(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	iss := s.httpServer.URL
+	s.m.Lock()
+	keys := s.jwks.Keys
+	s.m.Unlock()
+
+	f, err := ioutil.TempFile("", "oidc_bundle.json")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	writeBundle(t, f.Name(), iss, keys...)
+
+	oldToken := s.sign(t, s.signer, testAggregatedClaims, s.sign(t, s.signer, testGroupResp, ""))
+	distributedToken := s.sign(t, s.signer, testDistributedClaims, "")
+	// Any connection to the issuer fails from now on.
+	s.httpServer.Close()
+
+	a, err := New(Options{
+		IssuerURL:         iss,
+		ClientID:          testClientID,
+		UsernameClaim:     "username",
+		GroupsClaim:       "groups",
+		OfflineBundleFile: f.Name(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	defer a.Close()
+
+	info, _, ok, err := a.AuthenticateToken(oldToken)
+	if err != nil || !ok {
+		t.Fatalf("AuthenticateToken() with aggregated claims = ok %v, err %v; want ok", ok, err)
+	}
+	if got, want := info.GetGroups(), []string{"group1", "group2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("groups = %v, want %v", got, want)
+	}
+	if _, _, ok, err := a.AuthenticateToken(distributedToken); err == nil || ok {
+		t.Errorf("AuthenticateToken() with a distributed claim endpoint = ok %v, err %v; want an error", ok, err)
+	}
+
+	// Rotate the key in the bundle.
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	key := jose.JSONWebKey{Key: priv, KeyID: "rotated", Algorithm: string(jose.RS256)}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	newToken := s.sign(t, signer, testAggregatedClaims, s.sign(t, signer, testGroupResp, ""))
+	if _, _, ok, err := a.AuthenticateToken(newToken); err == nil || ok {
+		t.Errorf("AuthenticateToken() with a key not in the bundle = ok %v, err %v; want an error", ok, err)
+	}
+	writeBundle(t, f.Name(), iss, key.Public())
+	// Make sure the change is detected on file systems with a coarse mtime.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(f.Name(), later, later); err != nil {
+		t.Fatalf("Failed to change the bundle mtime: %v", err)
+	}
+	if _, _, ok, err := a.AuthenticateToken(newToken); err != nil || !ok {
+		t.Errorf("AuthenticateToken() with the rotated key = ok %v, err %v; want ok", ok, err)
+	}
+	if _, _, ok, err := a.AuthenticateToken(oldToken); err == nil || ok {
+		t.Errorf("AuthenticateToken() with a key removed from the bundle = ok %v, err %v; want an error", ok, err)
+	}
+
+	if _, err := New(Options{
+		IssuerURL:         "https://other.example.com",
+		ClientID:          testClientID,
+		UsernameClaim:     "username",
+		OfflineBundleFile: f.Name(),
+	}); err == nil {
+		t.Errorf("New() with an issuer not in the bundle succeeded, want an error")
+	}
+}
+
+func TestAuthenticatorReadiness(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	atomic.StoreInt32(&s.discoveryFailures, math.MaxInt32)
+
+	a, err := New(Options{
+		IssuerURL:     s.httpServer.URL,
+		ClientID:      testClientID,
+		CAFile:        s.caFile,
+		UsernameClaim: "username",
+		RetryBackoff:  RetryBackoff{Initial: 10 * time.Millisecond, Max: 20 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	defer a.Close()
+	readyz := NewReadyzHandler(a)
+	token := s.sign(t, s.signer, testDistributedClaims, "")
+
+	if a.Ready() {
+		t.Errorf("Ready() = true before the issuer is discovered, want false")
+	}
+	if err := a.Check(nil); !errors.Is(err, ErrVerifierNotReady) {
+		t.Errorf("Check() = %v before the issuer is discovered, want %v", err, ErrVerifierNotReady)
+	}
+	if rec := serveReadyz(readyz); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz status = %v before the issuer is discovered, want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+	if _, _, ok, err := a.AuthenticateToken(token); !errors.Is(err, ErrVerifierNotReady) || ok {
+		t.Errorf("AuthenticateToken() before the issuer is discovered = ok %v, err %v; want %v", ok, err, ErrVerifierNotReady)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.WaitReady(ctx); !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrVerifierNotReady) {
+		t.Errorf("WaitReady() = %v, want %v and %v", err, ErrVerifierNotReady, context.DeadlineExceeded)
+	}
+
+	atomic.StoreInt32(&s.discoveryFailures, 0)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady() = %v, want nil", err)
+	}
+	if n := atomic.LoadInt32(&s.discoveryRequests); n < 2 {
+		t.Errorf("discovery requests = %v, want the discovery to be retried", n)
+	}
+	if !a.Ready() {
+		t.Errorf("Ready() = false after the issuer is discovered, want true")
+	}
+	if err := a.Check(nil); err != nil {
+		t.Errorf("Check() = %v after the issuer is discovered, want nil", err)
+	}
+	if rec := serveReadyz(readyz); rec.Code != http.StatusOK {
+		t.Errorf("readyz status = %v after the issuer is discovered, want %v", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAsyncIDTokenVerifierReadiness(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	atomic.StoreInt32(&s.discoveryFailures, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := s.httpServer.Client()
+	backoff := RetryBackoff{Initial: 10 * time.Millisecond}
+	av := newAsyncIDTokenVerifier(oidc.ClientContext(ctx, client), client, nil, backoff, &oidc.Config{ClientID: testClientID}, s.httpServer.URL)
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if err := av.WaitReady(waitCtx); err != nil {
+		t.Fatalf("WaitReady() = %v, want nil", err)
+	}
+	if !av.Ready() || av.verifier() == nil {
+		t.Errorf("Ready() = %v, verifier() = %v; want an initialized verifier", av.Ready(), av.verifier())
+	}
+	if n := atomic.LoadInt32(&s.discoveryRequests); n != 3 {
+		t.Errorf("discovery requests = %v, want 3", n)
+	}
+}
+
+// serveReadyz serves a readyz request with h.
+func serveReadyz(h http.Handler) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	return rec
+}
+
+func TestAuthenticateTokenErrors(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	a, err := NewAuthenticatorWithIssuerURL(Options{
+		IssuerURL:           s.httpServer.URL,
+		ClientID:            testClientID,
+		CAFile:              s.caFile,
+		UsernameClaim:       "username",
+		GroupsClaim:         "groups",
+		RequiredClaims:      map[string]string{"tenant": "tenant1"},
+		VerifierWaitTimeout: testVerifierWaitTimeout,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	defer a.Close()
+
+	// tokenClaims returns valid claims of a token, with overrides applied. A
+	// nil override deletes the claim.
+	tokenClaims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":      s.httpServer.URL,
+			"aud":      testClientID,
+			"username": "test-user-name",
+			"tenant":   "tenant1",
+			"exp":      10413792000,
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	aggregated := func(claimJwt string) map[string]interface{} {
+		return tokenClaims(map[string]interface{}{
+			"_claim_names":   map[string]string{"groups": "src1"},
+			"_claim_sources": map[string]interface{}{"src1": map[string]string{"JWT": claimJwt}},
+		})
+	}
+	expired := time.Now().Add(-time.Hour).Unix()
+
+	testCases := []struct {
+		name    string
+		token   string
+		wantErr error
+		// wantClaimSource is whether the error is a *ClaimSourceError.
+		wantClaimSource bool
+	}{
+		{
+			name:    "expired token",
+			token:   signClaims(t, s.signer, tokenClaims(map[string]interface{}{"exp": expired})),
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name:    "bad signature",
+			token:   signClaims(t, newUntrustedSigner(t), tokenClaims(nil)),
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "wrong audience",
+			token:   signClaims(t, s.signer, tokenClaims(map[string]interface{}{"aud": "other-client-id"})),
+			wantErr: ErrWrongAudience,
+		},
+		{
+			name: "claim source unavailable",
+			token: signClaims(t, s.signer, tokenClaims(map[string]interface{}{
+				"_claim_names": map[string]string{"groups": "src1"},
+				"_claim_sources": map[string]interface{}{"src1": map[string]string{
+					"endpoint":     s.httpServer.URL + "/missing",
+					"access_token": testAccessToken,
+				}},
+			})),
+			wantErr:         ErrClaimSourceUnavailable,
+			wantClaimSource: true,
+		},
+		{
+			name: "expired claim JWT",
+			token: signClaims(t, s.signer, aggregated(signClaims(t, s.signer, map[string]interface{}{
+				"iss":    s.httpServer.URL,
+				"aud":    testClientID,
+				"groups": []string{"group1"},
+				"exp":    expired,
+			}))),
+			wantErr:         ErrTokenExpired,
+			wantClaimSource: true,
+		},
+		{
+			name:    "required claim mismatch",
+			token:   signClaims(t, s.signer, tokenClaims(map[string]interface{}{"tenant": "tenant2"})),
+			wantErr: ErrRequiredClaimMismatch,
+		},
+		{
+			name:    "required claim missing",
+			token:   signClaims(t, s.signer, tokenClaims(map[string]interface{}{"tenant": nil})),
+			wantErr: ErrRequiredClaimMismatch,
+		},
+		{
+			name:    "username missing",
+			token:   signClaims(t, s.signer, tokenClaims(map[string]interface{}{"username": nil})),
+			wantErr: ErrInvalidClaim,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, ok, err := a.AuthenticateToken(tc.token)
+			if ok || !errors.Is(err, tc.wantErr) {
+				t.Fatalf("AuthenticateToken() = ok %v, err %v; want %v", ok, err, tc.wantErr)
+			}
+			var claimSourceErr *ClaimSourceError
+			if got := errors.As(err, &claimSourceErr); got != tc.wantClaimSource {
+				t.Errorf("AuthenticateToken() error = %v, want ClaimSourceError: %v", err, tc.wantClaimSource)
+			}
+		})
+	}
+
+	_, _, _, err = a.AuthenticateToken(signClaims(t, s.signer, tokenClaims(map[string]interface{}{"tenant": "tenant2"})))
+	var requiredErr *RequiredClaimError
+	if !errors.As(err, &requiredErr) || requiredErr.Claim != "tenant" || requiredErr.Got != "tenant2" || requiredErr.Want != "tenant1" {
+		t.Errorf("AuthenticateToken() error = %#v, want a RequiredClaimError for tenant", err)
+	}
+}
+
+func TestNewVerificationError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want error
+	}{
+		{err: errors.New("oidc: malformed jwt: square/go-jose: compact JWS format must have three parts"), want: ErrMalformedToken},
+		{err: errors.New("oidc: token is expired (Token Expiry: 2019-01-01 00:00:00 +0000 UTC)"), want: ErrTokenExpired},
+		{err: errors.New("oidc: current time 2019-01-01 before the nbf (not before) time: 2020-01-01"), want: ErrTokenNotYetValid},
+		{err: errors.New(`oidc: id token issued by a different provider, expected "a" got "b"`), want: ErrWrongIssuer},
+		{err: errors.New(`oidc: expected audience "a" got ["b"]`), want: ErrWrongAudience},
+		{err: errors.New("failed to verify signature: fetching keys oidc: get keys failed: 503"), want: ErrKeysUnavailable},
+		{err: errors.New("failed to verify signature: failed to verify id token signature"), want: ErrInvalidSignature},
+		{err: errors.New(`oidc: id token signed with unsupported algorithm, expected ["RS256"] got "HS256"`), want: ErrInvalidSignature},
+	}
+	for _, tc := range testCases {
+		err := newVerificationError(tc.err)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("newVerificationError(%q) = %v, want %v", tc.err, err.Kind, tc.want)
+		}
+		if err.Error() != tc.err.Error() {
+			t.Errorf("newVerificationError(%q).Error() = %q, want the message unchanged", tc.err, err.Error())
+		}
+	}
+	if err := newVerificationError(errors.New("unknown")); err.Kind != nil {
+		t.Errorf("newVerificationError() of an unknown error = %v, want no kind", err.Kind)
+	}
+}
+
+func TestTokenAdapter(t *testing.T) {
+	s := newTestOidcServer(t)
+	defer s.close()
+	a := s.newAuthenticator(t, "roles", "tenants")
+	defer a.Close()
+	other := newTestOidcServer(t)
+	defer other.close()
+
+	tenantsJwt := s.sign(t, s.signer, testTenantsResp, "")
+	token := s.sign(t, s.signer, testMultipleDistributedClaims, tenantsJwt)
+
+	testCases := []struct {
+		name          string
+		opts          TokenAdapterOptions
+		token         string
+		apiAudiences  authenticator.Audiences
+		wantOK        bool
+		wantAudiences authenticator.Audiences
+		wantExtra     map[string][]string
+	}{
+		{
+			name:          "all claims",
+			opts:          TokenAdapterOptions{ExtraPrefix: "oidc.example.com/"},
+			token:         token,
+			wantOK:        true,
+			wantAudiences: authenticator.Audiences{testClientID},
+			wantExtra: map[string][]string{
+				"oidc.example.com/username": {"test-user-name"},
+				"oidc.example.com/groups":   {"group1", "group2"},
+				"oidc.example.com/roles":    {"admin"},
+				"oidc.example.com/tenants":  {"tenant1"},
+			},
+		},
+		{
+			name:          "listed claims",
+			opts:          TokenAdapterOptions{ExtraClaims: []string{"roles", "missing"}},
+			token:         token,
+			wantOK:        true,
+			wantAudiences: authenticator.Audiences{testClientID},
+			wantExtra:     map[string][]string{"roles": {"admin"}},
+		},
+		{
+			name:          "matching apiserver audiences",
+			opts:          TokenAdapterOptions{ExtraClaims: []string{"tenants"}},
+			token:         token,
+			apiAudiences:  authenticator.Audiences{"api", testClientID},
+			wantOK:        true,
+			wantAudiences: authenticator.Audiences{testClientID},
+			wantExtra:     map[string][]string{"tenants": {"tenant1"}},
+		},
+		{
+			name:         "other apiserver audiences",
+			token:        token,
+			apiAudiences: authenticator.Audiences{"api"},
+		},
+		{
+			name:  "token of another issuer",
+			token: other.sign(t, other.signer, testDistributedClaims, ""),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tokenAuthenticator authenticator.Token = NewTokenAdapter(a, tc.opts)
+			ctx := context.Background()
+			if tc.apiAudiences != nil {
+				ctx = authenticator.WithAudiences(ctx, tc.apiAudiences)
+			}
+			resp, ok, err := tokenAuthenticator.AuthenticateToken(ctx, tc.token)
+			if err != nil || ok != tc.wantOK {
+				t.Fatalf("AuthenticateToken() = ok %v, err %v; want ok %v", ok, err, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(resp.Audiences, tc.wantAudiences) {
+				t.Errorf("audiences = %v, want %v", resp.Audiences, tc.wantAudiences)
+			}
+			if got, want := resp.User.GetName(), "test-user-name"; got != want {
+				t.Errorf("user name = %v, want %v", got, want)
+			}
+			if got, want := resp.User.GetGroups(), []string{"group1", "group2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("groups = %v, want %v", got, want)
+			}
+			if got := resp.User.GetExtra(); !reflect.DeepEqual(got, tc.wantExtra) {
+				t.Errorf("extra = %v, want %v", got, tc.wantExtra)
+			}
+		})
+	}
+}
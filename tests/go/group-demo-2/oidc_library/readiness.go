@@ -0,0 +1,105 @@
+package oidc_library
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	defaultRetryInitial = time.Second
+	defaultRetryMax     = 10 * time.Second
+	defaultRetryFactor  = 2.0
+	defaultRetryJitter  = 0.1
+)
+
+// RetryBackoff configures how the discovery of an issuer is retried until it
+// succeeds. The zero value uses the defaults.
+type RetryBackoff struct {
+	// Initial is the delay before the first retry. Defaults to 1 second.
+	Initial time.Duration
+
+	// Max bounds the delay between two retries. Defaults to 10 seconds.
+	Max time.Duration
+
+	// Factor multiplies the delay after each retry. Defaults to 2.
+	Factor float64
+
+	// Jitter, if positive, adds up to Jitter*delay to each delay. Defaults to
+	// 0.1.
+	Jitter float64
+}
+
+func (b RetryBackoff) withDefaults() RetryBackoff {
+	if b.Initial <= 0 {
+		b.Initial = defaultRetryInitial
+	}
+	if b.Max <= 0 {
+		b.Max = defaultRetryMax
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+	if b.Factor < 1 {
+		b.Factor = defaultRetryFactor
+	}
+	if b.Jitter <= 0 {
+		b.Jitter = defaultRetryJitter
+	}
+	return b
+}
+
+// retryWithBackoff waits as configured by b and calls fn, until fn returns
+// true or ctx is done.
+func retryWithBackoff(ctx context.Context, b RetryBackoff, fn func() bool) {
+	b = b.withDefaults()
+	delay := b.Initial
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait.Jitter(delay, b.Jitter)):
+		}
+		if fn() {
+			return
+		}
+		delay = time.Duration(float64(delay) * b.Factor)
+		if delay > b.Max {
+			delay = b.Max
+		}
+	}
+}
+
+// HealthChecker reports whether an authenticator is ready to verify tokens.
+// It has the method set of the HealthChecker of
+// k8s.io/apiserver/pkg/server/healthz, so an authenticator can also be
+// installed as a readyz check of an apiserver.
+type HealthChecker interface {
+	Name() string
+	Check(req *http.Request) error
+}
+
+// NewReadyzHandler returns a handler that responds 200 if all the checks pass,
+// and 503 with the failed checks otherwise.
+func NewReadyzHandler(checks ...HealthChecker) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var failed []string
+		for _, c := range checks {
+			if err := c.Check(req); err != nil {
+				failed = append(failed, fmt.Sprintf("[-]%v failed: %v", c.Name(), err))
+			}
+		}
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(failed) > 0 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			for _, f := range failed {
+				fmt.Fprintln(resp, f)
+			}
+			return
+		}
+		fmt.Fprintln(resp, "ok")
+	})
+}
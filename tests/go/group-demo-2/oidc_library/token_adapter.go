@@ -0,0 +1,150 @@
+package oidc_library
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/golang/glog"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// registeredClaims are the claims of a token that are not copied into
+// user.Info.Extra unless listed in TokenAdapterOptions.ExtraClaims.
+var registeredClaims = map[string]bool{
+	"iss": true,
+	"sub": true,
+	"aud": true,
+	"exp": true,
+	"nbf": true,
+	"iat": true,
+	"jti": true,
+	"azp": true,
+}
+
+// ClaimsAuthenticator authenticates a token and returns its resolved claims.
+// It is implemented by Authenticator and MultiIssuerAuthenticator.
+type ClaimsAuthenticator interface {
+	AuthenticateTokenContext(ctx context.Context, token string) (user.Info, map[string]json.RawMessage, bool, error)
+}
+
+// TokenAdapterOptions configures a TokenAdapter.
+type TokenAdapterOptions struct {
+	// ExtraClaims are the claims copied into user.Info.Extra. If empty, all
+	// the claims except the registered JWT claims ("iss", "sub", "aud", "exp",
+	// "nbf", "iat", "jti" and "azp") are copied.
+	ExtraClaims []string
+
+	// ExtraPrefix is prepended to the claim names to form the keys of
+	// user.Info.Extra, e.g., "oidc.example.com/" maps the claim "roles" to
+	// "oidc.example.com/roles".
+	ExtraPrefix string
+}
+
+// TokenAdapter adapts a ClaimsAuthenticator to the authenticator.Token
+// interface of k8s.io/apiserver, so that it can be chained with the other
+// token authenticators of an apiserver. The "aud" claim of a token is returned
+// in Response.Audiences and the resolved claims in user.Info.Extra.
+type TokenAdapter struct {
+	authenticator ClaimsAuthenticator
+	extraClaims   []string
+	extraPrefix   string
+}
+
+var _ authenticator.Token = &TokenAdapter{}
+
+// NewTokenAdapter creates a TokenAdapter for a.
+func NewTokenAdapter(a ClaimsAuthenticator, opts TokenAdapterOptions) *TokenAdapter {
+	return &TokenAdapter{
+		authenticator: a,
+		extraClaims:   opts.ExtraClaims,
+		extraPrefix:   opts.ExtraPrefix,
+	}
+}
+
+// AuthenticateToken implements authenticator.Token. If the context carries
+// the audiences of the apiserver, a token for none of them is not
+// authenticated, and Response.Audiences is the intersection of the audiences.
+func (t *TokenAdapter) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	info, c, ok, err := t.authenticator.AuthenticateTokenContext(ctx, token)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	var auds authenticator.Audiences
+	if raw, ok := c["aud"]; ok {
+		var aud stringOrArray
+		if err := json.Unmarshal(raw, &aud); err != nil {
+			return nil, false, &InvalidClaimError{Claim: "aud", Err: err}
+		}
+		auds = authenticator.Audiences(aud)
+	}
+	if apiAuds, ok := authenticator.AudiencesFrom(ctx); ok {
+		auds = intersectAudiences(apiAuds, auds)
+		if len(auds) == 0 {
+			glog.V(4).Infof("token audiences do not match the audiences %v", apiAuds)
+			return nil, false, nil
+		}
+	}
+
+	return &authenticator.Response{
+		Audiences: auds,
+		User: &user.DefaultInfo{
+			Name:   info.GetName(),
+			UID:    info.GetUID(),
+			Groups: info.GetGroups(),
+			Extra:  t.extra(info.GetExtra(), claims(c)),
+		},
+	}, true, nil
+}
+
+// extra adds the claims to copy to the extra of a user.
+func (t *TokenAdapter) extra(extra map[string][]string, c claims) map[string][]string {
+	out := map[string][]string{}
+	for k, v := range extra {
+		out[k] = v
+	}
+	names := t.extraClaims
+	if len(names) == 0 {
+		for name := range c {
+			if !registeredClaims[name] {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, name := range names {
+		raw, ok := c[name]
+		if !ok {
+			continue
+		}
+		out[t.extraPrefix+name] = claimValues(raw)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// claimValues converts a claim to the values of an extra: a string or a list
+// of strings is kept as is, other claims are kept as JSON.
+func claimValues(raw json.RawMessage) []string {
+	var values stringOrArray
+	if err := json.Unmarshal(raw, &values); err == nil {
+		return []string(values)
+	}
+	return []string{string(raw)}
+}
+
+// intersectAudiences returns the audiences of tokenAuds that are in apiAuds.
+func intersectAudiences(apiAuds, tokenAuds authenticator.Audiences) authenticator.Audiences {
+	var auds authenticator.Audiences
+	for _, aud := range tokenAuds {
+		for _, apiAud := range apiAuds {
+			if aud == apiAud {
+				auds = append(auds, aud)
+				break
+			}
+		}
+	}
+	return auds
+}
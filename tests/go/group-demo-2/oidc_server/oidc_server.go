@@ -128,6 +128,9 @@ func NewOidcTestServer(pubKey jose.JSONWebKeySet, oidcConfig string, signer jose
 	return oidcServer
 }
 
+var signingKeyFile = flag.String("signing-key-file", "../testdata/oidc_server_signing_key.pem",
+	"path to the private key that signs the JWTs, e.g., an Ed25519 key to sign with EdDSA")
+
 func init() {
 	// Parse the flags for glog
 	flag.Parse()
@@ -137,7 +140,7 @@ func main() {
 	glog.V(5).Infof("Start OIDC server...")
 
 	// Load the private key for signing JWT
-	privKey, err := utils.LoadJSONWebPrivateKeyFromFile("../testdata/oidc_server_signing_key.pem", jose.RS256)
+	privKey, err := utils.LoadJSONWebPrivateKeyFromFile(*signingKeyFile, "")
 	if err != nil {
 		glog.Fatalf("Failed to load private key from file: %v", err)
 	}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/claim_policy"
+	oidc "github.com/lei-tang/dev/tests/go/group-demo-2/oidc_library"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	bearerPrefix = "Bearer "
+	// forwardedUserHeader and forwardedGroupsHeader carry the user name and
+	// the groups of the resolved token to the upstream.
+	forwardedUserHeader   = "X-Forwarded-User"
+	forwardedGroupsHeader = "X-Forwarded-Groups"
+	// readyzPath is the path of the readiness check, which is not proxied.
+	readyzPath = "/readyz"
+)
+
+// errorBody is the JSON body of a failed request.
+type errorBody struct {
+	Code    int    `json:"code"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// tokenProxy is a reverse proxy for services without a mesh. It authenticates
+// the bearer token of a request, resolves its distributed claims and forwards
+// the request upstream with a token of the resolved claims signed by the token
+// service.
+type tokenProxy struct {
+	authenticator oidc.ClaimsAuthenticator
+	// jwtOptions are the issuer, audience and lifetime of the re-signed tokens.
+	jwtOptions utils.JwtOptions
+	// policy filters and transforms the claims of the re-signed tokens.
+	policy *claim_policy.Policy
+	signer jose.Signer
+	// forwardUser adds the X-Forwarded-User and X-Forwarded-Groups headers.
+	forwardUser bool
+	proxy       *httputil.ReverseProxy
+}
+
+// newTokenProxy creates a tokenProxy to upstream that signs the resolved
+// tokens with the key in signingKeyFile.
+func newTokenProxy(a oidc.ClaimsAuthenticator, upstream *url.URL, jwtOptions utils.JwtOptions,
+	policy *claim_policy.Policy, signingKeyFile, keyID string, forwardUser bool) (*tokenProxy, error) {
+	privKey, err := utils.LoadJSONWebPrivateKeyFromFile(signingKeyFile, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the signing key: %v", err)
+	}
+	// The key id defaults to the RFC 7638 thumbprint of the key
+	if len(keyID) > 0 {
+		privKey.KeyID = keyID
+	}
+	signer, err := utils.NewJwtSigner(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a signer: %v", err)
+	}
+	return &tokenProxy{
+		authenticator: a,
+		jwtOptions:    jwtOptions,
+		policy:        policy,
+		signer:        signer,
+		forwardUser:   forwardUser,
+		proxy:         httputil.NewSingleHostReverseProxy(upstream),
+	}, nil
+}
+
+// newProxyHandler returns the handler of the proxy and of the readiness check
+// of the authenticator.
+func newProxyHandler(p *tokenProxy, ready oidc.HealthChecker) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(readyzPath, oidc.NewReadyzHandler(ready))
+	mux.Handle("/", p)
+	return mux
+}
+
+func (p *tokenProxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		writeError(resp, http.StatusUnauthorized, "no bearer token")
+		return
+	}
+	jwt := strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix))
+
+	info, claims, ok, err := p.authenticator.AuthenticateTokenContext(req.Context(), jwt)
+	if err != nil {
+		glog.V(4).Infof("Failed to authenticate the token: %v", err)
+		code, msg := errorStatus(err)
+		writeError(resp, code, msg)
+		return
+	}
+	if !ok {
+		writeError(resp, http.StatusUnauthorized, "the token failed to pass the authentication")
+		return
+	}
+	claims, err = p.policy.Apply(claims)
+	if err != nil {
+		glog.V(4).Infof("Failed to apply the claim policy: %v", err)
+		writeError(resp, http.StatusUnauthorized, "the claims are denied by the claim policy")
+		return
+	}
+	resigned, err := utils.CreateJwtWithOptions(p.signer, claims, p.jwtOptions)
+	if err != nil {
+		glog.Errorf("Failed to create a JWT with the resolved claims: %v", err)
+		writeError(resp, http.StatusInternalServerError, "failed to sign the resolved token")
+		return
+	}
+
+	// The request is shared with the caller of ServeHTTP, so the headers are
+	// changed on a copy.
+	out := req.Clone(req.Context())
+	out.Header.Set("Authorization", bearerPrefix+resigned)
+	// Never forward the headers of the client, which can't be trusted.
+	out.Header.Del(forwardedUserHeader)
+	out.Header.Del(forwardedGroupsHeader)
+	if p.forwardUser {
+		out.Header.Set(forwardedUserHeader, info.GetName())
+		for _, g := range info.GetGroups() {
+			out.Header.Add(forwardedGroupsHeader, g)
+		}
+	}
+	p.proxy.ServeHTTP(resp, out)
+}
+
+// errorStatus maps an error of the authentication to the status and the
+// message of the response: an untrusted issuer or claim source is forbidden,
+// and the other failures are unauthorized. The message is fixed so that the
+// internal URLs and verifier details of err are only logged.
+func errorStatus(err error) (int, string) {
+	if errors.Is(err, oidc.ErrUntrustedIssuer) || errors.Is(err, oidc.ErrUntrustedClaimSource) {
+		return http.StatusForbidden, "the token issuer or claim source is not trusted"
+	}
+	return http.StatusUnauthorized, "the token failed to pass the authentication"
+}
+
+func writeError(resp http.ResponseWriter, code int, msg string) {
+	resp.Header().Set("Content-Type", "application/json")
+	if code == http.StatusUnauthorized {
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	resp.WriteHeader(code)
+	body := errorBody{Code: code, Status: http.StatusText(code), Message: msg}
+	if err := json.NewEncoder(resp).Encode(&body); err != nil {
+		glog.Errorf("Failed to encode the error: %v", err)
+	}
+}
+
+func main() {
+	var listenAddress string
+	var tlsCertFile string
+	var tlsKeyFile string
+	var upstreamURL string
+	var issuerURL string
+	var clientID string
+	var caFile string
+	var usernameClaim string
+	var groupsClaim string
+	var distributedClaims string
+	var forwardUser bool
+	var issuer string
+	var claimPolicyFile string
+	var audience string
+	var maxTokenLifetime time.Duration
+	var signingKeyFile string
+	var keyID string
+	flag.StringVar(&listenAddress, "listen-address", ":8080", "the address to serve the proxy on")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "path to the TLS certificate of the proxy, serves HTTP if empty")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "path to the TLS private key of the proxy")
+	flag.StringVar(&upstreamURL, "upstream", "", "the URL of the upstream service")
+	flag.StringVar(&issuerURL, "issuer-url", "", "the URL of the issuer of the incoming tokens")
+	flag.StringVar(&clientID, "client-id", "test-client-id", "the client id the tokens must be issued for")
+	flag.StringVar(&caFile, "ca-file", "", "path to the root CA certificate of the issuer")
+	flag.StringVar(&usernameClaim, "username-claim", "username", "the claim to use as the user name")
+	flag.StringVar(&groupsClaim, "groups-claim", "groups", "the claim to use as the groups, resolved if distributed")
+	flag.StringVar(&distributedClaims, "distributed-claims", "",
+		"comma-separated names of the other distributed claims to resolve, or \"*\" for all distributed claims")
+	flag.BoolVar(&forwardUser, "forward-user", false,
+		"add the X-Forwarded-User and X-Forwarded-Groups headers to the upstream requests")
+	flag.StringVar(&issuer, "issuer", "token-service", "the issuer of the re-signed tokens")
+	flag.StringVar(&claimPolicyFile, "claim-policy-file", "",
+		"path to a YAML or JSON policy that filters and transforms the claims of the re-signed tokens")
+	flag.StringVar(&audience, "audience", "",
+		"comma-separated audiences of the re-signed tokens, defaults to the audience of the incoming tokens")
+	flag.DurationVar(&maxTokenLifetime, "max-token-lifetime", 0,
+		"the max lifetime of the re-signed tokens, which never outlive the incoming tokens; 0 keeps their expiry")
+	flag.StringVar(&signingKeyFile, "signing-key-file", "../testdata/token_service_signing_key.pem",
+		"path to the private key to sign the resolved tokens, e.g., an Ed25519 key to sign with EdDSA")
+	flag.StringVar(&keyID, "key-id", "",
+		"the key id of the signing key in the JWKS of the issuer, defaults to the RFC 7638 thumbprint of the key")
+	flag.Parse()
+	if len(issuerURL) == 0 {
+		glog.Fatalf("Must specify the issuer URL --issuer-url.")
+	}
+	if len(upstreamURL) == 0 {
+		glog.Fatalf("Must specify the upstream URL --upstream.")
+	}
+	upstream, err := url.Parse(upstreamURL)
+	if err != nil {
+		glog.Fatalf("Failed to parse the upstream URL: %v", err)
+	}
+
+	var claims []string
+	if len(distributedClaims) > 0 {
+		claims = strings.Split(distributedClaims, ",")
+	}
+	a, err := oidc.NewAuthenticatorWithIssuerURL(oidc.Options{
+		IssuerURL:            issuerURL,
+		ClientID:             clientID,
+		CAFile:               caFile,
+		UsernameClaim:        usernameClaim,
+		GroupsClaim:          groupsClaim,
+		DistributedClaims:    claims,
+		SupportedSigningAlgs: utils.SigningAlgs,
+		VerifierWaitTimeout:  10 * time.Second,
+	})
+	if err != nil {
+		glog.Fatalf("Failed to create an oidc authenticator: %v", err)
+	}
+	defer a.Close()
+
+	var policy *claim_policy.Policy
+	if len(claimPolicyFile) > 0 {
+		policy, err = claim_policy.LoadPolicyFromFile(claimPolicyFile)
+		if err != nil {
+			glog.Fatalf("Failed to load the claim policy: %v", err)
+		}
+	}
+	jwtOptions := utils.JwtOptions{
+		Issuer:        issuer,
+		MaxLifetime:   maxTokenLifetime,
+		ResetIssuedAt: true,
+		NewID:         true,
+	}
+	if len(audience) > 0 {
+		jwtOptions.Audience = strings.Split(audience, ",")
+	}
+	p, err := newTokenProxy(a, upstream, jwtOptions, policy, signingKeyFile, keyID, forwardUser)
+	if err != nil {
+		glog.Fatalf("Failed to create the proxy: %v", err)
+	}
+	glog.Infof("Proxying %v to %v", listenAddress, upstream)
+	h := newProxyHandler(p, a)
+	if len(tlsCertFile) > 0 {
+		err = http.ListenAndServeTLS(listenAddress, tlsCertFile, tlsKeyFile, h)
+	} else {
+		err = http.ListenAndServe(listenAddress, h)
+	}
+	if err != nil {
+		glog.Fatalf("Failed to serve the proxy: %v", err)
+	}
+}
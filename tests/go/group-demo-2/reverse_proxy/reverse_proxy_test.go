@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	oidc "github.com/lei-tang/dev/tests/go/group-demo-2/oidc_library"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils/test_idp"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	testUntrustedEndpoint = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "username": "test-user-name",
+	  "_claim_names": {
+	    "groups": "group_source_1"
+	  },
+	  "_claim_sources": {
+	    "group_source_1": {
+	      "endpoint": "https://untrusted.example.com/groups",
+	      "access_token": "group_access_token"
+	    }
+	  },
+	  "exp": 10413792000
+	}`
+)
+
+// upstreamRequest is the request received by the test upstream.
+type upstreamRequest struct {
+	path   string
+	header http.Header
+}
+
+func TestTokenProxy(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	a, err := oidc.NewAuthenticatorWithIssuerURL(oidc.Options{
+		IssuerURL:           idp.Server.URL,
+		ClientID:            test_idp.ClientID,
+		CAFile:              idp.CAFile,
+		UsernameClaim:       "username",
+		GroupsClaim:         "groups",
+		ClaimSourcePolicy:   &oidc.ClaimSourcePolicy{},
+		VerifierWaitTimeout: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	defer a.Close()
+
+	received := make(chan upstreamRequest, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		received <- upstreamRequest{path: req.URL.Path, header: req.Header}
+		resp.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the upstream URL: %v", err)
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	untrustedSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: priv}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	token := idp.Sign(t, idp.Signer, idp.Server.URL, test_idp.DistributedClaims)
+
+	testCases := []struct {
+		name        string
+		forwardUser bool
+		header      http.Header
+		wantCode    int
+		// wantUser and wantGroups are the X-Forwarded-User and
+		// X-Forwarded-Groups headers of the upstream request.
+		wantUser   []string
+		wantGroups []string
+	}{
+		{
+			name:     "distributed groups",
+			header:   http.Header{"Authorization": {"Bearer " + token}},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:        "forwarded user",
+			forwardUser: true,
+			header: http.Header{
+				"Authorization":      {"Bearer " + token},
+				"X-Forwarded-User":   {"spoofed-user"},
+				"X-Forwarded-Groups": {"system:masters"},
+			},
+			wantCode:   http.StatusOK,
+			wantUser:   []string{"test-user-name"},
+			wantGroups: []string{"group1", "group2"},
+		},
+		{
+			name: "spoofed headers",
+			header: http.Header{
+				"Authorization":      {"Bearer " + token},
+				"X-Forwarded-User":   {"spoofed-user"},
+				"X-Forwarded-Groups": {"system:masters"},
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "no token",
+			header:   http.Header{},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "bad signature",
+			header:   http.Header{"Authorization": {"Bearer " + idp.Sign(t, untrustedSigner, idp.Server.URL, test_idp.DistributedClaims)}},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "untrusted claim source",
+			header:   http.Header{"Authorization": {"Bearer " + idp.Sign(t, idp.Signer, idp.Server.URL, testUntrustedEndpoint)}},
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := newTokenProxy(a, upstreamURL, utils.JwtOptions{Issuer: "token-service"}, nil,
+				"../testdata/token_service_signing_key.pem", "", tc.forwardUser)
+			if err != nil {
+				t.Fatalf("Failed to create the proxy: %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/ip", nil)
+			req.Header = tc.header
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			if rec.Code != tc.wantCode {
+				t.Fatalf("status code = %v (%v), want %v", rec.Code, rec.Body.String(), tc.wantCode)
+			}
+
+			if tc.wantCode != http.StatusOK {
+				if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+					t.Errorf("error Content-Type = %q, want application/json", ct)
+				}
+				var body errorBody
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatalf("Failed to parse the error body %q: %v", rec.Body.String(), err)
+				}
+				if body.Code != tc.wantCode || body.Message == "" {
+					t.Errorf("error body = %+v, want the code %v and a message", body, tc.wantCode)
+				}
+				if strings.Contains(body.Message, "127.0.0.1") || strings.Contains(body.Message, "example.com") {
+					t.Errorf("error message %q contains the details of the error", body.Message)
+				}
+				select {
+				case r := <-received:
+					t.Errorf("upstream received a failed request: %+v", r)
+				default:
+				}
+				return
+			}
+
+			r := <-received
+			if r.path != "/ip" {
+				t.Errorf("upstream path = %q, want /ip", r.path)
+			}
+			authz := r.header.Get("Authorization")
+			if !strings.HasPrefix(authz, "Bearer ") || authz == "Bearer "+token {
+				t.Fatalf("upstream Authorization = %q, want the re-signed token", authz)
+			}
+			claims := test_idp.VerifyResigned(t, strings.TrimPrefix(authz, "Bearer "))
+			if got := string(claims["iss"]); got != `"token-service"` {
+				t.Errorf("re-signed token iss = %v, want \"token-service\"", got)
+			}
+			var groups []string
+			if err := json.Unmarshal(claims["groups"], &groups); err != nil {
+				t.Fatalf("Failed to parse the groups of the re-signed token: %v", err)
+			}
+			if want := []string{"group1", "group2"}; !reflect.DeepEqual(groups, want) {
+				t.Errorf("re-signed token groups = %v, want %v", groups, want)
+			}
+			if got := r.header[forwardedUserHeader]; !reflect.DeepEqual(got, tc.wantUser) {
+				t.Errorf("upstream %v = %v, want %v", forwardedUserHeader, got, tc.wantUser)
+			}
+			if got := r.header[forwardedGroupsHeader]; !reflect.DeepEqual(got, tc.wantGroups) {
+				t.Errorf("upstream %v = %v, want %v", forwardedGroupsHeader, got, tc.wantGroups)
+			}
+		})
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	upstreamURL, _ := url.Parse("http://127.0.0.1:1")
+	p, err := newTokenProxy(nil, upstreamURL, utils.JwtOptions{Issuer: "token-service"}, nil,
+		"../testdata/token_service_signing_key.pem", "", false)
+	if err != nil {
+		t.Fatalf("Failed to create the proxy: %v", err)
+	}
+	serve := func(a *oidc.Authenticator, path string) int {
+		rec := httptest.NewRecorder()
+		newProxyHandler(p, a).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	// The issuer can't be discovered
+	notReady, err := oidc.New(oidc.Options{IssuerURL: "https://127.0.0.1:1", UsernameClaim: "username"})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	defer notReady.Close()
+	if code := serve(notReady, readyzPath); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz status code = %v before the issuer is discovered, want %v", code, http.StatusServiceUnavailable)
+	}
+
+	a, err := oidc.NewAuthenticatorWithIssuerURL(oidc.Options{
+		IssuerURL:     idp.Server.URL,
+		ClientID:      test_idp.ClientID,
+		CAFile:        idp.CAFile,
+		UsernameClaim: "username",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	defer a.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.WaitReady(ctx); err != nil {
+		t.Fatalf("The authenticator is not ready: %v", err)
+	}
+	if code := serve(a, readyzPath); code != http.StatusOK {
+		t.Errorf("readyz status code = %v, want %v", code, http.StatusOK)
+	}
+	// The other paths are proxied
+	if code := serve(a, "/ip"); code != http.StatusUnauthorized {
+		t.Errorf("status code of a request without a token = %v, want %v", code, http.StatusUnauthorized)
+	}
+}
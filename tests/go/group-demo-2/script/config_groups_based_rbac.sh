@@ -16,6 +16,9 @@ kubectl apply -f <(istioctl kube-inject -f samples/httpbin/httpbin.yaml) -n $NS
 kubectl apply -f <(istioctl kube-inject -f samples/sleep/sleep.yaml) -n $NS
 
 # Apply an authentication policy to require both mutual TLS and JWT authentication for httpbin.
+# Set TOKEN_SERVICE_JWKS_URI to the /jwks of a running token service, e.g., https://<host>:8443/jwks,
+# to verify with the keys it publishes instead of the sample JWKS.
+TOKEN_SERVICE_JWKS_URI=${TOKEN_SERVICE_JWKS_URI:-"https://raw.githubusercontent.com/istio/istio/master/security/tools/jwt/samples/jwks.json"}
 cat <<EOF | kubectl apply -n $NS -f -
 apiVersion: "authentication.istio.io/v1alpha1"
 kind: "Policy"
@@ -29,7 +32,7 @@ spec:
   origins:
   - jwt:
       issuer: "token-service"
-      jwksUri: "https://raw.githubusercontent.com/istio/istio/master/security/tools/jwt/samples/jwks.json"
+      jwksUri: "${TOKEN_SERVICE_JWKS_URI}"
   principalBinding: USE_ORIGIN
 EOF
 
@@ -16,11 +16,37 @@ kubectl exec $(kubectl get pod -l app=sleep -n $NS -o jsonpath={.items..metadata
 
 ### 3. Resolve the distributed groups in the JWT
 pushd ~/go/src/github.com/lei-tang/dev/tests/go/group-demo-2/distributed_groups
-go run distributed_group.go -logtostderr --tls-cert-path ${TLS_CERT_PATH} -jwt ${JWT}
+go run distributed_group.go -logtostderr --tls-cert-path ${TLS_CERT_PATH} --trusted-issuers "https://127.0.0.1:*" -jwt ${JWT}
 # With resolved groups claim, the curl command from sleep to httpbin succeeds
 export TOKEN="The resolved JWT outputed by the previous step"
 kubectl exec $(kubectl get pod -l app=sleep -n $NS -o jsonpath={.items..metadata.name}) -c sleep -n $NS -- curl http://httpbin.$NS:8000/ip -s -o /dev/null -w "%{http_code}\n" --header "Authorization: Bearer $TOKEN"
 
+### 4. (Optional) Serve the TokenReview webhook that resolves the distributed groups
+# Point the --authentication-token-webhook-config-file of kube-apiserver at https://<host>:8443/authenticate
+pushd ~/go/src/github.com/lei-tang/dev/tests/go/group-demo-2/token_review_webhook
+go run token_review_webhook.go -logtostderr --issuer-url "The issuer URL outputed by the claims-provider server" --ca-file ${TLS_CERT_PATH} --tls-cert-file ${WEBHOOK_CERT} --tls-key-file ${WEBHOOK_KEY}
+
+### 5. (Optional) Serve the Envoy ext_authz gRPC API that resolves the groups and re-signs the JWT inline
+# Point an envoy.filters.http.ext_authz grpc_service at <host>:9001, so that the request
+# with ${JWT} reaches the JWT authentication of httpbin with the re-signed token of step 3
+pushd ~/go/src/github.com/lei-tang/dev/tests/go/group-demo-2/ext_authz
+go run ext_authz.go -logtostderr --tls-cert-path ${TLS_CERT_PATH} --trusted-issuers "https://127.0.0.1:*"
+
+### 6. (Optional) Without a mesh, proxy a service with the tokens swapped for the re-signed tokens
+pushd ~/go/src/github.com/lei-tang/dev/tests/go/group-demo-2/reverse_proxy
+go run reverse_proxy.go -logtostderr --issuer-url "The issuer URL outputed by the claims-provider server" --ca-file ${TLS_CERT_PATH} --upstream http://127.0.0.1:8000 --forward-user
+curl http://127.0.0.1:8080/ip -s -o /dev/null -w "%{http_code}\n" --header "Authorization: Bearer $JWT"
+
+### 7. (Optional) Serve the token service, which exchanges the JWT for the re-signed token over HTTP (RFC 8693)
+pushd ~/go/src/github.com/lei-tang/dev/tests/go/group-demo-2/token_service
+go run . -logtostderr --tls-cert-path ${TLS_CERT_PATH} --trusted-issuers "https://127.0.0.1:*" --tls-cert-file ${TOKEN_SERVICE_CERT} --tls-key-file ${TOKEN_SERVICE_KEY}
+# Or sign with rotated keys persisted in a key file; kill -HUP the token service to rotate them on command
+# go run . -logtostderr --tls-cert-path ${TLS_CERT_PATH} --trusted-issuers "https://127.0.0.1:*" --tls-cert-file ${TOKEN_SERVICE_CERT} --tls-key-file ${TOKEN_SERVICE_KEY} --key-file /tmp/token_service_keys.json --key-rotation-period 24h --key-retirement-period 24h
+# Or sign with a key in the Transit engine of a Vault dev server (vault server -dev -dev-root-token-id=myroot), which never leaves Vault
+# export VAULT_ADDR=http://127.0.0.1:8200 VAULT_TOKEN=myroot; vault secrets enable transit; vault write transit/keys/token-service type=ecdsa-p256
+# go run . -logtostderr --tls-cert-path ${TLS_CERT_PATH} --trusted-issuers "https://127.0.0.1:*" --tls-cert-file ${TOKEN_SERVICE_CERT} --tls-key-file ${TOKEN_SERVICE_KEY} --signer vault --vault-transit-key token-service
+curl -k https://127.0.0.1:8443/token -d grant_type=urn:ietf:params:oauth:grant-type:token-exchange -d subject_token=${JWT} -d subject_token_type=urn:ietf:params:oauth:token-type:jwt
+
 ###Clean up
 k delete ns $NS
 
@@ -0,0 +1,256 @@
+//go:build pkcs11
+// +build pkcs11
+
+package signer_backend
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/miekg/pkcs11"
+)
+
+// The object identifiers of the CKA_EC_PARAMS of the supported curves.
+var (
+	oidP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+// digestInfoPrefixes are the DER prefixes of the DigestInfo of PKCS #1 v1.5,
+// which CKM_RSA_PKCS expects before the digest.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11Signer signs with a private key in a PKCS#11 token. The session of a
+// token is not safe for concurrent use, so the signatures are serialized.
+type pkcs11Signer struct {
+	m       sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+// NewPKCS11Signer creates a signer with a key in a PKCS#11 token. The session
+// of the signer is kept open for the lifetime of the process.
+func NewPKCS11Signer(opts PKCS11Options) (crypto.Signer, error) {
+	if len(opts.Module) == 0 || len(opts.TokenLabel) == 0 || len(opts.KeyLabel) == 0 {
+		return nil, fmt.Errorf("Must specify the PKCS#11 module, token label and key label")
+	}
+	ctx := pkcs11.New(opts.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("Failed to load the PKCS#11 module %v", opts.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("Failed to initialize the PKCS#11 module %v: %v", opts.Module, err)
+	}
+	s, err := newPKCS11Signer(ctx, opts)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	glog.Infof("Signing with the PKCS#11 key %v of the token %v", opts.KeyLabel, opts.TokenLabel)
+	return s, nil
+}
+
+func newPKCS11Signer(ctx *pkcs11.Ctx, opts PKCS11Options) (*pkcs11Signer, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the PKCS#11 slots: %v", err)
+	}
+	slot := -1
+	for _, id := range slots {
+		info, err := ctx.GetTokenInfo(id)
+		if err == nil && info.Label == opts.TokenLabel {
+			slot = int(id)
+			break
+		}
+	}
+	if slot < 0 {
+		return nil, fmt.Errorf("No PKCS#11 token of the label %q", opts.TokenLabel)
+	}
+	session, err := ctx.OpenSession(uint(slot), pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open a PKCS#11 session: %v", err)
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, opts.PIN); err != nil {
+		// The login is shared by the sessions of an application
+		if e, ok := err.(pkcs11.Error); !ok || e != pkcs11.CKR_USER_ALREADY_LOGGED_IN {
+			ctx.CloseSession(session)
+			return nil, fmt.Errorf("Failed to log in to the PKCS#11 token %q: %v", opts.TokenLabel, err)
+		}
+	}
+	s := &pkcs11Signer{ctx: ctx, session: session}
+	if err := s.findKey(opts.KeyLabel); err != nil {
+		ctx.CloseSession(session)
+		return nil, err
+	}
+	return s, nil
+}
+
+// findKey finds the private key of the label and reads its public key.
+func (s *pkcs11Signer) findKey(label string) error {
+	priv, err := s.findObject(pkcs11.CKO_PRIVATE_KEY, label)
+	if err != nil {
+		return err
+	}
+	attrs, err := s.ctx.GetAttributeValue(s.session, priv, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to read the type of the PKCS#11 key %q: %v", label, err)
+	}
+	switch keyType := bytesToUint(attrs[0].Value); keyType {
+	case pkcs11.CKK_RSA:
+		// The modulus and the public exponent are attributes of the private key
+		attrs, err := s.ctx.GetAttributeValue(s.session, priv, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to read the public key of the PKCS#11 key %q: %v", label, err)
+		}
+		s.pub = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}
+	case pkcs11.CKK_EC:
+		// The EC point is only an attribute of the public key
+		pub, err := s.findObject(pkcs11.CKO_PUBLIC_KEY, label)
+		if err != nil {
+			return err
+		}
+		attrs, err := s.ctx.GetAttributeValue(s.session, pub, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to read the public key of the PKCS#11 key %q: %v", label, err)
+		}
+		if s.pub, err = parseECPublicKey(attrs[0].Value, attrs[1].Value); err != nil {
+			return fmt.Errorf("Failed to parse the public key of the PKCS#11 key %q: %v", label, err)
+		}
+	default:
+		return fmt.Errorf("Unsupported type %v of the PKCS#11 key %q", keyType, label)
+	}
+	s.key = priv
+	return nil
+}
+
+// findObject finds the only object of the class and the label.
+func (s *pkcs11Signer) findObject(class uint, label string) (pkcs11.ObjectHandle, error) {
+	if err := s.ctx.FindObjectsInit(s.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}); err != nil {
+		return 0, fmt.Errorf("Failed to find the PKCS#11 key %q: %v", label, err)
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 2)
+	if finalErr := s.ctx.FindObjectsFinal(s.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Failed to find the PKCS#11 key %q: %v", label, err)
+	}
+	if len(objs) != 1 {
+		return 0, fmt.Errorf("Found %v PKCS#11 objects of the class %v and the label %q, want 1", len(objs), class, label)
+	}
+	return objs[0], nil
+}
+
+// parseECPublicKey parses the DER encoded CKA_EC_PARAMS and CKA_EC_POINT.
+func parseECPublicKey(params, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("Invalid EC parameters: %v", err)
+	}
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(oidP256):
+		curve = elliptic.P256()
+	case oid.Equal(oidP384):
+		curve = elliptic.P384()
+	case oid.Equal(oidP521):
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("Unsupported elliptic curve %v", oid)
+	}
+	// The point is an uncompressed point in a DER OCTET STRING
+	var raw []byte
+	if _, err := asn1.Unmarshal(point, &raw); err != nil {
+		return nil, fmt.Errorf("Invalid EC point: %v", err)
+	}
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, fmt.Errorf("Invalid EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// bytesToUint decodes an attribute of CK_ULONG, in the byte order of the host.
+func bytesToUint(b []byte) uint {
+	var v uint
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint(b[i])
+	}
+	return v
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs the digest with CKM_RSA_PKCS or CKM_ECDSA. The ECDSA signature
+// is ASN.1 encoded, as the crypto.Signer of an ECDSA key returns.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism uint
+	data := digest
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, fmt.Errorf("PKCS#11 RSA keys only sign with PKCS #1 v1.5")
+		}
+		prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported hash %v", opts.HashFunc())
+		}
+		mechanism = pkcs11.CKM_RSA_PKCS
+		data = append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.CKM_ECDSA
+	}
+
+	s.m.Lock()
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, s.key)
+	var sig []byte
+	if err == nil {
+		sig, err = s.ctx.Sign(s.session, data)
+	}
+	s.m.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign with the PKCS#11 key: %v", err)
+	}
+
+	if mechanism == pkcs11.CKM_ECDSA {
+		// CKM_ECDSA returns r and s of the same length
+		n := len(sig) / 2
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])})
+	}
+	return sig, nil
+}
@@ -0,0 +1,15 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package signer_backend
+
+import (
+	"crypto"
+	"fmt"
+)
+
+// NewPKCS11Signer needs cgo and the PKCS#11 bindings, which are only built
+// with "go build -tags pkcs11".
+func NewPKCS11Signer(opts PKCS11Options) (crypto.Signer, error) {
+	return nil, fmt.Errorf("PKCS#11 is not supported, build with -tags pkcs11")
+}
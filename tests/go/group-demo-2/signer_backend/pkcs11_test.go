@@ -0,0 +1,113 @@
+//go:build pkcs11
+// +build pkcs11
+
+package signer_backend
+
+import (
+	"encoding/asn1"
+	"os"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// TestPKCS11Signer signs with the keys generated in a PKCS#11 token, e.g., of
+// SoftHSM:
+//
+//	softhsm2-util --init-token --free --label test-token --pin 1234 --so-pin 5678
+//	PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so PKCS11_TOKEN_LABEL=test-token PKCS11_PIN=1234 \
+//	  go test -tags pkcs11 ./signer_backend
+func TestPKCS11Signer(t *testing.T) {
+	opts := PKCS11Options{
+		Module:     os.Getenv("PKCS11_MODULE"),
+		TokenLabel: os.Getenv("PKCS11_TOKEN_LABEL"),
+		PIN:        os.Getenv("PKCS11_PIN"),
+	}
+	if len(opts.Module) == 0 || len(opts.TokenLabel) == 0 {
+		t.Skip("PKCS11_MODULE and PKCS11_TOKEN_LABEL of a PKCS#11 token are not set")
+	}
+	ctx := pkcs11.New(opts.Module)
+	if ctx == nil {
+		t.Fatalf("Failed to load the PKCS#11 module %v", opts.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize the PKCS#11 module: %v", err)
+	}
+	defer ctx.Destroy()
+	defer ctx.Finalize()
+	session := openSession(t, ctx, opts)
+	defer ctx.CloseSession(session)
+
+	p256, _ := asn1.Marshal(oidP256)
+	testCases := []struct {
+		name      string
+		mechanism uint
+		public    []*pkcs11.Attribute
+	}{
+		{
+			name:      "rsa",
+			mechanism: pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN,
+			public: []*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+				pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			},
+		},
+		{
+			name:      "ecdsa",
+			mechanism: pkcs11.CKM_EC_KEY_PAIR_GEN,
+			public: []*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, p256),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := opts
+			opts.KeyLabel = "signer-backend-test-" + tc.name
+			if s, err := newPKCS11Signer(ctx, opts); err == nil {
+				t.Fatalf("newPKCS11Signer() of a missing key = %+v, want an error", s)
+			}
+			label := pkcs11.NewAttribute(pkcs11.CKA_LABEL, opts.KeyLabel)
+			pub, priv, err := ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(tc.mechanism, nil)},
+				append(tc.public, label, pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true)),
+				[]*pkcs11.Attribute{label, pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+					pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true)})
+			if err != nil {
+				t.Fatalf("Failed to generate a key pair: %v", err)
+			}
+			defer ctx.DestroyObject(session, priv)
+			defer ctx.DestroyObject(session, pub)
+			s, err := newPKCS11Signer(ctx, opts)
+			if err != nil {
+				t.Fatalf("newPKCS11Signer() failed: %v", err)
+			}
+			defer ctx.CloseSession(s.session)
+			verifyJwt(t, s, "")
+		})
+	}
+}
+
+// openSession opens a read-write session of the token to generate the keys.
+// The signers share the login of the session.
+func openSession(t *testing.T, ctx *pkcs11.Ctx, opts PKCS11Options) pkcs11.SessionHandle {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		t.Fatalf("Failed to list the PKCS#11 slots: %v", err)
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != opts.TokenLabel {
+			continue
+		}
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			t.Fatalf("Failed to open a PKCS#11 session: %v", err)
+		}
+		if err := ctx.Login(session, pkcs11.CKU_USER, opts.PIN); err != nil {
+			t.Fatalf("Failed to log in to the PKCS#11 token: %v", err)
+		}
+		return session
+	}
+	t.Fatalf("No PKCS#11 token of the label %q", opts.TokenLabel)
+	return 0
+}
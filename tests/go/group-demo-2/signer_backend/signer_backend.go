@@ -0,0 +1,91 @@
+// Package signer_backend provides the backends of the keys that re-sign the
+// tokens as crypto.Signer, so that the private key may stay in a hardware
+// security module (NewPKCS11Signer) or in Vault (NewVaultSigner) instead of
+// the memory of the process. A local key file is loaded with
+// utils.LoadJSONWebPrivateKeyFromFile, whose key is a crypto.Signer too.
+package signer_backend
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/cryptosigner"
+)
+
+// NewJwtSigner creates a signer of JWTs with the key of s, e.g., of
+// NewPKCS11Signer() or NewVaultSigner(), for utils.CreateJwtWithOptions().
+// s: the signer of the private key
+// alg: the signature algorithm, or "" to infer it from the key
+// keyID: the key id, or "" for the RFC 7638 thumbprint of the key
+func NewJwtSigner(s crypto.Signer, alg jose.SignatureAlgorithm, keyID string) (jose.Signer, error) {
+	pub, err := PublicJSONWebKey(s, alg, keyID)
+	if err != nil {
+		return nil, err
+	}
+	opaque := &opaqueSigner{OpaqueSigner: cryptosigner.Opaque(s), pub: pub}
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	return jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(pub.Algorithm), Key: opaque}, opts)
+}
+
+// PublicJSONWebKey returns the public key of s to publish in a JWKS, with the
+// algorithm and the key id of NewJwtSigner().
+func PublicJSONWebKey(s crypto.Signer, alg jose.SignatureAlgorithm, keyID string) (*jose.JSONWebKey, error) {
+	pub := &jose.JSONWebKey{Key: s.Public(), KeyID: keyID, Use: "sig"}
+	inferred, err := utils.SignatureAlgorithm(pub.Key)
+	if err != nil {
+		return nil, err
+	}
+	if alg == "" {
+		alg = inferred
+	} else if !utils.AlgorithmMatchesKey(alg, inferred) {
+		return nil, fmt.Errorf("The %v key cannot sign with the algorithm %v", inferred, alg)
+	}
+	pub.Algorithm = string(alg)
+	if pub.KeyID == "" {
+		hash, err := pub.Thumbprint(crypto.SHA256)
+		if err != nil {
+			glog.Errorf("Failed to compute a SHA256 hash for the key: %v", err)
+			return nil, err
+		}
+		pub.KeyID = base64.RawURLEncoding.EncodeToString(hash)
+	}
+	return pub, nil
+}
+
+// opaqueSigner is the jose.OpaqueSigner of a crypto.Signer with the key id
+// and the algorithm of its public key.
+type opaqueSigner struct {
+	jose.OpaqueSigner
+	pub *jose.JSONWebKey
+}
+
+// Public returns the public key, whose key id is set in the JWS header.
+func (s *opaqueSigner) Public() *jose.JSONWebKey {
+	return s.pub
+}
+
+func (s *opaqueSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{jose.SignatureAlgorithm(s.pub.Algorithm)}
+}
+
+// PKCS11Options are the options of a signing key in a PKCS#11 token, e.g., of
+// a hardware security module or of SoftHSM. The key is an RSA or ECDSA key
+// pair of the same label, e.g., generated with:
+//
+//	pkcs11-tool --module $MODULE --login --pin $PIN --token-label $TOKEN \
+//	  --keypairgen --key-type EC:prime256v1 --label token-service
+type PKCS11Options struct {
+	// Module is the path to the PKCS#11 library, e.g.,
+	// /usr/lib/softhsm/libsofthsm2.so.
+	Module string
+	// TokenLabel is the label of the token of the key.
+	TokenLabel string
+	// PIN is the user PIN of the token.
+	PIN string
+	// KeyLabel is the label of the private key and of its public key.
+	KeyLabel string
+}
@@ -0,0 +1,275 @@
+package signer_backend
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	testVaultToken = "test-vault-token"
+	testKeyFile    = "../testdata/token_service_signing_key.pem"
+)
+
+var testClaims = map[string]json.RawMessage{
+	"sub":    json.RawMessage(`"test-user"`),
+	"groups": json.RawMessage(`["group1","group2"]`),
+}
+
+// fakeTransit is a Transit engine of Vault mounted at /v1/transit.
+type fakeTransit struct {
+	keys map[string]crypto.Signer
+}
+
+func (f *fakeTransit) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	writeError := func(code int, msg string) {
+		resp.WriteHeader(code)
+		fmt.Fprintf(resp, `{"errors":[%q]}`, msg)
+	}
+	if req.Header.Get("X-Vault-Token") != testVaultToken {
+		writeError(http.StatusForbidden, "permission denied")
+		return
+	}
+	var op, name string
+	if parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v1/transit/"), "/"); len(parts) == 2 {
+		op, name = parts[0], parts[1]
+	}
+	key, ok := f.keys[name]
+	if !ok {
+		writeError(http.StatusNotFound, "no such key")
+		return
+	}
+	switch {
+	case op == "keys" && req.Method == http.MethodGet:
+		var keyType, publicKey string
+		switch pub := key.Public().(type) {
+		case ed25519.PublicKey:
+			keyType = "ed25519"
+			publicKey = base64.StdEncoding.EncodeToString(pub)
+		default:
+			keyType = "ecdsa-p256"
+			if _, ok := pub.(*rsa.PublicKey); ok {
+				keyType = "rsa-2048"
+			}
+			der, _ := x509.MarshalPKIXPublicKey(pub)
+			publicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		}
+		// Version 1 was rotated to version 2
+		fmt.Fprintf(resp, `{"data":{"type":%q,"latest_version":2,"keys":{"1":{"public_key":"unused"},"2":{"public_key":%q}}}}`,
+			keyType, publicKey)
+	case op == "sign" && (req.Method == http.MethodPost || req.Method == http.MethodPut):
+		var in struct {
+			Input              []byte `json:"input"`
+			Prehashed          bool   `json:"prehashed"`
+			HashAlgorithm      string `json:"hash_algorithm"`
+			SignatureAlgorithm string `json:"signature_algorithm"`
+			KeyVersion         int    `json:"key_version"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&in); err != nil || in.KeyVersion != 2 {
+			writeError(http.StatusBadRequest, fmt.Sprintf("invalid request %+v: %v", in, err))
+			return
+		}
+		var opts crypto.SignerOpts = crypto.Hash(0)
+		if in.Prehashed {
+			hashes := map[string]crypto.Hash{"sha2-256": crypto.SHA256, "sha2-384": crypto.SHA384, "sha2-512": crypto.SHA512}
+			opts = hashes[in.HashAlgorithm]
+			if in.SignatureAlgorithm == "pss" {
+				opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: hashes[in.HashAlgorithm]}
+			}
+		}
+		sig, err := key.Sign(rand.Reader, in.Input, opts)
+		if err != nil {
+			writeError(http.StatusBadRequest, err.Error())
+			return
+		}
+		fmt.Fprintf(resp, `{"data":{"signature":"vault:v2:%v","key_version":2}}`, base64.StdEncoding.EncodeToString(sig))
+	default:
+		writeError(http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+func newFakeTransit(t *testing.T) *httptest.Server {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate an RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate an ECDSA key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate an Ed25519 key: %v", err)
+	}
+	return httptest.NewServer(&fakeTransit{keys: map[string]crypto.Signer{
+		"rsa":     rsaKey,
+		"ecdsa":   ecKey,
+		"ed25519": edKey,
+	}})
+}
+
+// verifyJwt signs the test claims with s and verifies the JWT with its
+// public key.
+func verifyJwt(t *testing.T, s crypto.Signer, alg jose.SignatureAlgorithm) {
+	signer, err := NewJwtSigner(s, alg, "")
+	if err != nil {
+		t.Fatalf("NewJwtSigner() failed: %v", err)
+	}
+	pub, err := PublicJSONWebKey(s, alg, "")
+	if err != nil {
+		t.Fatalf("PublicJSONWebKey() failed: %v", err)
+	}
+	claims := map[string]json.RawMessage{}
+	for name, v := range testClaims {
+		claims[name] = v
+	}
+	jwt, err := utils.CreateJwtWithOptions(signer, claims, utils.JwtOptions{Issuer: "token-service"})
+	if err != nil {
+		t.Fatalf("CreateJwtWithOptions() failed: %v", err)
+	}
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		t.Fatalf("Failed to parse the JWT: %v", err)
+	}
+	header := jws.Signatures[0].Protected
+	if header.KeyID != pub.KeyID || header.Algorithm != pub.Algorithm || header.ExtraHeaders["typ"] != "JWT" {
+		t.Errorf("JWT header = %+v, want the kid %v, the alg %v and the typ JWT", header, pub.KeyID, pub.Algorithm)
+	}
+	payload, err := jws.Verify(pub)
+	if err != nil {
+		t.Fatalf("Failed to verify the JWT: %v", err)
+	}
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &got); err != nil || !bytes.Equal(got["groups"], testClaims["groups"]) {
+		t.Errorf("JWT claims = %s, %v, want the groups %s", payload, err, testClaims["groups"])
+	}
+}
+
+func TestNewJwtSignerFileKey(t *testing.T) {
+	key, err := utils.LoadJSONWebPrivateKeyFromFile(testKeyFile, "")
+	if err != nil {
+		t.Fatalf("Failed to load the key: %v", err)
+	}
+	s := key.Key.(crypto.Signer)
+	// The key id is the same thumbprint as of the key file
+	pub, err := PublicJSONWebKey(s, "", "")
+	if err != nil || pub.KeyID != key.KeyID || pub.Algorithm != "RS256" || !pub.IsPublic() {
+		t.Errorf("PublicJSONWebKey() = %+v, %v, want the public RS256 key of the key id %v", pub, err, key.KeyID)
+	}
+	if pub, err := PublicJSONWebKey(s, "", "test-key"); err != nil || pub.KeyID != "test-key" {
+		t.Errorf("PublicJSONWebKey() = %+v, %v, want the key id test-key", pub, err)
+	}
+	if _, err := NewJwtSigner(s, jose.ES256, ""); err == nil {
+		t.Errorf("NewJwtSigner() of an RSA key for ES256 succeeded, want an error")
+	}
+	verifyJwt(t, s, "")
+	verifyJwt(t, s, jose.PS256)
+}
+
+func TestVaultSigner(t *testing.T) {
+	server := newFakeTransit(t)
+	defer server.Close()
+	testCases := []struct {
+		key string
+		alg jose.SignatureAlgorithm
+	}{
+		{key: "rsa", alg: jose.RS256},
+		{key: "rsa", alg: jose.PS384},
+		{key: "ecdsa", alg: jose.ES256},
+		{key: "ed25519", alg: jose.EdDSA},
+	}
+	for _, tc := range testCases {
+		t.Run(string(tc.alg), func(t *testing.T) {
+			s, err := NewVaultSigner(VaultOptions{Address: server.URL, Token: testVaultToken, Key: tc.key})
+			if err != nil {
+				t.Fatalf("NewVaultSigner() failed: %v", err)
+			}
+			verifyJwt(t, s, tc.alg)
+		})
+	}
+}
+
+func TestVaultSignerErrors(t *testing.T) {
+	server := newFakeTransit(t)
+	defer server.Close()
+	testCases := []struct {
+		name string
+		opts VaultOptions
+	}{
+		{
+			name: "no key",
+			opts: VaultOptions{Address: server.URL, Token: testVaultToken},
+		},
+		{
+			name: "unknown key",
+			opts: VaultOptions{Address: server.URL, Token: testVaultToken, Key: "unknown"},
+		},
+		{
+			name: "invalid token",
+			opts: VaultOptions{Address: server.URL, Token: "invalid", Key: "rsa"},
+		},
+		{
+			name: "unknown mount",
+			opts: VaultOptions{Address: server.URL, Token: testVaultToken, Mount: "pki", Key: "rsa"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewVaultSigner(tc.opts); err == nil {
+				t.Errorf("NewVaultSigner() succeeded, want an error")
+			}
+		})
+	}
+}
+
+// TestVaultSignerDevServer signs with the Transit engine of a Vault server,
+// e.g., started with:
+//
+//	vault server -dev -dev-root-token-id=myroot
+//	VAULT_ADDR=http://127.0.0.1:8200 VAULT_TOKEN=myroot go test ./signer_backend
+func TestVaultSignerDevServer(t *testing.T) {
+	if len(os.Getenv("VAULT_ADDR")) == 0 || len(os.Getenv("VAULT_TOKEN")) == 0 {
+		t.Skip("VAULT_ADDR and VAULT_TOKEN of a Vault server are not set")
+	}
+	client, err := newVaultClient(VaultOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create the Vault client: %v", err)
+	}
+	// The Transit engine may be mounted already
+	if err := client.Sys().Mount(defaultTransitMount, &api.MountInput{Type: "transit"}); err != nil &&
+		!strings.Contains(err.Error(), "path is already in use") {
+		t.Fatalf("Failed to mount the Transit engine: %v", err)
+	}
+	for _, keyType := range []string{"rsa-2048", "ecdsa-p256", "ed25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			key := "signer-backend-test-" + keyType
+			_, err := client.Logical().Write(defaultTransitMount+"/keys/"+key, map[string]interface{}{"type": keyType})
+			if err != nil {
+				t.Fatalf("Failed to create the Transit key: %v", err)
+			}
+			signer, err := NewVaultSigner(VaultOptions{Key: key})
+			if err != nil {
+				t.Fatalf("NewVaultSigner() failed: %v", err)
+			}
+			verifyJwt(t, signer, "")
+		})
+	}
+}
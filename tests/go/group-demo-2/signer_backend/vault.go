@@ -0,0 +1,214 @@
+package signer_backend
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/vault/api"
+)
+
+const defaultTransitMount = "transit"
+
+// vaultHashAlgorithms are the Transit names of the hashes of the digests.
+var vaultHashAlgorithms = map[crypto.Hash]string{
+	crypto.SHA256: "sha2-256",
+	crypto.SHA384: "sha2-384",
+	crypto.SHA512: "sha2-512",
+}
+
+// VaultOptions are the options of a signing key in the Transit secrets engine
+// of Vault. The Transit engine signs with the key, which never leaves Vault.
+type VaultOptions struct {
+	// Address is the address of the Vault server, e.g.,
+	// "http://127.0.0.1:8200". The default is $VAULT_ADDR, as for the Vault
+	// CLI, or else "https://127.0.0.1:8200".
+	Address string
+	// Token authenticates to Vault. The default is $VAULT_TOKEN.
+	Token string
+	// CAFile is the path to the root CA certificate of the Vault server. The
+	// default is $VAULT_CACERT, or else the host's root CA set.
+	CAFile string
+	// Mount is the mount path of the Transit engine. The default is "transit".
+	Mount string
+	// Key is the name of the Transit key: an RSA, ECDSA or Ed25519 key, e.g.,
+	// created with "vault write transit/keys/token-service type=ecdsa-p256".
+	Key string
+}
+
+// vaultSigner signs with the latest version of a Transit key when it was
+// created, so that the signatures always match its public key. A new version
+// of the key is used after a restart.
+type vaultSigner struct {
+	client  *api.Client
+	mount   string
+	key     string
+	version int
+	pub     crypto.PublicKey
+}
+
+// vaultKey is the response of reading a Transit key.
+type vaultKey struct {
+	Type          string                     `json:"type"`
+	LatestVersion int                        `json:"latest_version"`
+	Keys          map[string]json.RawMessage `json:"keys"`
+}
+
+// NewVaultSigner creates a signer with a key in the Transit engine of Vault.
+func NewVaultSigner(opts VaultOptions) (crypto.Signer, error) {
+	if len(opts.Key) == 0 {
+		return nil, fmt.Errorf("Must specify the Transit key of Vault")
+	}
+	client, err := newVaultClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &vaultSigner{
+		client: client,
+		mount:  opts.Mount,
+		key:    opts.Key,
+	}
+	if len(s.mount) == 0 {
+		s.mount = defaultTransitMount
+	}
+	s.mount = strings.Trim(s.mount, "/")
+
+	secret, err := s.client.Logical().Read(s.mount + "/keys/" + s.key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the Transit key %v: %v", s.key, err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("The Transit key %v is not found in %v", s.key, s.mount)
+	}
+	var key vaultKey
+	if err := decodeSecretData(secret, &key); err != nil {
+		return nil, fmt.Errorf("Failed to decode the Transit key %v: %v", s.key, err)
+	}
+	var version struct {
+		PublicKey string `json:"public_key"`
+	}
+	raw, ok := key.Keys[strconv.Itoa(key.LatestVersion)]
+	if !ok || json.Unmarshal(raw, &version) != nil || len(version.PublicKey) == 0 {
+		return nil, fmt.Errorf("The Transit key %v of type %v has no public key", s.key, key.Type)
+	}
+	pub, err := parseVaultPublicKey(key.Type, version.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the public key of the Transit key %v: %v", s.key, err)
+	}
+	s.version = key.LatestVersion
+	s.pub = pub
+	glog.Infof("Signing with version %v of the Transit key %v at %v", s.version, s.key, s.client.Address())
+	return s, nil
+}
+
+// newVaultClient creates a client of the Vault server. The address, the token
+// and the CA file that are not in opts are read from the environment
+// variables of the Vault CLI.
+func newVaultClient(opts VaultOptions) (*api.Client, error) {
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return nil, fmt.Errorf("Failed to read the Vault configuration: %v", config.Error)
+	}
+	if len(opts.Address) > 0 {
+		config.Address = opts.Address
+	}
+	if len(opts.CAFile) > 0 {
+		if err := config.ConfigureTLS(&api.TLSConfig{CACert: opts.CAFile}); err != nil {
+			return nil, fmt.Errorf("Failed to read the CA file of Vault: %v", err)
+		}
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the Vault client: %v", err)
+	}
+	if len(opts.Token) > 0 {
+		client.SetToken(opts.Token)
+	}
+	return client, nil
+}
+
+// decodeSecretData decodes the data of a Vault response into out.
+func decodeSecretData(secret *api.Secret, out interface{}) error {
+	b, err := json.Marshal(secret.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// parseVaultPublicKey parses the public key of a Transit key, which is base64
+// encoded for Ed25519 and PEM encoded for the other keys.
+func parseVaultPublicKey(keyType, publicKey string) (crypto.PublicKey, error) {
+	if keyType == "ed25519" {
+		b, err := base64.StdEncoding.DecodeString(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 public key of %v bytes", len(b))
+		}
+		return ed25519.PublicKey(b), nil
+	}
+	p, _ := pem.Decode([]byte(publicKey))
+	if p == nil {
+		return nil, fmt.Errorf("Failed to decode the PEM public key")
+	}
+	return x509.ParsePKIXPublicKey(p.Bytes)
+}
+
+func (s *vaultSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs the digest with the Transit key. An Ed25519 key signs the
+// message itself.
+func (s *vaultSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(digest),
+		"key_version": s.version,
+	}
+	if _, ok := s.pub.(ed25519.PublicKey); ok {
+		if opts.HashFunc() != crypto.Hash(0) {
+			return nil, fmt.Errorf("An Ed25519 key signs the message, not a digest")
+		}
+	} else {
+		hash, ok := vaultHashAlgorithms[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported hash %v", opts.HashFunc())
+		}
+		req["prehashed"] = true
+		req["hash_algorithm"] = hash
+		if _, ok := s.pub.(*rsa.PublicKey); ok {
+			// Transit signs with PSS by default
+			req["signature_algorithm"] = "pkcs1v15"
+			if _, ok := opts.(*rsa.PSSOptions); ok {
+				req["signature_algorithm"] = "pss"
+			}
+		}
+	}
+	secret, err := s.client.Logical().Write(s.mount+"/sign/"+s.key, req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign with the Transit key %v: %v", s.key, err)
+	}
+	var resp struct {
+		Signature string `json:"signature"`
+	}
+	if secret == nil || decodeSecretData(secret, &resp) != nil {
+		return nil, fmt.Errorf("The Transit key %v returned no signature", s.key)
+	}
+	// The signature is of the form vault:v<version>:<base64 signature>
+	parts := strings.SplitN(resp.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("Invalid signature of the Transit key %v: %q", s.key, resp.Signature)
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
@@ -16,12 +16,14 @@
 
 rm *.pem
 
+# -m PEM writes PKCS#1 and SEC1 keys, which utils.LoadJSONWebPrivateKeyFromFile
+# parses, instead of the OpenSSH format.
 for N in `seq 1 3`; do
-    ssh-keygen -t rsa -b 2048 -f rsa_$N.pem -N ''
+    ssh-keygen -t rsa -b 2048 -m PEM -f rsa_$N.pem -N ''
 done
 
 for N in `seq 1 3`; do
-    ssh-keygen -t ecdsa -b 521 -f ecdsa_$N.pem -N ''
+    ssh-keygen -t ecdsa -b 521 -m PEM -f ecdsa_$N.pem -N ''
 done
 
 rm *.pub
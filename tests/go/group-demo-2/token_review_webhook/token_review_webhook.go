@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	oidc "github.com/lei-tang/dev/tests/go/group-demo-2/oidc_library"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+)
+
+const (
+	// tokenReviewPath is the path of the TokenReview API.
+	tokenReviewPath = "/authenticate"
+	// readyzPath is the path of the readiness check.
+	readyzPath = "/readyz"
+	// maxTokenReviewBytes bounds the size of a TokenReview request.
+	maxTokenReviewBytes = 1 << 20
+)
+
+// tokenReviewServer serves the authentication.k8s.io/v1 TokenReview API of a
+// token authentication webhook, e.g., for the
+// --authentication-token-webhook-config-file of kube-apiserver.
+type tokenReviewServer struct {
+	authenticator authenticator.Token
+}
+
+// newTokenReviewHandler returns the handler of the TokenReview API and of the
+// readiness check of a.
+func newTokenReviewHandler(a *oidc.Authenticator, opts oidc.TokenAdapterOptions) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(tokenReviewPath, &tokenReviewServer{authenticator: oidc.NewTokenAdapter(a, opts)})
+	mux.Handle(readyzPath, oidc.NewReadyzHandler(a))
+	return mux
+}
+
+func (s *tokenReviewServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(resp, fmt.Sprintf("method %v is not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	var review authenticationv1.TokenReview
+	if err := json.NewDecoder(http.MaxBytesReader(resp, req.Body, maxTokenReviewBytes)).Decode(&review); err != nil {
+		http.Error(resp, fmt.Sprintf("failed to decode the TokenReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	if review.APIVersion != authenticationv1.SchemeGroupVersion.String() || review.Kind != "TokenReview" {
+		http.Error(resp, fmt.Sprintf("unsupported object %v %v, want %v TokenReview",
+			review.APIVersion, review.Kind, authenticationv1.SchemeGroupVersion), http.StatusBadRequest)
+		return
+	}
+
+	status := s.review(req.Context(), review.Spec)
+	glog.V(5).Infof("TokenReview status: %+v", status)
+	out := authenticationv1.TokenReview{
+		TypeMeta: review.TypeMeta,
+		Status:   status,
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(&out); err != nil {
+		glog.Errorf("Failed to encode the TokenReview: %v", err)
+	}
+}
+
+// review authenticates the token of a TokenReview. A token that fails the
+// authentication is reported in the status rather than as an HTTP error.
+func (s *tokenReviewServer) review(ctx context.Context, spec authenticationv1.TokenReviewSpec) authenticationv1.TokenReviewStatus {
+	if spec.Token == "" {
+		return authenticationv1.TokenReviewStatus{Error: "no token"}
+	}
+	if len(spec.Audiences) > 0 {
+		ctx = authenticator.WithAudiences(ctx, spec.Audiences)
+	}
+	r, ok, err := s.authenticator.AuthenticateToken(ctx, spec.Token)
+	if err != nil {
+		glog.V(4).Infof("Failed to authenticate the token: %v", err)
+		return authenticationv1.TokenReviewStatus{Error: err.Error()}
+	}
+	if !ok {
+		return authenticationv1.TokenReviewStatus{}
+	}
+
+	var extra map[string]authenticationv1.ExtraValue
+	if e := r.User.GetExtra(); len(e) > 0 {
+		extra = map[string]authenticationv1.ExtraValue{}
+		for k, v := range e {
+			extra[k] = authenticationv1.ExtraValue(v)
+		}
+	}
+	return authenticationv1.TokenReviewStatus{
+		Authenticated: true,
+		User: authenticationv1.UserInfo{
+			Username: r.User.GetName(),
+			UID:      r.User.GetUID(),
+			Groups:   r.User.GetGroups(),
+			Extra:    extra,
+		},
+		Audiences: r.Audiences,
+	}
+}
+
+func main() {
+	var listenAddress string
+	var tlsCertFile string
+	var tlsKeyFile string
+	var issuerURL string
+	var clientID string
+	var caFile string
+	var usernameClaim string
+	var groupsClaim string
+	var groupsPrefix string
+	var distributedClaims string
+	var extraPrefix string
+	flag.StringVar(&listenAddress, "listen-address", ":8443", "the address to serve the TokenReview API on")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "path to the TLS certificate of the webhook")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "path to the TLS private key of the webhook")
+	flag.StringVar(&issuerURL, "issuer-url", "", "the URL of the issuer of the tokens")
+	flag.StringVar(&clientID, "client-id", "test-client-id", "the client id the tokens must be issued for")
+	flag.StringVar(&caFile, "ca-file", "", "path to the root CA certificate of the issuer")
+	flag.StringVar(&usernameClaim, "username-claim", "username", "the claim to use as the user name")
+	flag.StringVar(&groupsClaim, "groups-claim", "groups", "the claim to use as the groups, resolved if distributed")
+	flag.StringVar(&groupsPrefix, "groups-prefix", "", "the prefix added to the groups")
+	flag.StringVar(&distributedClaims, "distributed-claims", "",
+		"comma-separated names of the other distributed claims to resolve, or \"*\" for all distributed claims")
+	flag.StringVar(&extraPrefix, "extra-prefix", "",
+		"the prefix of the claim names in the extra of the user, e.g., oidc.example.com/")
+	flag.Parse()
+	if len(issuerURL) == 0 {
+		glog.Fatalf("Must specify the issuer URL --issuer-url.")
+	}
+	if len(tlsCertFile) == 0 || len(tlsKeyFile) == 0 {
+		glog.Fatalf("Must specify the TLS certificate and key --tls-cert-file and --tls-key-file.")
+	}
+
+	var claims []string
+	if len(distributedClaims) > 0 {
+		claims = strings.Split(distributedClaims, ",")
+	}
+	a, err := oidc.NewAuthenticatorWithIssuerURL(oidc.Options{
+		IssuerURL:            issuerURL,
+		ClientID:             clientID,
+		CAFile:               caFile,
+		UsernameClaim:        usernameClaim,
+		GroupsClaim:          groupsClaim,
+		GroupsPrefix:         groupsPrefix,
+		DistributedClaims:    claims,
+		SupportedSigningAlgs: utils.SigningAlgs,
+		VerifierWaitTimeout:  10 * time.Second,
+	})
+	if err != nil {
+		glog.Fatalf("Failed to create an oidc authenticator: %v", err)
+	}
+	defer a.Close()
+
+	handler := newTokenReviewHandler(a, oidc.TokenAdapterOptions{ExtraPrefix: extraPrefix})
+	glog.Infof("Serving the TokenReview API at https://%v%v", listenAddress, tokenReviewPath)
+	if err := http.ListenAndServeTLS(listenAddress, tlsCertFile, tlsKeyFile, handler); err != nil {
+		glog.Fatalf("Failed to serve the TokenReview API: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	oidc "github.com/lei-tang/dev/tests/go/group-demo-2/oidc_library"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils/test_idp"
+	"gopkg.in/square/go-jose.v2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// postTokenReview posts a TokenReview of token to the webhook.
+func postTokenReview(t *testing.T, webhook *httptest.Server, review *authenticationv1.TokenReview) (*authenticationv1.TokenReview, int) {
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("Failed to marshal the TokenReview: %v", err)
+	}
+	resp, err := webhook.Client().Post(webhook.URL+tokenReviewPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post the TokenReview: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+	var out authenticationv1.TokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("Failed to decode the TokenReview: %v", err)
+	}
+	return &out, resp.StatusCode
+}
+
+func newTokenReview(token string, audiences ...string) *authenticationv1.TokenReview {
+	return &authenticationv1.TokenReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"},
+		Spec:     authenticationv1.TokenReviewSpec{Token: token, Audiences: audiences},
+	}
+}
+
+func TestTokenReview(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	a, err := oidc.NewAuthenticatorWithIssuerURL(oidc.Options{
+		IssuerURL:           idp.Server.URL,
+		ClientID:            test_idp.ClientID,
+		CAFile:              idp.CAFile,
+		UsernameClaim:       "username",
+		GroupsClaim:         "groups",
+		GroupsPrefix:        "oidc:",
+		VerifierWaitTimeout: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator: %v", err)
+	}
+	defer a.Close()
+	webhook := httptest.NewTLSServer(newTokenReviewHandler(a, oidc.TokenAdapterOptions{
+		ExtraClaims: []string{"groups"},
+		ExtraPrefix: "oidc.example.com/",
+	}))
+	defer webhook.Close()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	untrustedSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: priv}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	token := idp.Sign(t, idp.Signer, idp.Server.URL, test_idp.DistributedClaims)
+
+	testCases := []struct {
+		name       string
+		review     *authenticationv1.TokenReview
+		wantStatus authenticationv1.TokenReviewStatus
+		wantErr    bool
+	}{
+		{
+			name:   "distributed groups",
+			review: newTokenReview(token),
+			wantStatus: authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				User: authenticationv1.UserInfo{
+					Username: "test-user-name",
+					Groups:   []string{"oidc:group1", "oidc:group2"},
+					Extra: map[string]authenticationv1.ExtraValue{
+						"oidc.example.com/groups": {"group1", "group2"},
+					},
+				},
+				Audiences: []string{test_idp.ClientID},
+			},
+		},
+		{
+			name:   "matching audiences",
+			review: newTokenReview(token, "api", test_idp.ClientID),
+			wantStatus: authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				User: authenticationv1.UserInfo{
+					Username: "test-user-name",
+					Groups:   []string{"oidc:group1", "oidc:group2"},
+					Extra: map[string]authenticationv1.ExtraValue{
+						"oidc.example.com/groups": {"group1", "group2"},
+					},
+				},
+				Audiences: []string{test_idp.ClientID},
+			},
+		},
+		{
+			name:   "other audiences",
+			review: newTokenReview(token, "api"),
+		},
+		{
+			name:    "bad signature",
+			review:  newTokenReview(idp.Sign(t, untrustedSigner, idp.Server.URL, test_idp.DistributedClaims)),
+			wantErr: true,
+		},
+		{
+			name:    "no token",
+			review:  newTokenReview(""),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, code := postTokenReview(t, webhook, tc.review)
+			if code != http.StatusOK {
+				t.Fatalf("TokenReview status code = %v, want %v", code, http.StatusOK)
+			}
+			if out.APIVersion != "authentication.k8s.io/v1" || out.Kind != "TokenReview" {
+				t.Errorf("TokenReview type = %v %v, want authentication.k8s.io/v1 TokenReview", out.APIVersion, out.Kind)
+			}
+			if tc.wantErr {
+				if out.Status.Authenticated || out.Status.Error == "" {
+					t.Errorf("TokenReview status = %+v, want an error", out.Status)
+				}
+				return
+			}
+			if !reflect.DeepEqual(out.Status, tc.wantStatus) {
+				t.Errorf("TokenReview status = %+v, want %+v", out.Status, tc.wantStatus)
+			}
+		})
+	}
+
+	review := newTokenReview(token)
+	review.APIVersion = "authentication.k8s.io/v1beta1"
+	if _, code := postTokenReview(t, webhook, review); code != http.StatusBadRequest {
+		t.Errorf("TokenReview of another version status code = %v, want %v", code, http.StatusBadRequest)
+	}
+	resp, err := webhook.Client().Get(webhook.URL + tokenReviewPath)
+	if err != nil {
+		t.Fatalf("Failed to get the TokenReview API: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status code = %v, want %v", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	resp, err = webhook.Client().Get(webhook.URL + readyzPath)
+	if err != nil {
+		t.Fatalf("Failed to get the readiness check: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("readyz status code = %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+}
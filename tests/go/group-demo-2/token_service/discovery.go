@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lei-tang/dev/tests/go/group-demo-2/signer_backend"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// discoveryPath and jwksPath are the paths of the OIDC discovery document
+	// and of the JWKS of the token service.
+	discoveryPath = "/.well-known/openid-configuration"
+	jwksPath      = "/jwks"
+
+	// keysMaxAge is the max-age of the discovery document and of the JWKS, so
+	// that verifiers pick up new keys within minutes.
+	keysMaxAge = "max-age=300"
+)
+
+// discoveryDocument is the OIDC discovery document of the token service.
+type discoveryDocument struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	GrantTypesSupported              []string `json:"grant_types_supported"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// serveDiscovery serves the OIDC discovery document, so that verifiers can
+// find the JWKS of the token service from its issuer.
+func (s *tokenService) serveDiscovery(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp.Header().Set("Allow", "GET, HEAD")
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	base := s.baseURL(req)
+	algs := map[string]bool{}
+	var signingAlgs []string
+	for _, key := range s.keys.PublicKeys().Keys {
+		if !algs[key.Algorithm] {
+			algs[key.Algorithm] = true
+			signingAlgs = append(signingAlgs, key.Algorithm)
+		}
+	}
+	resp.Header().Set("Cache-Control", keysMaxAge)
+	writeJSON(resp, http.StatusOK, &discoveryDocument{
+		Issuer:                           s.jwtOptions.Issuer,
+		JWKSURI:                          base + jwksPath,
+		TokenEndpoint:                    base + tokenPath,
+		GrantTypesSupported:              []string{tokenExchangeGrantType},
+		ResponseTypesSupported:           []string{"id_token"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: signingAlgs,
+	})
+}
+
+// serveJWKS serves the public keys of the signing keys.
+func (s *tokenService) serveJWKS(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp.Header().Set("Allow", "GET, HEAD")
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Cache-Control", keysMaxAge)
+	jwks := s.keys.PublicKeys()
+	writeJSON(resp, http.StatusOK, &jwks)
+}
+
+// baseURL returns the URL the endpoints of the token service are published
+// under: the issuer if it is a URL, as required by OIDC discovery, or else the
+// URL the request was sent to.
+func (s *tokenService) baseURL(req *http.Request) string {
+	issuer := s.jwtOptions.Issuer
+	if u, err := url.Parse(issuer); err == nil && u.Scheme == "https" && u.Host != "" {
+		return strings.TrimSuffix(issuer, "/")
+	}
+	scheme := "https"
+	if req.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + req.Host
+}
+
+// signingKeys signs the tokens of the token service and returns the public
+// keys to publish. It is implemented by key_manager.KeyManager.
+type signingKeys interface {
+	jose.Signer
+	PublicKeys() jose.JSONWebKeySet
+}
+
+// staticKeys are signing keys that are not rotated.
+type staticKeys struct {
+	jose.Signer
+	jwks jose.JSONWebKeySet
+}
+
+func (k *staticKeys) PublicKeys() jose.JSONWebKeySet {
+	return k.jwks
+}
+
+// loadStaticKeys loads the keys in files. The first key signs and all the
+// keys are published, e.g., the key that signed the tokens before a key
+// rollover. The key ids are the RFC 7638 thumbprints of the keys.
+func loadStaticKeys(files []string) (*staticKeys, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no signing key")
+	}
+	k := &staticKeys{}
+	var signingKey *jose.JSONWebKey
+	for _, f := range files {
+		privKey, err := utils.LoadJSONWebPrivateKeyFromFile(f, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the signing key %v: %v", f, err)
+		}
+		if signingKey == nil {
+			signingKey = privKey
+		}
+		pub := privKey.Public()
+		pub.Use = "sig"
+		k.jwks.Keys = append(k.jwks.Keys, pub)
+	}
+	signer, err := utils.NewJwtSigner(signingKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a signer: %v", err)
+	}
+	k.Signer = signer
+	return k, nil
+}
+
+// newBackendKeys creates the signing keys of a signer backend, whose key may
+// never leave the backend, e.g., a PKCS#11 token or Vault. The key id is the
+// RFC 7638 thumbprint of the public key.
+func newBackendKeys(backend crypto.Signer) (*staticKeys, error) {
+	pub, err := signer_backend.PublicJSONWebKey(backend, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the public key of the signer: %v", err)
+	}
+	signer, err := signer_backend.NewJwtSigner(backend, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a signer: %v", err)
+	}
+	return &staticKeys{Signer: signer, jwks: jose.JSONWebKeySet{Keys: []jose.JSONWebKey{*pub}}}, nil
+}
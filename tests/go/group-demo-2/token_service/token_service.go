@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/claim_policy"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/key_manager"
+	oidc "github.com/lei-tang/dev/tests/go/group-demo-2/oidc_library"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/signer_backend"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"gopkg.in/square/go-jose.v2"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// tokenPath is the path of the token endpoint.
+	tokenPath = "/token"
+	// readyzPath is the path of the readiness check.
+	readyzPath = "/readyz"
+
+	// The grant type and the token types of RFC 8693.
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	jwtTokenType           = "urn:ietf:params:oauth:token-type:jwt"
+	idTokenType            = "urn:ietf:params:oauth:token-type:id_token"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+
+	// maxTokenRequestBytes bounds the size of a token request.
+	maxTokenRequestBytes = 1 << 20
+)
+
+// The error codes of RFC 6749, section 5.2.
+const (
+	errInvalidRequest         = "invalid_request"
+	errUnsupportedGrantType   = "unsupported_grant_type"
+	errServerError            = "server_error"
+	errTemporarilyUnavailable = "temporarily_unavailable"
+)
+
+// tokenResponse is the successful response of the token endpoint.
+type tokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in,omitempty"`
+}
+
+// errorResponse is the error response of the token endpoint.
+type errorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// tokenService is the "token-service" issuer. It exchanges a token with
+// distributed claims for a token of the resolved claims that it signs, and
+// publishes its signing keys for the verifiers of the tokens.
+type tokenService struct {
+	// resolver resolves the distributed claims with the authenticators of
+	// the trusted issuers.
+	resolver *utils.DistributedClaimsResolver
+	// jwtOptions are the issuer, audience and lifetime of the issued tokens.
+	jwtOptions utils.JwtOptions
+	// policy filters and transforms the claims of the issued tokens.
+	policy *claim_policy.Policy
+	keys   signingKeys
+	now    func() time.Time
+}
+
+// newTokenService creates a tokenService that signs the resolved tokens with
+// keys.
+func newTokenService(clientID string, distributedClaims []string, groupsClaim, usernameClaim string,
+	trustedIssuers utils.TrustedIssuers, jwtOptions utils.JwtOptions, policy *claim_policy.Policy,
+	keys signingKeys) *tokenService {
+	return &tokenService{
+		resolver: utils.NewDistributedClaimsResolver(utils.ResolverOptions{
+			ClientID:          clientID,
+			DistributedClaims: distributedClaims,
+			GroupsClaim:       groupsClaim,
+			UsernameClaim:     usernameClaim,
+			TrustedIssuers:    trustedIssuers,
+		}),
+		jwtOptions: jwtOptions,
+		policy:     policy,
+		keys:       keys,
+		now:        time.Now,
+	}
+}
+
+// handler returns the handler of the endpoints of the token service.
+func (s *tokenService) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(tokenPath, s.serveToken)
+	mux.HandleFunc(discoveryPath, s.serveDiscovery)
+	mux.HandleFunc(jwksPath, s.serveJWKS)
+	mux.Handle(readyzPath, oidc.NewReadyzHandler(s.resolver))
+	return mux
+}
+
+// serveToken serves the token exchange of RFC 8693. The subject token is
+// resolved and re-signed; the other parameters of the exchange, e.g.,
+// "audience", are not supported.
+func (s *tokenService) serveToken(resp http.ResponseWriter, req *http.Request) {
+	// RFC 6749, section 5.1: the responses of the token endpoint must not
+	// be cached.
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Header().Set("Pragma", "no-cache")
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		writeError(resp, http.StatusMethodNotAllowed, errInvalidRequest,
+			fmt.Sprintf("method %v is not allowed", req.Method))
+		return
+	}
+	req.Body = http.MaxBytesReader(resp, req.Body, maxTokenRequestBytes)
+	if err := req.ParseForm(); err != nil {
+		writeError(resp, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("failed to parse the request: %v", err))
+		return
+	}
+	if grantType := req.PostForm.Get("grant_type"); grantType != tokenExchangeGrantType {
+		writeError(resp, http.StatusBadRequest, errUnsupportedGrantType,
+			fmt.Sprintf("grant_type %q is not supported, want %q", grantType, tokenExchangeGrantType))
+		return
+	}
+	subjectToken := req.PostForm.Get("subject_token")
+	if subjectToken == "" {
+		writeError(resp, http.StatusBadRequest, errInvalidRequest, "missing subject_token")
+		return
+	}
+	switch t := req.PostForm.Get("subject_token_type"); t {
+	case jwtTokenType, idTokenType, accessTokenType:
+	case "":
+		writeError(resp, http.StatusBadRequest, errInvalidRequest, "missing subject_token_type")
+		return
+	default:
+		writeError(resp, http.StatusBadRequest, errInvalidRequest,
+			fmt.Sprintf("subject_token_type %q is not supported", t))
+		return
+	}
+	if t := req.PostForm.Get("requested_token_type"); t != "" && t != jwtTokenType {
+		writeError(resp, http.StatusBadRequest, errInvalidRequest,
+			fmt.Sprintf("requested_token_type %q is not supported, want %q", t, jwtTokenType))
+		return
+	}
+
+	_, claims, err := s.resolver.Resolve(req.Context(), subjectToken)
+	if err != nil {
+		glog.V(4).Infof("Failed to resolve the subject token: %v", err)
+		if errors.Is(err, oidc.ErrVerifierNotReady) || errors.Is(err, oidc.ErrKeysUnavailable) ||
+			errors.Is(err, oidc.ErrClaimSourceUnavailable) {
+			writeError(resp, http.StatusServiceUnavailable, errTemporarilyUnavailable, err.Error())
+			return
+		}
+		writeError(resp, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+	claims, err = s.policy.Apply(claims)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, errInvalidRequest, err.Error())
+		return
+	}
+	opts := s.jwtOptions
+	opts.Now = s.now
+	token, err := utils.CreateJwtWithOptions(s.keys, claims, opts)
+	if err != nil {
+		glog.Errorf("Failed to create a JWT with the resolved claims: %v", err)
+		writeError(resp, http.StatusInternalServerError, errServerError, "failed to sign the resolved token")
+		return
+	}
+
+	out := tokenResponse{
+		AccessToken:     token,
+		IssuedTokenType: jwtTokenType,
+		TokenType:       "Bearer",
+	}
+	// The issued token expires with the subject token, unless its lifetime
+	// is capped.
+	var exp float64
+	if err := json.Unmarshal(claims["exp"], &exp); err == nil {
+		if expiresIn := int64(exp) - s.now().Unix(); expiresIn > 0 {
+			out.ExpiresIn = expiresIn
+		}
+	}
+	writeJSON(resp, http.StatusOK, &out)
+}
+
+func writeError(resp http.ResponseWriter, code int, errCode, description string) {
+	writeJSON(resp, code, &errorResponse{Error: errCode, ErrorDescription: description})
+}
+
+func writeJSON(resp http.ResponseWriter, code int, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	if err := json.NewEncoder(resp).Encode(v); err != nil {
+		glog.Errorf("Failed to encode the response: %v", err)
+	}
+}
+
+func main() {
+	var listenAddress string
+	var tlsCertFile string
+	var tlsKeyFile string
+	var tlsCertPath string
+	var trustedIssuerPatterns string
+	var trustedIssuersFile string
+	var clientID string
+	var distributedClaims string
+	var groupsClaim string
+	var usernameClaim string
+	var issuer string
+	var claimPolicyFile string
+	var audience string
+	var maxTokenLifetime time.Duration
+	var signingKeyFiles string
+	var keyFile string
+	var keyRotationPeriod time.Duration
+	var keyRetirementPeriod time.Duration
+	var keyAlgorithm string
+	var signerBackend string
+	var pkcs11Opts signer_backend.PKCS11Options
+	var vaultOpts signer_backend.VaultOptions
+	flag.StringVar(&listenAddress, "listen-address", ":8443", "the address to serve the token service on")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "path to the TLS certificate of the token service")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "path to the TLS private key of the token service")
+	flag.StringVar(&tlsCertPath, "tls-cert-path", "", "path to the root CA certificate of the trusted issuers")
+	flag.StringVar(&trustedIssuerPatterns, "trusted-issuers", "",
+		"comma-separated patterns of the trusted JWT issuers, e.g., https://127.0.0.1:*")
+	flag.StringVar(&trustedIssuersFile, "trusted-issuers-file", "",
+		"path to a JSON file of the trusted JWT issuers and their root CA certificates")
+	flag.StringVar(&clientID, "client-id", "test-client-id", "the client id the tokens must be issued for")
+	flag.StringVar(&distributedClaims, "distributed-claims", "groups",
+		"comma-separated names of the distributed claims to resolve, or \"*\" for all distributed claims")
+	flag.StringVar(&groupsClaim, "groups-claim", "groups", "the claim to use as the groups")
+	flag.StringVar(&usernameClaim, "username-claim", "username", "the claim to use as the user name")
+	flag.StringVar(&issuer, "issuer", "token-service", "the issuer of the re-signed tokens")
+	flag.StringVar(&claimPolicyFile, "claim-policy-file", "",
+		"path to a YAML or JSON policy that filters and transforms the claims of the re-signed tokens")
+	flag.StringVar(&audience, "audience", "",
+		"comma-separated audiences of the re-signed tokens, defaults to the audience of the subject tokens")
+	flag.DurationVar(&maxTokenLifetime, "max-token-lifetime", 0,
+		"the max lifetime of the re-signed tokens, which never outlive the subject tokens; 0 keeps their expiry")
+	flag.StringVar(&signingKeyFiles, "signing-key-files", "../testdata/token_service_signing_key.pem",
+		"comma-separated paths to the private keys published in the JWKS, the first of which signs the resolved tokens, "+
+			"e.g., an Ed25519 key to sign with EdDSA")
+	flag.StringVar(&keyFile, "key-file", "",
+		"path to the file of the rotated signing keys, which replace the --signing-key-files if specified; "+
+			"only valid with --signer=file")
+	flag.DurationVar(&keyRotationPeriod, "key-rotation-period", 24*time.Hour,
+		"how long a rotated signing key signs before the next key replaces it")
+	flag.DurationVar(&keyRetirementPeriod, "key-retirement-period", 24*time.Hour,
+		"how long a replaced signing key stays published, at least the lifetime of the tokens")
+	flag.StringVar(&keyAlgorithm, "key-algorithm", "RS256",
+		"the signature algorithm of the rotated signing keys: RS256, ES256 or EdDSA")
+	flag.StringVar(&signerBackend, "signer", "file",
+		"the backend of the signing key: file for the --signing-key-files, pkcs11 for a key in a PKCS#11 token, "+
+			"or vault for a key in the Transit engine of Vault; the secrets are $PKCS11_PIN and $VAULT_TOKEN")
+	flag.StringVar(&pkcs11Opts.Module, "pkcs11-module", "", "path to the PKCS#11 library, e.g., of SoftHSM")
+	flag.StringVar(&pkcs11Opts.TokenLabel, "pkcs11-token-label", "", "the label of the PKCS#11 token of the signing key")
+	flag.StringVar(&pkcs11Opts.KeyLabel, "pkcs11-key-label", "", "the label of the PKCS#11 signing key")
+	flag.StringVar(&vaultOpts.Address, "vault-address", "", "the address of the Vault server, defaults to $VAULT_ADDR")
+	flag.StringVar(&vaultOpts.CAFile, "vault-ca-file", "", "path to the root CA certificate of the Vault server")
+	flag.StringVar(&vaultOpts.Mount, "vault-transit-mount", "transit", "the mount path of the Transit engine of Vault")
+	flag.StringVar(&vaultOpts.Key, "vault-transit-key", "", "the name of the Transit signing key")
+	flag.Parse()
+	if len(tlsCertFile) == 0 || len(tlsKeyFile) == 0 {
+		glog.Fatalf("Must specify the TLS certificate and key --tls-cert-file and --tls-key-file.")
+	}
+	if len(keyFile) > 0 && signerBackend != "file" {
+		glog.Fatalf("Must not specify --key-file with the %v signer backend.", signerBackend)
+	}
+
+	var trustedIssuers utils.TrustedIssuers
+	var err error
+	if len(trustedIssuersFile) > 0 {
+		trustedIssuers, err = utils.LoadTrustedIssuersFromFile(trustedIssuersFile)
+	} else {
+		if len(tlsCertPath) == 0 {
+			glog.Fatalf("Must specify the path to the root CA certificate --tls-cert-path.")
+		}
+		trustedIssuers, err = utils.ParseTrustedIssuers(trustedIssuerPatterns, tlsCertPath)
+	}
+	if err != nil {
+		glog.Fatalf("Failed to load the trusted issuers: %v", err)
+	}
+	if len(trustedIssuers) == 0 {
+		glog.Fatalf("Must specify the trusted issuers --trusted-issuers or --trusted-issuers-file.")
+	}
+
+	var keys signingKeys
+	if len(keyFile) > 0 {
+		m, err := key_manager.NewKeyManager(key_manager.Options{
+			File:             keyFile,
+			RotationPeriod:   keyRotationPeriod,
+			RetirementPeriod: keyRetirementPeriod,
+			Algorithm:        jose.SignatureAlgorithm(keyAlgorithm),
+		})
+		if err != nil {
+			glog.Fatalf("Failed to load the signing keys: %v", err)
+		}
+		go m.Run(wait.NeverStop)
+		// Rotate the keys on SIGHUP
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := m.Rotate(); err != nil {
+					glog.Errorf("Failed to rotate the signing keys: %v", err)
+				}
+			}
+		}()
+		keys = m
+	} else if signerBackend == "file" {
+		keys, err = loadStaticKeys(strings.Split(signingKeyFiles, ","))
+		if err != nil {
+			glog.Fatalf("Failed to load the signing keys: %v", err)
+		}
+	} else {
+		var backend crypto.Signer
+		switch signerBackend {
+		case "pkcs11":
+			// The PIN is not a flag, so that it is not visible to other users
+			pkcs11Opts.PIN = os.Getenv("PKCS11_PIN")
+			backend, err = signer_backend.NewPKCS11Signer(pkcs11Opts)
+		case "vault":
+			backend, err = signer_backend.NewVaultSigner(vaultOpts)
+		default:
+			glog.Fatalf("Unknown signer backend %q.", signerBackend)
+		}
+		if err != nil {
+			glog.Fatalf("Failed to create the %v signer: %v", signerBackend, err)
+		}
+		keys, err = newBackendKeys(backend)
+		if err != nil {
+			glog.Fatalf("Failed to create the signing keys: %v", err)
+		}
+	}
+
+	var policy *claim_policy.Policy
+	if len(claimPolicyFile) > 0 {
+		policy, err = claim_policy.LoadPolicyFromFile(claimPolicyFile)
+		if err != nil {
+			glog.Fatalf("Failed to load the claim policy: %v", err)
+		}
+	}
+	jwtOptions := utils.JwtOptions{
+		Issuer:        issuer,
+		MaxLifetime:   maxTokenLifetime,
+		ResetIssuedAt: true,
+		NewID:         true,
+	}
+	if len(audience) > 0 {
+		jwtOptions.Audience = strings.Split(audience, ",")
+	}
+	s := newTokenService(clientID, strings.Split(distributedClaims, ","), groupsClaim, usernameClaim,
+		trustedIssuers, jwtOptions, policy, keys)
+	// The token service is not ready until the trusted issuers are discovered
+	s.resolver.WarmUp()
+	glog.Infof("Serving the token exchange at https://%v%v and the JWKS at https://%v%v",
+		listenAddress, tokenPath, listenAddress, jwksPath)
+	if err := http.ListenAndServeTLS(listenAddress, tlsCertFile, tlsKeyFile, s.handler()); err != nil {
+		glog.Fatalf("Failed to serve the token service: %v", err)
+	}
+}
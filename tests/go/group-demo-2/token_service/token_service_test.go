@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lei-tang/dev/tests/go/group-demo-2/claim_policy"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/key_manager"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils/test_idp"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const testExpiry = 10413792000
+
+// newTestTokenService creates a token service that trusts the tokens of idp.
+func newTestTokenService(t *testing.T, idp *test_idp.Idp) *tokenService {
+	trustedIssuers := idp.TrustedIssuers(t)
+	keys, err := loadStaticKeys([]string{"../testdata/token_service_signing_key.pem"})
+	if err != nil {
+		t.Fatalf("Failed to load the signing keys: %v", err)
+	}
+	s := newTokenService(test_idp.ClientID, []string{"groups"}, "groups", "username", trustedIssuers,
+		utils.JwtOptions{Issuer: "token-service"}, nil, keys)
+	s.now = func() time.Time { return time.Unix(testExpiry-3600, 0) }
+	return s
+}
+
+// exchangeForm returns the form of the exchange of subjectToken.
+func exchangeForm(subjectToken string) url.Values {
+	return url.Values{
+		"grant_type":         {tokenExchangeGrantType},
+		"subject_token":      {subjectToken},
+		"subject_token_type": {jwtTokenType},
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	server := httptest.NewTLSServer(newTestTokenService(t, idp).handler())
+	defer server.Close()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	untrustedSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: priv}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	token := idp.Sign(t, idp.Signer, idp.Server.URL, test_idp.DistributedClaims)
+	with := func(form url.Values, key, value string) url.Values {
+		form.Set(key, value)
+		return form
+	}
+
+	testCases := []struct {
+		name      string
+		form      url.Values
+		wantCode  int
+		wantError string
+	}{
+		{
+			name:     "distributed groups",
+			form:     exchangeForm(token),
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "requested jwt",
+			form:     with(exchangeForm(token), "requested_token_type", jwtTokenType),
+			wantCode: http.StatusOK,
+		},
+		{
+			name:      "unsupported grant type",
+			form:      with(exchangeForm(token), "grant_type", "client_credentials"),
+			wantCode:  http.StatusBadRequest,
+			wantError: errUnsupportedGrantType,
+		},
+		{
+			name:      "no subject token",
+			form:      with(exchangeForm(token), "subject_token", ""),
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRequest,
+		},
+		{
+			name:      "no subject token type",
+			form:      with(exchangeForm(token), "subject_token_type", ""),
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRequest,
+		},
+		{
+			name:      "unsupported subject token type",
+			form:      with(exchangeForm(token), "subject_token_type", "urn:ietf:params:oauth:token-type:saml2"),
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRequest,
+		},
+		{
+			name:      "unsupported requested token type",
+			form:      with(exchangeForm(token), "requested_token_type", accessTokenType),
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRequest,
+		},
+		{
+			name:      "bad signature",
+			form:      exchangeForm(idp.Sign(t, untrustedSigner, idp.Server.URL, test_idp.DistributedClaims)),
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRequest,
+		},
+		{
+			name:      "untrusted issuer",
+			form:      exchangeForm(idp.Sign(t, idp.Signer, "https://untrusted.example.com", test_idp.DistributedClaims)),
+			wantCode:  http.StatusBadRequest,
+			wantError: errInvalidRequest,
+		},
+		{
+			name:      "claim source unavailable",
+			form:      exchangeForm(idp.Sign(t, idp.Signer, idp.Server.URL, test_idp.WrongAccessToken)),
+			wantCode:  http.StatusServiceUnavailable,
+			wantError: errTemporarilyUnavailable,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := server.Client().PostForm(server.URL+tokenPath, tc.form)
+			if err != nil {
+				t.Fatalf("Failed to post the token request: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantCode {
+				body, _ := ioutil.ReadAll(resp.Body)
+				t.Fatalf("status code = %v (%s), want %v", resp.StatusCode, body, tc.wantCode)
+			}
+			if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", cc)
+			}
+
+			if tc.wantError != "" {
+				var out errorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+					t.Fatalf("Failed to decode the error response: %v", err)
+				}
+				if out.Error != tc.wantError || out.ErrorDescription == "" {
+					t.Errorf("error response = %+v, want the error %q and a description", out, tc.wantError)
+				}
+				return
+			}
+
+			var out tokenResponse
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatalf("Failed to decode the token response: %v", err)
+			}
+			if out.IssuedTokenType != jwtTokenType || out.TokenType != "Bearer" || out.ExpiresIn != 3600 {
+				t.Errorf("token response = %+v, want a %v bearer token expiring in 3600s", out, jwtTokenType)
+			}
+			claims := test_idp.VerifyResigned(t, out.AccessToken)
+			if got := string(claims["iss"]); got != `"token-service"` {
+				t.Errorf("issued token iss = %v, want \"token-service\"", got)
+			}
+			var groups []string
+			if err := json.Unmarshal(claims["groups"], &groups); err != nil {
+				t.Fatalf("Failed to parse the groups of the issued token: %v", err)
+			}
+			if want := []string{"group1", "group2"}; !reflect.DeepEqual(groups, want) {
+				t.Errorf("issued token groups = %v, want %v", groups, want)
+			}
+		})
+	}
+
+	resp, err := server.Client().Get(server.URL + tokenPath)
+	if err != nil {
+		t.Fatalf("Failed to get the token endpoint: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status code = %v, want %v", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestTokenExchangeClaimPolicy(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	s := newTestTokenService(t, idp)
+	policy, err := claim_policy.ParsePolicy([]byte(`
+deny: [username]
+rename: {groups: roles}
+static: {cluster: demo}
+derive:
+- claim: group
+  groupPrefix: group
+  multiple: true
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse the claim policy: %v", err)
+	}
+	s.policy = policy
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+
+	resp, err := server.Client().PostForm(server.URL+tokenPath,
+		exchangeForm(idp.Sign(t, idp.Signer, idp.Server.URL, test_idp.DistributedClaims)))
+	if err != nil {
+		t.Fatalf("Failed to post the token request: %v", err)
+	}
+	defer resp.Body.Close()
+	var out tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("Failed to decode the token response: %v", err)
+	}
+	claims := test_idp.VerifyResigned(t, out.AccessToken)
+	want := map[string]string{
+		"cluster": `"demo"`,
+		"roles":   `["group1","group2"]`,
+		"group":   `["1","2"]`,
+	}
+	for k, v := range want {
+		if string(claims[k]) != v {
+			t.Errorf("issued token claim %v = %s, want %s", k, claims[k], v)
+		}
+	}
+	for _, k := range []string{"username", "groups"} {
+		if _, ok := claims[k]; ok {
+			t.Errorf("issued token has the claim %v, want it removed by the policy", k)
+		}
+	}
+}
+
+// newIssuerURLServer starts a TLS token service of the keys whose issuer is
+// its URL, which is only known once the server is started.
+func newIssuerURLServer(t *testing.T, idp *test_idp.Idp, keys signingKeys) *httptest.Server {
+	trustedIssuers := idp.TrustedIssuers(t)
+	var s *tokenService
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		s.handler().ServeHTTP(resp, req)
+	}))
+	s = newTokenService(test_idp.ClientID, []string{"groups"}, "groups", "username", trustedIssuers,
+		utils.JwtOptions{Issuer: server.URL}, nil, keys)
+	return server
+}
+
+func TestDiscovery(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	keys, err := loadStaticKeys([]string{"../testdata/token_service_signing_key.pem", "../testdata/oidc_server_signing_key.pem"})
+	if err != nil {
+		t.Fatalf("Failed to load the signing keys: %v", err)
+	}
+	server := newIssuerURLServer(t, idp, keys)
+	defer server.Close()
+
+	var doc discoveryDocument
+	getJSON(t, server, discoveryPath, &doc)
+	wantDoc := discoveryDocument{
+		Issuer:                           server.URL,
+		JWKSURI:                          server.URL + jwksPath,
+		TokenEndpoint:                    server.URL + tokenPath,
+		GrantTypesSupported:              []string{tokenExchangeGrantType},
+		ResponseTypesSupported:           []string{"id_token"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{"RS256"},
+	}
+	if !reflect.DeepEqual(doc, wantDoc) {
+		t.Errorf("discovery document = %+v, want %+v", doc, wantDoc)
+	}
+
+	var jwks jose.JSONWebKeySet
+	getJSON(t, server, jwksPath, &jwks)
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("JWKS has %v keys, want 2", len(jwks.Keys))
+	}
+	// The key id of the token service key is the RFC 7638 thumbprint in the
+	// JWKS of the testdata.
+	if jwks.Keys[0].KeyID != test_idp.TokenServiceKeyID {
+		t.Errorf("JWKS key id = %q, want %q", jwks.Keys[0].KeyID, test_idp.TokenServiceKeyID)
+	}
+	for _, key := range jwks.Keys {
+		if !key.IsPublic() || key.Use != "sig" || key.Algorithm != "RS256" {
+			t.Errorf("JWKS key = %+v, want a public RS256 signing key", key)
+		}
+	}
+
+	// A verifier discovers the keys of the token service from its issuer.
+	verifyDiscovered(t, idp, server)
+}
+
+// verifyDiscovered exchanges a token at the token service server and
+// authenticates the issued token with the keys discovered from the issuer of
+// the token service, which is the URL of server.
+func verifyDiscovered(t *testing.T, idp *test_idp.Idp, server *httptest.Server) {
+	caFile, err := ioutil.TempFile("", "temp_ca.cert")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary file: %v", err)
+	}
+	defer os.Remove(caFile.Name())
+	err = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	caFile.Close()
+	if err != nil {
+		t.Fatalf("Failed to encode the CA certificate: %v", err)
+	}
+	a, err := utils.CreateGroupAuthenticator(server.URL, test_idp.ClientID, "groups", "", "username",
+		caFile.Name(), map[string]string{})
+	if err != nil {
+		t.Fatalf("Failed to create an authenticator of the token service: %v", err)
+	}
+	defer a.Close()
+
+	resp, err := server.Client().PostForm(server.URL+tokenPath,
+		exchangeForm(idp.Sign(t, idp.Signer, idp.Server.URL, test_idp.DistributedClaims)))
+	if err != nil {
+		t.Fatalf("Failed to post the token request: %v", err)
+	}
+	defer resp.Body.Close()
+	var out tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("Failed to decode the token response: %v", err)
+	}
+	info, _, ok, err := a.AuthenticateToken(out.AccessToken)
+	if err != nil || !ok {
+		t.Fatalf("Failed to authenticate the issued token: %v, %v", ok, err)
+	}
+	if info.GetName() != "test-user-name" || !reflect.DeepEqual(info.GetGroups(), []string{"group1", "group2"}) {
+		t.Errorf("issued token user = %+v, want test-user-name in group1 and group2", info)
+	}
+}
+
+func TestTokenExchangeEdDSA(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to encode the key: %v", err)
+	}
+	keyFile, err := ioutil.TempFile("", "ed25519_key.pem")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary file: %v", err)
+	}
+	defer os.Remove(keyFile.Name())
+	err = pem.Encode(keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	keyFile.Close()
+	if err != nil {
+		t.Fatalf("Failed to encode the key: %v", err)
+	}
+	keys, err := loadStaticKeys([]string{keyFile.Name()})
+	if err != nil {
+		t.Fatalf("Failed to load the signing key: %v", err)
+	}
+	server := newIssuerURLServer(t, idp, keys)
+	defer server.Close()
+
+	var doc discoveryDocument
+	getJSON(t, server, discoveryPath, &doc)
+	if !reflect.DeepEqual(doc.IDTokenSigningAlgValuesSupported, []string{"EdDSA"}) {
+		t.Errorf("signing algorithms = %v, want [EdDSA]", doc.IDTokenSigningAlgValuesSupported)
+	}
+	var jwks jose.JSONWebKeySet
+	getJSON(t, server, jwksPath, &jwks)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Algorithm != "EdDSA" || !jwks.Keys[0].IsPublic() {
+		t.Fatalf("JWKS = %+v, want a public EdDSA key", jwks)
+	}
+	verifyDiscovered(t, idp, server)
+}
+
+// opaqueKey is a signer backend whose private key is not accessible.
+type opaqueKey struct {
+	crypto.Signer
+}
+
+func TestBackendKeys(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	key, err := utils.LoadJSONWebPrivateKeyFromFile("../testdata/token_service_signing_key.pem", "")
+	if err != nil {
+		t.Fatalf("Failed to load the signing key: %v", err)
+	}
+	keys, err := newBackendKeys(opaqueKey{key.Key.(crypto.Signer)})
+	if err != nil {
+		t.Fatalf("newBackendKeys() failed: %v", err)
+	}
+	server := newIssuerURLServer(t, idp, keys)
+	defer server.Close()
+
+	// The key id is the same as of the key file
+	var jwks jose.JSONWebKeySet
+	getJSON(t, server, jwksPath, &jwks)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].KeyID != test_idp.TokenServiceKeyID || !jwks.Keys[0].IsPublic() {
+		t.Fatalf("JWKS = %+v, want the public key %v", jwks, test_idp.TokenServiceKeyID)
+	}
+	verifyDiscovered(t, idp, server)
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	trustedIssuers := idp.TrustedIssuers(t)
+	dir, err := ioutil.TempDir("", "token_service")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	m, err := key_manager.NewKeyManager(key_manager.Options{File: filepath.Join(dir, "keys.json")})
+	if err != nil {
+		t.Fatalf("Failed to create a key manager: %v", err)
+	}
+	s := newTokenService(test_idp.ClientID, []string{"groups"}, "groups", "username", trustedIssuers,
+		utils.JwtOptions{Issuer: "token-service"}, nil, m)
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+
+	exchange := func() string {
+		resp, err := server.Client().PostForm(server.URL+tokenPath,
+			exchangeForm(idp.Sign(t, idp.Signer, idp.Server.URL, test_idp.DistributedClaims)))
+		if err != nil {
+			t.Fatalf("Failed to post the token request: %v", err)
+		}
+		defer resp.Body.Close()
+		var out tokenResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatalf("Failed to decode the token response: %v", err)
+		}
+		return out.AccessToken
+	}
+	// verify verifies token with the published JWKS and returns its kid.
+	verify := func(token string) (string, error) {
+		var jwks jose.JSONWebKeySet
+		getJSON(t, server, jwksPath, &jwks)
+		jws, err := jose.ParseSigned(token)
+		if err != nil {
+			return "", err
+		}
+		kid := jws.Signatures[0].Header.KeyID
+		keys := jwks.Key(kid)
+		if len(keys) != 1 {
+			return kid, fmt.Errorf("key %q is not published", kid)
+		}
+		_, err = jws.Verify(keys[0])
+		return kid, err
+	}
+
+	before := exchange()
+	kid, err := verify(before)
+	if err != nil || kid != m.ActiveKeyID() {
+		t.Fatalf("verify() = %q, %v, want the active key %q", kid, err, m.ActiveKeyID())
+	}
+	if err := m.Rotate(); err != nil {
+		t.Fatalf("Rotate() failed: %v", err)
+	}
+	// The tokens issued before the rotation still verify.
+	if _, err := verify(before); err != nil {
+		t.Errorf("Failed to verify a token issued before the rotation: %v", err)
+	}
+	after := exchange()
+	newKid, err := verify(after)
+	if err != nil || newKid == kid || newKid != m.ActiveKeyID() {
+		t.Errorf("verify() = %q, %v after the rotation, want the new active key %q", newKid, err, m.ActiveKeyID())
+	}
+}
+
+// getJSON gets path from server and decodes the JSON response into v.
+func getJSON(t *testing.T, server *httptest.Server, path string, v interface{}) {
+	resp, err := server.Client().Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("Failed to get %v: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%v status code = %v, want %v", path, resp.StatusCode, http.StatusOK)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != keysMaxAge {
+		t.Errorf("%v Cache-Control = %q, want %q", path, cc, keysMaxAge)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("Failed to decode %v: %v", path, err)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	idp := test_idp.New(t)
+	defer idp.Close()
+	s := newTestTokenService(t, idp)
+	defer s.resolver.Close()
+	serveReadyz := func(s *tokenService) int {
+		rec := httptest.NewRecorder()
+		s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+		return rec.Code
+	}
+
+	s.resolver.WarmUp()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.resolver.WaitReady(ctx); err != nil {
+		t.Fatalf("The trusted issuer is not discovered: %v", err)
+	}
+	if code := serveReadyz(s); code != http.StatusOK {
+		t.Errorf("readyz status code = %v, want %v", code, http.StatusOK)
+	}
+
+	// The trusted issuer can't be discovered
+	unreachable := newTokenService(test_idp.ClientID, []string{"groups"}, "groups", "username",
+		utils.TrustedIssuers{{Pattern: "https://127.0.0.1:1"}}, utils.JwtOptions{Issuer: "token-service"}, nil, s.keys)
+	defer unreachable.resolver.Close()
+	unreachable.resolver.WarmUp()
+	if code := serveReadyz(unreachable); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz status code = %v before the issuer is discovered, want %v", code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,197 @@
+// Package unverified_jwt parses a JWT without verifying its signature, so that
+// its header and claims can be inspected before it is verified, e.g., to find
+// the authenticator of its issuer or whether it has distributed claims.
+//
+// WARNING: the header and the claims of an unverified token are not trusted.
+// They only select how the token is verified.
+package unverified_jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ClaimNamesKey and ClaimSourcesKey are the claims of the distributed and
+	// aggregated claims (OIDC Connect Core 1.0, section 5.6.2).
+	ClaimNamesKey   = "_claim_names"
+	ClaimSourcesKey = "_claim_sources"
+)
+
+var (
+	// ErrMalformedToken is wrapped when a token can't be parsed.
+	ErrMalformedToken = errors.New("oidc: malformed token")
+
+	// ErrInvalidClaim is wrapped when a claim of a token is missing or can't
+	// be parsed.
+	ErrInvalidClaim = errors.New("oidc: invalid claim")
+)
+
+// InvalidClaimError is returned when a claim of a token is missing or can't be
+// parsed.
+type InvalidClaimError struct {
+	Claim string
+	Err   error
+}
+
+func (e *InvalidClaimError) Error() string {
+	return fmt.Sprintf("oidc: parse claim %q: %v", e.Claim, e.Err)
+}
+
+func (e *InvalidClaimError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InvalidClaimError) Is(target error) bool {
+	return target == ErrInvalidClaim
+}
+
+// Header is the JOSE header of a JWT.
+type Header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// Token is a JWT whose signature is not verified.
+type Token struct {
+	Header Header
+	// Claims are the claims of the payload.
+	Claims map[string]json.RawMessage
+	// Raw is the compact serialization the token was parsed from.
+	Raw string
+}
+
+// ParseUnverified parses the header and the claims of a compact serialized
+// JWT without verifying its signature.
+func ParseUnverified(token string) (*Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: the JWT has %v parts, want 3", ErrMalformedToken, len(parts))
+	}
+	t := &Token{Raw: token}
+	if err := decodeSegment(parts[0], &t.Header); err != nil {
+		return nil, fmt.Errorf("%w: invalid header: %v", ErrMalformedToken, err)
+	}
+	if len(parts[1]) == 0 {
+		return nil, fmt.Errorf("%w: the payload of the JWT is empty", ErrMalformedToken)
+	}
+	if err := decodeSegment(parts[1], &t.Claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid payload: %v", ErrMalformedToken, err)
+	}
+	if t.Claims == nil {
+		return nil, fmt.Errorf("%w: the payload of the JWT is not a JSON object", ErrMalformedToken)
+	}
+	return t, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT into v.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Issuer returns the "iss" claim, or "" if there is none.
+func (t *Token) Issuer() (string, error) {
+	raw, ok := t.Claims["iss"]
+	if !ok {
+		return "", nil
+	}
+	var iss string
+	if err := json.Unmarshal(raw, &iss); err != nil {
+		return "", fmt.Errorf("%w: the issuer is not a string: %v", ErrMalformedToken, err)
+	}
+	return iss, nil
+}
+
+// DistributedClaims returns the distributed and aggregated claims of the
+// token, or nil if there are none.
+func (t *Token) DistributedClaims() (*DistributedClaims, error) {
+	return ParseDistributedClaims(t.Claims)
+}
+
+// DistributedClaims are the distributed and aggregated claims of a token, e.g.,
+//
+//	"_claim_names": {
+//	  "groups": "src1"
+//	},
+//	"_claim_sources": {
+//	  "src1": {
+//	    "endpoint": "https://www.example.com",
+//	    "access_token": "f005ba11"
+//	  }
+//	}
+type DistributedClaims struct {
+	// Names maps the names of the claims to the names of their sources.
+	Names map[string]string
+	// Sources maps the names of the sources to the sources.
+	Sources map[string]ClaimSource
+}
+
+// ClaimSource is the source of distributed or aggregated claims: either a
+// distributed claims endpoint or an aggregated claims JWT.
+type ClaimSource struct {
+	// URL to use to request the distributed claim.  This URL is expected to be
+	// prefixed by one of the known issuer URLs.
+	URL string `json:"endpoint,omitempty"`
+	// AccessToken is the bearer token to use for access.  If empty, it is
+	// not used.  Access token is optional per the OIDC distributed claims
+	// specification.
+	// See: http://openid.net/specs/openid-connect-core-1_0.html#DistributedExample
+	AccessToken string `json:"access_token,omitempty"`
+	// JWT is the container for aggregated claims.
+	// See: http://openid.net/specs/openid-connect-core-1_0.html#AggregatedExample
+	JWT string `json:"JWT,omitempty"`
+}
+
+// ParseDistributedClaims parses the "_claim_names" and the "_claim_sources"
+// of claims, verified or not. It returns nil if there is no "_claim_names".
+func ParseDistributedClaims(claims map[string]json.RawMessage) (*DistributedClaims, error) {
+	names, ok := claims[ClaimNamesKey]
+	if !ok {
+		return nil, nil
+	}
+	d := &DistributedClaims{}
+	if err := json.Unmarshal(names, &d.Names); err != nil {
+		return nil, &InvalidClaimError{Claim: ClaimNamesKey, Err: err}
+	}
+	sources, ok := claims[ClaimSourcesKey]
+	if !ok {
+		// Having _claim_names claim,  but no _claim_sources is not an expected
+		// state.
+		return nil, &InvalidClaimError{Claim: ClaimSourcesKey, Err: errors.New("no claim sources")}
+	}
+	if err := json.Unmarshal(sources, &d.Sources); err != nil {
+		return nil, &InvalidClaimError{Claim: ClaimSourcesKey, Err: err}
+	}
+	return d, nil
+}
+
+// Has reports whether name is a distributed or aggregated claim. A nil
+// DistributedClaims has no claims.
+func (d *DistributedClaims) Has(name string) bool {
+	if d == nil {
+		return false
+	}
+	_, ok := d.Names[name]
+	return ok
+}
+
+// Source returns the source of a distributed or aggregated claim.
+func (d *DistributedClaims) Source(name string) (ClaimSource, bool) {
+	if d == nil {
+		return ClaimSource{}, false
+	}
+	srcName, ok := d.Names[name]
+	if !ok {
+		return ClaimSource{}, false
+	}
+	src, ok := d.Sources[srcName]
+	return src, ok
+}
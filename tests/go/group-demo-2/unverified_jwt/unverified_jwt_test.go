@@ -0,0 +1,159 @@
+package unverified_jwt
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// jwt creates an unsigned JWT of the JSON header and payload.
+func jwt(header, payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestParseUnverified(t *testing.T) {
+	raw := jwt(`{"alg":"EdDSA","kid":"test-key","typ":"JWT"}`, `{
+		"iss": "https://127.0.0.1:8443",
+		"username": "test-user-name",
+		"_claim_names": {"groups": "src1", "roles": "src2"},
+		"_claim_sources": {
+			"src1": {"endpoint": "https://127.0.0.1:8443/groups", "access_token": "group_access_token"},
+			"src2": {"JWT": "eyJhbGciOiJSUzI1NiJ9.e30.c2ln"}
+		}
+	}`)
+	token, err := ParseUnverified(raw)
+	if err != nil {
+		t.Fatalf("ParseUnverified() failed: %v", err)
+	}
+	if want := (Header{Algorithm: "EdDSA", KeyID: "test-key", Type: "JWT"}); token.Header != want || token.Raw != raw {
+		t.Errorf("ParseUnverified() = header %+v, raw %q; want %+v, %q", token.Header, token.Raw, want, raw)
+	}
+	if iss, err := token.Issuer(); err != nil || iss != "https://127.0.0.1:8443" {
+		t.Errorf("Issuer() = %q, %v, want https://127.0.0.1:8443", iss, err)
+	}
+	if string(token.Claims["username"]) != `"test-user-name"` {
+		t.Errorf("username = %s, want test-user-name", token.Claims["username"])
+	}
+
+	d, err := token.DistributedClaims()
+	if err != nil {
+		t.Fatalf("DistributedClaims() failed: %v", err)
+	}
+	if !d.Has("groups") || !d.Has("roles") || d.Has("username") {
+		t.Errorf("DistributedClaims() = %+v, want the distributed claims groups and roles", d)
+	}
+	src, ok := d.Source("groups")
+	if want := (ClaimSource{URL: "https://127.0.0.1:8443/groups", AccessToken: "group_access_token"}); !ok || src != want {
+		t.Errorf("Source(groups) = %+v, %v, want %+v", src, ok, want)
+	}
+	if src, ok := d.Source("roles"); !ok || src.JWT == "" {
+		t.Errorf("Source(roles) = %+v, %v, want the aggregated JWT", src, ok)
+	}
+	if _, ok := d.Source("username"); ok {
+		t.Errorf("Source(username) found a source, want none")
+	}
+}
+
+func TestParseUnverifiedNoClaims(t *testing.T) {
+	token, err := ParseUnverified(jwt(`{"alg":"RS256"}`, `{"sub":"test-user"}`))
+	if err != nil {
+		t.Fatalf("ParseUnverified() failed: %v", err)
+	}
+	if iss, err := token.Issuer(); err != nil || iss != "" {
+		t.Errorf("Issuer() = %q, %v, want no issuer", iss, err)
+	}
+	d, err := token.DistributedClaims()
+	if err != nil || d != nil {
+		t.Errorf("DistributedClaims() = %+v, %v, want none", d, err)
+	}
+	// A nil DistributedClaims has no claims
+	if _, ok := d.Source("groups"); d.Has("groups") || ok {
+		t.Errorf("nil DistributedClaims has the claim groups")
+	}
+}
+
+func TestParseUnverifiedErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{name: "two parts", token: "malformed.token"},
+		{name: "undecodable header", token: "!!!." + jwt(`{}`, `{}`)[3:]},
+		{name: "invalid header", token: jwt(`alg`, `{}`)},
+		{name: "empty payload", token: jwt(`{"alg":"RS256"}`, ``)},
+		{name: "undecodable payload", token: "eyJhbGciOiJSUzI1NiJ9.!!!.c2ln"},
+		{name: "null payload", token: jwt(`{"alg":"RS256"}`, `null`)},
+		{name: "array payload", token: jwt(`{"alg":"RS256"}`, `["iss"]`)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if token, err := ParseUnverified(tc.token); !errors.Is(err, ErrMalformedToken) {
+				t.Errorf("ParseUnverified() = %+v, %v, want %v", token, err, ErrMalformedToken)
+			}
+		})
+	}
+
+	token, err := ParseUnverified(jwt(`{"alg":"RS256"}`, `{"iss":["https://127.0.0.1:8443"]}`))
+	if err != nil {
+		t.Fatalf("ParseUnverified() failed: %v", err)
+	}
+	if iss, err := token.Issuer(); !errors.Is(err, ErrMalformedToken) {
+		t.Errorf("Issuer() of an array = %q, %v, want %v", iss, err, ErrMalformedToken)
+	}
+}
+
+func TestParseDistributedClaimsErrors(t *testing.T) {
+	testCases := []struct {
+		name      string
+		payload   string
+		wantClaim string
+	}{
+		{
+			name:      "invalid claim names",
+			payload:   `{"_claim_names": ["groups"], "_claim_sources": {}}`,
+			wantClaim: ClaimNamesKey,
+		},
+		{
+			name:      "no claim sources",
+			payload:   `{"_claim_names": {"groups": "src1"}}`,
+			wantClaim: ClaimSourcesKey,
+		},
+		{
+			name:      "invalid claim sources",
+			payload:   `{"_claim_names": {"groups": "src1"}, "_claim_sources": {"src1": "https://127.0.0.1:8443"}}`,
+			wantClaim: ClaimSourcesKey,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := ParseUnverified(jwt(`{"alg":"RS256"}`, tc.payload))
+			if err != nil {
+				t.Fatalf("ParseUnverified() failed: %v", err)
+			}
+			d, err := token.DistributedClaims()
+			var claimErr *InvalidClaimError
+			if !errors.Is(err, ErrInvalidClaim) || !errors.As(err, &claimErr) || claimErr.Claim != tc.wantClaim {
+				t.Errorf("DistributedClaims() = %+v, %v, want an invalid claim %v", d, err, tc.wantClaim)
+			}
+		})
+	}
+}
+
+func TestParseDistributedClaimsVerified(t *testing.T) {
+	// The claims of a verified token are parsed the same way
+	token, err := ParseUnverified(jwt(`{"alg":"RS256"}`,
+		`{"_claim_names": {"groups": "src1"}, "_claim_sources": {"src1": {"endpoint": "https://127.0.0.1:8443/groups"}}}`))
+	if err != nil {
+		t.Fatalf("ParseUnverified() failed: %v", err)
+	}
+	d, err := ParseDistributedClaims(token.Claims)
+	want := &DistributedClaims{
+		Names:   map[string]string{"groups": "src1"},
+		Sources: map[string]ClaimSource{"src1": {URL: "https://127.0.0.1:8443/groups"}},
+	}
+	if err != nil || !reflect.DeepEqual(d, want) {
+		t.Errorf("ParseDistributedClaims() = %+v, %v, want %+v", d, err, want)
+	}
+}
@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// LoadJSONWebPrivateKeyFromFile creates a JSONWebKey from the private key
+// in the file. The key id is the RFC 7638 SHA-256 thumbprint of the key,
+// base64url encoded, so that it is the same wherever the key is loaded.
+// The file may be a PEM file of a PKCS#1 RSA key, a PKCS#8 RSA, ECDSA or
+// Ed25519 key or a SEC1 EC key, or a JSON file of a JWK or of a JWKS of one
+// key. A JWK keeps its key id, if any.
+// path: the path to the private key file
+// alg: the signature algorithm, or "" to infer it from the key
+func LoadJSONWebPrivateKeyFromFile(path string, alg jose.SignatureAlgorithm) (*jose.JSONWebKey, error) {
+	return LoadEncryptedJSONWebPrivateKeyFromFile(path, alg, nil)
+}
+
+// LoadEncryptedJSONWebPrivateKeyFromFile is LoadJSONWebPrivateKeyFromFile for
+// a PEM file that may be encrypted with a passphrase (RFC 1423).
+// path: the path to the private key file
+// alg: the signature algorithm, or "" to infer it from the key
+// passphrase: the passphrase of an encrypted PEM file
+func LoadEncryptedJSONWebPrivateKeyFromFile(path string, alg jose.SignatureAlgorithm,
+	passphrase []byte) (*jose.JSONWebKey, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		glog.Errorf("Failed to read key file: %v", err)
+		return nil, err
+	}
+	key, err := ParseJSONWebPrivateKey(d, alg, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return key, nil
+}
+
+// ParseJSONWebPrivateKey creates a JSONWebKey from a private key in one of
+// the formats of LoadJSONWebPrivateKeyFromFile.
+// data: the PEM or JSON encoded private key
+// alg: the signature algorithm, or "" to infer it from the key
+// passphrase: the passphrase of an encrypted PEM key, may be nil
+func ParseJSONWebPrivateKey(data []byte, alg jose.SignatureAlgorithm, passphrase []byte) (*jose.JSONWebKey, error) {
+	var key *jose.JSONWebKey
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		key, err = parseJSONWebKey(trimmed)
+	} else {
+		key, err = parsePEMPrivateKey(data, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.IsPublic() {
+		return nil, fmt.Errorf("Not a private key")
+	}
+
+	inferred, err := signatureAlgorithm(key.Key)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case alg != "" && key.Algorithm != "" && key.Algorithm != string(alg):
+		return nil, fmt.Errorf("The key is for the algorithm %v, not %v", key.Algorithm, alg)
+	case alg != "":
+		if !AlgorithmMatchesKey(alg, inferred) {
+			return nil, fmt.Errorf("The %v key cannot sign with the algorithm %v", inferred, alg)
+		}
+		key.Algorithm = string(alg)
+	case key.Algorithm != "":
+		if !AlgorithmMatchesKey(jose.SignatureAlgorithm(key.Algorithm), inferred) {
+			return nil, fmt.Errorf("The %v key cannot sign with the algorithm %v", inferred, key.Algorithm)
+		}
+	default:
+		key.Algorithm = string(inferred)
+	}
+
+	if key.KeyID == "" {
+		hash, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			glog.Errorf("Failed to compute a SHA256 hash for the key: %v", err)
+			return nil, err
+		}
+		key.KeyID = base64.RawURLEncoding.EncodeToString(hash)
+	}
+	return key, nil
+}
+
+// parsePEMPrivateKey parses the first PEM block of data.
+func parsePEMPrivateKey(data, passphrase []byte) (*jose.JSONWebKey, error) {
+	p, _ := pem.Decode(data)
+	if p == nil {
+		glog.Errorf("Failed to decode the PEM file.")
+		return nil, fmt.Errorf("Failed to decode the PEM file.")
+	}
+	der := p.Bytes
+	// Only the RFC 1423 PEM encryption of OpenSSL is supported, which is
+	// deprecated for its weak key derivation, but still widely deployed.
+	if x509.IsEncryptedPEMBlock(p) {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("The PEM block is encrypted, but there is no passphrase")
+		}
+		var err error
+		if der, err = x509.DecryptPEMBlock(p, passphrase); err != nil {
+			return nil, fmt.Errorf("Failed to decrypt the PEM block: %v", err)
+		}
+	}
+	return parseDERPrivateKey(p.Type, der)
+}
+
+// parseDERPrivateKey parses a private key of the PEM block type blockType.
+func parseDERPrivateKey(blockType string, der []byte) (*jose.JSONWebKey, error) {
+	var priv interface{}
+	var err error
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(der)
+	case "ENCRYPTED PRIVATE KEY":
+		return nil, fmt.Errorf("Encrypted PKCS#8 keys are not supported, encrypt the PEM block instead")
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block type %q", blockType)
+	}
+	if err != nil {
+		glog.Errorf("Failed to parse private key: %v", err)
+		return nil, err
+	}
+	// x509 returns an Ed25519 key by value and the other keys by pointer,
+	// as jose expects.
+	return &jose.JSONWebKey{Key: priv}, nil
+}
+
+// parseJSONWebKey parses a JWK, or a JWKS of exactly one key.
+func parseJSONWebKey(data []byte) (*jose.JSONWebKey, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("Failed to parse the JSON key: %v", err)
+	}
+	if _, ok := fields["keys"]; ok {
+		var jwks jose.JSONWebKeySet
+		if err := json.Unmarshal(data, &jwks); err != nil {
+			return nil, fmt.Errorf("Failed to parse the JWKS: %v", err)
+		}
+		if len(jwks.Keys) != 1 {
+			return nil, fmt.Errorf("The JWKS has %v keys, want 1", len(jwks.Keys))
+		}
+		return &jwks.Keys[0], nil
+	}
+	key := &jose.JSONWebKey{}
+	if err := key.UnmarshalJSON(data); err != nil {
+		return nil, fmt.Errorf("Failed to parse the JWK: %v", err)
+	}
+	return key, nil
+}
+
+// signatureAlgorithm returns the signature algorithm of a private key.
+func signatureAlgorithm(key interface{}) (jose.SignatureAlgorithm, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("Unsupported private key type %T", key)
+	}
+	return SignatureAlgorithm(signer.Public())
+}
+
+// SignatureAlgorithm returns the signature algorithm of a public key: RS256
+// for RSA, ES256, ES384 or ES512 for the ECDSA curves and EdDSA for Ed25519.
+func SignatureAlgorithm(pub crypto.PublicKey) (jose.SignatureAlgorithm, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return jose.RS256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+		return "", fmt.Errorf("Unsupported elliptic curve %v", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return jose.EdDSA, nil
+	}
+	return "", fmt.Errorf("Unsupported key type %T", pub)
+}
+
+// AlgorithmMatchesKey reports whether alg can sign with a key whose
+// SignatureAlgorithm is keyAlg.
+func AlgorithmMatchesKey(alg, keyAlg jose.SignatureAlgorithm) bool {
+	if keyAlg == jose.RS256 {
+		switch alg {
+		case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+			return true
+		}
+		return false
+	}
+	return alg == keyAlg
+}
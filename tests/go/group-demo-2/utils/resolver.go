@@ -0,0 +1,431 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	oidc "github.com/lei-tang/dev/tests/go/group-demo-2/oidc_library"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/unverified_jwt"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// DefaultAuthenticatorIdleTimeout is how long the authenticator of an issuer
+// is kept without resolving a JWT of the issuer, unless
+// ResolverOptions.IdleTimeout is specified.
+const DefaultAuthenticatorIdleTimeout = 10 * time.Minute
+
+// minEvictionInterval is the shortest interval at which the idle
+// authenticators are evicted, whatever the IdleTimeout.
+const minEvictionInterval = time.Second
+
+// warmUpRetryInterval is how long WarmUp waits before it creates the
+// authenticator of an issuer again after a failure.
+const warmUpRetryInterval = 10 * time.Second
+
+// ErrResolverClosed is returned when a JWT is resolved by a closed
+// DistributedClaimsResolver.
+var ErrResolverClosed = errors.New("The distributed claims resolver is closed")
+
+// ResolverOptions are the options of a DistributedClaimsResolver. Except for
+// IdleTimeout, they are the parameters of ResolveDistributedClaimsToken.
+type ResolverOptions struct {
+	ClientID string
+	// DistributedClaims are the names of the distributed claims to resolve.
+	// oidc.AllDistributedClaims resolves all distributed claims in a JWT.
+	DistributedClaims []string
+	// GroupsClaim is the name of the group claim, may be empty.
+	GroupsClaim string
+	// GroupsPrefix is the prefix to be added to the resolved groups.
+	GroupsPrefix string
+	// UsernameClaim is the name of the user name claim.
+	UsernameClaim string
+	// TrustedIssuers are the issuers whose JWTs may be resolved.
+	TrustedIssuers TrustedIssuers
+	// IdleTimeout is how long the authenticator of an issuer is kept without
+	// resolving a JWT of the issuer. It defaults to
+	// DefaultAuthenticatorIdleTimeout. The idle authenticators are evicted at
+	// most every second, so a shorter IdleTimeout is only approximate.
+	IdleTimeout time.Duration
+}
+
+// DistributedClaimsResolver resolves the distributed claims of JWTs like
+// ResolveDistributedClaimsToken, but keeps the authenticator of an issuer
+// across the JWTs of the issuer instead of discovering the issuer and fetching
+// its keys for every JWT. An authenticator that is idle for
+// ResolverOptions.IdleTimeout is closed. The authenticators of the issuers of
+// the same root CA certificate share an HTTP transport, and thus their
+// connections.
+type DistributedClaimsResolver struct {
+	opts ResolverOptions
+
+	m sync.Mutex
+	// authenticators maps an issuer URL to the authenticator of the issuer.
+	authenticators map[string]*cachedAuthenticator
+	// transports maps the path of a root CA certificate to the transport.
+	transports map[string]*http.Transport
+	closed     bool
+	// pending are the issuers whose authenticators are being created by
+	// WarmUp. ready is closed when there is none.
+	pending map[string]bool
+	ready   chan struct{}
+
+	stop chan struct{}
+	// now is used for testing. It defaults to time.Now.
+	now func() time.Time
+}
+
+// cachedAuthenticator is the authenticator of an issuer. It is created by the
+// first JWT of the issuer, while the other JWTs of the issuer wait for it.
+type cachedAuthenticator struct {
+	// created is closed when the authenticator is created or failed to be.
+	created       chan struct{}
+	authenticator *oidc.Authenticator
+	err           error
+	// inUse is the number of the JWTs resolved by the authenticator. An
+	// authenticator in use is not closed when it is evicted.
+	inUse    int
+	lastUsed time.Time
+}
+
+// NewDistributedClaimsResolver creates a DistributedClaimsResolver. The
+// authenticators are created when the first JWT of an issuer is resolved, or
+// by WarmUp. Close stops the resolver.
+func NewDistributedClaimsResolver(opts ResolverOptions) *DistributedClaimsResolver {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultAuthenticatorIdleTimeout
+	}
+	r := &DistributedClaimsResolver{
+		opts:           opts,
+		authenticators: map[string]*cachedAuthenticator{},
+		transports:     map[string]*http.Transport{},
+		pending:        map[string]bool{},
+		ready:          make(chan struct{}),
+		stop:           make(chan struct{}),
+		now:            time.Now,
+	}
+	close(r.ready)
+	go r.evictIdleAuthenticators()
+	return r
+}
+
+// Resolve resolves the distributed claims of a JWT. The errors are those of
+// ResolveDistributedClaimsToken, or those of ctx when it is done before the
+// claims are resolved.
+func (r *DistributedClaimsResolver) Resolve(ctx context.Context, jwt string) (user.Info, map[string]json.RawMessage, error) {
+	t, err := unverified_jwt.ParseUnverified(jwt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.ResolveParsedToken(ctx, t)
+}
+
+// ResolveParsedToken resolves the distributed claims of a JWT already parsed
+// with unverified_jwt.ParseUnverified.
+func (r *DistributedClaimsResolver) ResolveParsedToken(ctx context.Context,
+	t *unverified_jwt.Token) (user.Info, map[string]json.RawMessage, error) {
+	issuerUrl, trustedIssuer, err := matchTrustedIssuer(r.opts.DistributedClaims, r.opts.TrustedIssuers, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.authenticate(ctx, issuerUrl, trustedIssuer, t)
+}
+
+// Authenticate verifies a JWT of a trusted issuer and resolves its distributed
+// claims. Unlike Resolve, a JWT without the distributed claims to resolve is
+// verified rather than rejected with ErrNoDistributedClaims; resolved reports
+// whether the JWT had any.
+func (r *DistributedClaimsResolver) Authenticate(ctx context.Context,
+	jwt string) (info user.Info, claims map[string]json.RawMessage, resolved bool, err error) {
+	t, err := unverified_jwt.ParseUnverified(jwt)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return r.AuthenticateParsedToken(ctx, t)
+}
+
+// AuthenticateParsedToken is Authenticate for a JWT already parsed with
+// unverified_jwt.ParseUnverified.
+func (r *DistributedClaimsResolver) AuthenticateParsedToken(ctx context.Context,
+	t *unverified_jwt.Token) (info user.Info, claims map[string]json.RawMessage, resolved bool, err error) {
+	resolved, err = containDistributedClaims(t, r.opts.DistributedClaims)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	issuerUrl, trustedIssuer, err := trustedIssuerOf(r.opts.TrustedIssuers, t)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	info, claims, err = r.authenticate(ctx, issuerUrl, trustedIssuer, t)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return info, claims, resolved, nil
+}
+
+// authenticate verifies a JWT with the authenticator of its trusted issuer and
+// resolves its distributed claims.
+func (r *DistributedClaimsResolver) authenticate(ctx context.Context, issuerUrl string, trustedIssuer TrustedIssuer,
+	t *unverified_jwt.Token) (user.Info, map[string]json.RawMessage, error) {
+	c, err := r.acquire(ctx, issuerUrl, trustedIssuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.release(c)
+	return authenticateParsedToken(ctx, c.authenticator, t)
+}
+
+// acquire returns the authenticator of the issuer, creating it if there is
+// none. The authenticator must be released after use.
+func (r *DistributedClaimsResolver) acquire(ctx context.Context, issuerUrl string,
+	trustedIssuer TrustedIssuer) (*cachedAuthenticator, error) {
+	r.m.Lock()
+	if r.closed {
+		r.m.Unlock()
+		return nil, ErrResolverClosed
+	}
+	c, ok := r.authenticators[issuerUrl]
+	if !ok {
+		c = &cachedAuthenticator{created: make(chan struct{})}
+		r.authenticators[issuerUrl] = c
+	}
+	c.inUse++
+	r.m.Unlock()
+
+	if !ok {
+		// The authenticator is created without the lock, so that the JWTs of
+		// the other issuers are not blocked by the discovery of the issuer,
+		// and in the background, so that it is shared by the JWTs whose
+		// contexts are done before it is created.
+		go r.create(c, issuerUrl, trustedIssuer)
+	}
+	select {
+	case <-c.created:
+	case <-ctx.Done():
+		r.release(c)
+		return nil, ctx.Err()
+	}
+	if c.err != nil {
+		r.release(c)
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// create creates the authenticator of c and closes c.created.
+func (r *DistributedClaimsResolver) create(c *cachedAuthenticator, issuerUrl string, trustedIssuer TrustedIssuer) {
+	a, err := r.createAuthenticator(issuerUrl, trustedIssuer)
+	r.m.Lock()
+	if err == nil && r.closed {
+		a.Close()
+		a, err = nil, ErrResolverClosed
+	}
+	c.authenticator, c.err = a, err
+	c.lastUsed = r.now()
+	if err != nil && r.authenticators[issuerUrl] == c {
+		// The next JWT of the issuer creates the authenticator again
+		delete(r.authenticators, issuerUrl)
+	}
+	r.m.Unlock()
+	close(c.created)
+}
+
+// release marks that a JWT is no longer resolved by the authenticator.
+func (r *DistributedClaimsResolver) release(c *cachedAuthenticator) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	c.inUse--
+	c.lastUsed = r.now()
+}
+
+// createAuthenticator creates the authenticator of an issuer with the shared
+// transport of the root CA certificate of the issuer.
+func (r *DistributedClaimsResolver) createAuthenticator(issuerUrl string,
+	trustedIssuer TrustedIssuer) (*oidc.Authenticator, error) {
+	tr, err := r.transport(trustedIssuer.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	options := claimsAuthenticatorOptions(issuerUrl, r.opts.ClientID, r.opts.DistributedClaims, r.opts.GroupsClaim,
+		r.opts.GroupsPrefix, r.opts.UsernameClaim, trustedIssuer.CAFile, map[string]string{})
+	options.Transport = tr
+	a, err := newReadyAuthenticator(options)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(4).Infof("Created the authenticator of the issuer %v", issuerUrl)
+	return a, nil
+}
+
+// transport returns the transport of a root CA certificate, creating it if
+// there is none.
+func (r *DistributedClaimsResolver) transport(caFile string) (*http.Transport, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if tr, ok := r.transports[caFile]; ok {
+		return tr, nil
+	}
+	tr, err := oidc.NewTransport(caFile)
+	if err != nil {
+		return nil, err
+	}
+	r.transports[caFile] = tr
+	return tr, nil
+}
+
+// WarmUp creates the authenticators of the trusted issuers without a wildcard
+// in the background, retrying those that fail, so that the first JWTs of the
+// issuers don't wait for their discovery. The resolver is not ready until the
+// authenticators are created. The issuers of the patterns with a wildcard are
+// only known from their JWTs, so their authenticators are created on demand.
+func (r *DistributedClaimsResolver) WarmUp() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, ti := range r.opts.TrustedIssuers {
+		p, err := parseIssuerPattern(ti.Pattern)
+		if err != nil {
+			continue
+		}
+		issuerUrl, ok := p.issuerURL()
+		if !ok || r.pending[issuerUrl] {
+			continue
+		}
+		// An earlier pattern may match the issuer with another CA file
+		trustedIssuer, _ := r.opts.TrustedIssuers.Match(issuerUrl)
+		if len(r.pending) == 0 {
+			r.ready = make(chan struct{})
+		}
+		r.pending[issuerUrl] = true
+		go r.warmUp(issuerUrl, trustedIssuer)
+	}
+}
+
+// warmUp creates the authenticator of an issuer, until it succeeds or the
+// resolver is closed.
+func (r *DistributedClaimsResolver) warmUp(issuerUrl string, trustedIssuer TrustedIssuer) {
+	for {
+		c, err := r.acquire(context.Background(), issuerUrl, trustedIssuer)
+		if err == nil {
+			r.release(c)
+			r.m.Lock()
+			delete(r.pending, issuerUrl)
+			if len(r.pending) == 0 {
+				close(r.ready)
+			}
+			r.m.Unlock()
+			glog.Infof("The authenticator of the issuer %v is ready", issuerUrl)
+			return
+		}
+		if errors.Is(err, ErrResolverClosed) {
+			return
+		}
+		glog.Errorf("Failed to create the authenticator of the issuer %v, retrying in %v: %v",
+			issuerUrl, warmUpRetryInterval, err)
+		select {
+		case <-time.After(warmUpRetryInterval):
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// WaitReady blocks until the authenticators created by WarmUp are ready or
+// ctx is done.
+func (r *DistributedClaimsResolver) WaitReady(ctx context.Context) error {
+	r.m.Lock()
+	ready := r.ready
+	r.m.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-r.stop:
+		return ErrResolverClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Name returns the name of the readiness check of the resolver.
+func (r *DistributedClaimsResolver) Name() string {
+	return "distributed-claims-resolver"
+}
+
+// Check returns an error naming the issuers whose authenticators are still
+// being created by WarmUp, or if the resolver is closed.
+func (r *DistributedClaimsResolver) Check(_ *http.Request) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.closed {
+		return ErrResolverClosed
+	}
+	if len(r.pending) > 0 {
+		pending := make([]string, 0, len(r.pending))
+		for issuerUrl := range r.pending {
+			pending = append(pending, issuerUrl)
+		}
+		sort.Strings(pending)
+		return fmt.Errorf("%w for issuers: %q", oidc.ErrVerifierNotReady, pending)
+	}
+	return nil
+}
+
+// evictIdleAuthenticators periodically closes the idle authenticators until
+// the resolver is closed.
+func (r *DistributedClaimsResolver) evictIdleAuthenticators() {
+	interval := r.opts.IdleTimeout / 2
+	if interval < minEvictionInterval {
+		interval = minEvictionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.evictIdle()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// evictIdle closes the authenticators not used for the idle timeout.
+func (r *DistributedClaimsResolver) evictIdle() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	now := r.now()
+	for issuerUrl, c := range r.authenticators {
+		if c.inUse > 0 || c.authenticator == nil || now.Sub(c.lastUsed) < r.opts.IdleTimeout {
+			continue
+		}
+		glog.V(4).Infof("Closing the authenticator of the issuer %v, idle since %v", issuerUrl, c.lastUsed)
+		c.authenticator.Close()
+		delete(r.authenticators, issuerUrl)
+	}
+}
+
+// Close closes the authenticators and the idle connections of the
+// transports. The JWTs resolved afterwards fail with ErrResolverClosed.
+func (r *DistributedClaimsResolver) Close() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.stop)
+	for _, c := range r.authenticators {
+		if c.authenticator != nil {
+			c.authenticator.Close()
+		}
+	}
+	r.authenticators = map[string]*cachedAuthenticator{}
+	for _, tr := range r.transports {
+		tr.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,224 @@
+// Package test_idp provides an OIDC provider serving distributed groups for
+// the tests of the servers that resolve and re-sign the tokens.
+package test_idp
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/lei-tang/dev/tests/go/group-demo-2/utils"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	ClientID    = "test-client-id"
+	AccessToken = "group_access_token"
+	// TokenServiceKeyID is the key id of the signing key of the token service
+	// in the testdata, i.e., its RFC 7638 thumbprint.
+	TokenServiceKeyID = "DHFbpoIUqrY8t2zpA2qXfCmr5VO5ZEr4RzHU_-envvQ"
+
+	OidcConfig = `{
+	  "issuer": "{{.ISSUER_URL}}",
+	  "jwks_uri": "{{.ISSUER_URL}}/jwks"
+	}`
+
+	DistributedClaims = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "username": "test-user-name",
+	  "_claim_names": {
+	    "groups": "group_source_1"
+	  },
+	  "_claim_sources": {
+	    "group_source_1": {
+	      "endpoint": "{{.ISSUER_URL}}/groups",
+	      "access_token": "group_access_token"
+	    }
+	  },
+	  "exp": 10413792000
+	}`
+
+	// WrongAccessToken are distributed claims whose access token is rejected
+	// by the claim endpoint.
+	WrongAccessToken = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "username": "test-user-name",
+	  "_claim_names": {
+	    "groups": "group_source_1"
+	  },
+	  "_claim_sources": {
+	    "group_source_1": {
+	      "endpoint": "{{.ISSUER_URL}}/groups",
+	      "access_token": "wrong_access_token"
+	    }
+	  },
+	  "exp": 10413792000
+	}`
+
+	GroupResp = `{
+	  "iss": "{{.ISSUER_URL}}",
+	  "aud": "test-client-id",
+	  "groups": ["group1", "group2"],
+	  "exp": 10413792000
+	}`
+)
+
+// Idp is an OIDC provider serving distributed groups, like the
+// NewOidcTestServer of the oidc_server command.
+type Idp struct {
+	Server *httptest.Server
+	// Signer signs with the key published by the provider.
+	Signer jose.Signer
+	// CAFile is the path to the CA certificate of the provider.
+	CAFile string
+}
+
+// New starts a provider signing with the oidc_server key of the testdata.
+// The provider must be closed by the caller.
+func New(tb testing.TB) *Idp {
+	privKey, err := utils.LoadJSONWebPrivateKeyFromFile(testdataPath("oidc_server_signing_key.pem"), jose.RS256)
+	if err != nil {
+		tb.Fatalf("Failed to load private key from file: %v", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: privKey}, nil)
+	if err != nil {
+		tb.Fatalf("Failed to create a signer: %v", err)
+	}
+	idp := &Idp{Signer: signer}
+	jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{privKey.Public()}}
+
+	// The handler runs outside of the test goroutine, so it fails the
+	// requests instead of the test.
+	idp.Server = httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			config, err := idp.render(OidcConfig)
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Header().Set("Content-Type", "application/json")
+			resp.Write([]byte(config))
+		case "/jwks":
+			resp.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(resp).Encode(jwks)
+		case "/groups":
+			if req.Header.Get("Authorization") != fmt.Sprintf("Bearer %v", AccessToken) {
+				resp.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			jwt, err := utils.CreateTestJwt(GroupResp, idp.Server.URL, signer)
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Write([]byte(jwt))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	caFile, err := ioutil.TempFile("", "temp_ca.cert")
+	if err != nil {
+		idp.Server.Close()
+		tb.Fatalf("Failed to create a temporary file: %v", err)
+	}
+	defer caFile.Close()
+	idp.CAFile = caFile.Name()
+	pemBlock := &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: idp.Server.TLS.Certificates[0].Certificate[0],
+	}
+	if err := pem.Encode(caFile, pemBlock); err != nil {
+		idp.Close()
+		tb.Fatalf("Failed to encode the CA certificate: %v", err)
+	}
+	return idp
+}
+
+// Close stops the provider and removes its CA certificate.
+func (idp *Idp) Close() {
+	idp.Server.Close()
+	os.Remove(idp.CAFile)
+}
+
+// TrustedIssuers returns the trusted issuers holding the provider.
+func (idp *Idp) TrustedIssuers(tb testing.TB) utils.TrustedIssuers {
+	trustedIssuers, err := utils.ParseTrustedIssuers(idp.Server.URL, idp.CAFile)
+	if err != nil {
+		tb.Fatalf("Failed to parse the trusted issuers: %v", err)
+	}
+	return trustedIssuers
+}
+
+// Render fills in the issuer URL of the provider in tpl.
+func (idp *Idp) Render(tb testing.TB, tpl string) string {
+	s, err := idp.render(tpl)
+	if err != nil {
+		tb.Fatalf("Failed to render the template: %v", err)
+	}
+	return s
+}
+
+func (idp *Idp) render(tpl string) (string, error) {
+	return utils.ReplaceValueInTemplate(tpl, &struct{ ISSUER_URL string }{ISSUER_URL: idp.Server.URL})
+}
+
+// Sign fills in issuerURL in the claim template tpl and signs it with signer.
+func (idp *Idp) Sign(tb testing.TB, signer jose.Signer, issuerURL, tpl string) string {
+	jwt, err := utils.CreateTestJwt(tpl, issuerURL, signer)
+	if err != nil {
+		tb.Fatalf("Failed to create a test JWT: %v", err)
+	}
+	return jwt
+}
+
+// VerifyResigned verifies the signature of a re-signed token with the key of
+// the token service published in the JWKS of the testdata, and returns its
+// claims.
+func VerifyResigned(tb testing.TB, jwt string) map[string]json.RawMessage {
+	var jwks jose.JSONWebKeySet
+	data, err := ioutil.ReadFile(testdataPath("token_service_signing_key_jwks.json"))
+	if err != nil {
+		tb.Fatalf("Failed to read the JWKS of the token service: %v", err)
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		tb.Fatalf("Failed to parse the JWKS of the token service: %v", err)
+	}
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		tb.Fatalf("Failed to parse the re-signed token: %v", err)
+	}
+	if kid := jws.Signatures[0].Header.KeyID; kid != TokenServiceKeyID {
+		tb.Errorf("re-signed token kid = %q, want %q", kid, TokenServiceKeyID)
+	}
+	keys := jwks.Key(TokenServiceKeyID)
+	if len(keys) != 1 {
+		tb.Fatalf("JWKS of the token service has %v keys of kid %q, want 1", len(keys), TokenServiceKeyID)
+	}
+	payload, err := jws.Verify(keys[0].Key)
+	if err != nil {
+		tb.Fatalf("Failed to verify the re-signed token: %v", err)
+	}
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		tb.Fatalf("Failed to parse the claims of the re-signed token: %v", err)
+	}
+	return claims
+}
+
+// testdataPath returns the path to a file of the testdata, which does not
+// depend on the directory of the test.
+func testdataPath(name string) string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "testdata", name)
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// TrustedIssuer is an issuer whose JWTs may be resolved.
+type TrustedIssuer struct {
+	// Pattern matches the issuer URL (the "iss" claim), e.g.,
+	// "https://login.example.com" or "https://*.example.com". The scheme, the
+	// host name, the port and the path of the URL are matched separately,
+	// using the syntax of path.Match. A wildcard of the host name matches
+	// within a label, and a wildcard of the path within a segment.
+	Pattern string `json:"pattern"`
+	// CAFile is the path to the root CA certificate of the issuer. If empty,
+	// the host's root CA set is used.
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// TrustedIssuers is the list of the issuers whose JWTs may be resolved.
+// JWTs of other issuers are rejected before any network I/O.
+type TrustedIssuers []TrustedIssuer
+
+// Match returns the first trusted issuer whose pattern matches iss. An
+// issuer with a user info, a query or a fragment matches no pattern.
+func (t TrustedIssuers) Match(iss string) (TrustedIssuer, bool) {
+	// An empty query or fragment is not kept by url.Parse
+	if strings.ContainsAny(iss, "@?#") {
+		return TrustedIssuer{}, false
+	}
+	u, err := url.Parse(iss)
+	if err != nil || u.Opaque != "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" ||
+		u.Hostname() == "" {
+		return TrustedIssuer{}, false
+	}
+	for _, ti := range t {
+		p, err := parseIssuerPattern(ti.Pattern)
+		if err == nil && p.match(u) {
+			return ti, true
+		}
+	}
+	return TrustedIssuer{}, false
+}
+
+// issuerPattern is a pattern of an issuer URL, split into the parts that are
+// matched separately.
+type issuerPattern struct {
+	scheme   string
+	hostname string
+	port     string
+	path     string
+}
+
+// parseIssuerPattern splits a pattern of the form scheme://hostname[:port][/path].
+// The pattern can't be parsed by url.Parse, which rejects a wildcard port.
+func parseIssuerPattern(pattern string) (*issuerPattern, error) {
+	i := strings.Index(pattern, "://")
+	if i <= 0 {
+		return nil, fmt.Errorf("the pattern has no scheme")
+	}
+	p := &issuerPattern{scheme: strings.ToLower(pattern[:i])}
+	host := pattern[i+len("://"):]
+	if strings.ContainsAny(host, "@?#") {
+		return nil, fmt.Errorf("the pattern has a user info, a query or a fragment")
+	}
+	if j := strings.Index(host, "/"); j >= 0 {
+		host, p.path = host[:j], host[j:]
+	}
+	if strings.HasPrefix(host, "[") {
+		// An IPv6 address
+		j := strings.Index(host, "]")
+		if j < 0 {
+			return nil, fmt.Errorf("the pattern has an invalid host")
+		}
+		p.hostname, host = host[1:j], host[j+1:]
+		if host != "" && !strings.HasPrefix(host, ":") {
+			return nil, fmt.Errorf("the pattern has an invalid host")
+		}
+		p.port = strings.TrimPrefix(host, ":")
+	} else if j := strings.LastIndex(host, ":"); j >= 0 {
+		p.hostname, p.port = host[:j], host[j+1:]
+	} else {
+		p.hostname = host
+	}
+	p.hostname = strings.ToLower(p.hostname)
+	if p.hostname == "" {
+		return nil, fmt.Errorf("the pattern has no host")
+	}
+	for _, part := range []string{p.scheme, p.hostname, p.port, p.path} {
+		if _, err := path.Match(part, ""); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// issuerURL returns the only issuer URL the pattern matches, if it has no
+// wildcard.
+func (p *issuerPattern) issuerURL() (string, bool) {
+	for _, part := range []string{p.scheme, p.hostname, p.port, p.path} {
+		if strings.ContainsAny(part, `*?[\`) {
+			return "", false
+		}
+	}
+	host := p.hostname
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if p.port != "" {
+		host += ":" + p.port
+	}
+	return p.scheme + "://" + host + p.path, true
+}
+
+// match reports whether the pattern matches the parsed issuer URL.
+func (p *issuerPattern) match(u *url.URL) bool {
+	if ok, _ := path.Match(p.scheme, strings.ToLower(u.Scheme)); !ok {
+		return false
+	}
+	// Each label of the host name is matched separately, so that a wildcard
+	// can't span a "."
+	patternLabels := strings.Split(p.hostname, ".")
+	labels := strings.Split(strings.ToLower(u.Hostname()), ".")
+	if len(patternLabels) != len(labels) {
+		return false
+	}
+	for i := range labels {
+		if ok, _ := path.Match(patternLabels[i], labels[i]); !ok {
+			return false
+		}
+	}
+	if ok, _ := path.Match(p.port, u.Port()); !ok {
+		return false
+	}
+	// A wildcard of path.Match never spans a "/", nor an escaped "/", which
+	// is unescaped in u.Path
+	ok, _ := path.Match(p.path, u.Path)
+	return ok
+}
+
+// ParseTrustedIssuers creates the trusted issuers from comma-separated issuer
+// patterns that share the same root CA certificate.
+// patterns: comma-separated issuer patterns, e.g., "https://a.com,https://*.b.com"
+// caFile: the path to the root CA certificate, may be empty
+func ParseTrustedIssuers(patterns, caFile string) (TrustedIssuers, error) {
+	var t TrustedIssuers
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := parseIssuerPattern(p); err != nil {
+			return nil, fmt.Errorf("Invalid trusted issuer pattern %q: %v", p, err)
+		}
+		t = append(t, TrustedIssuer{Pattern: p, CAFile: caFile})
+	}
+	return t, nil
+}
+
+// LoadTrustedIssuersFromFile reads the trusted issuers from a JSON file of the
+// form:
+//
+//	[
+//	  {"pattern": "https://login.example.com", "caFile": "/etc/ca/example.pem"},
+//	  {"pattern": "https://*.corp.example.com"}
+//	]
+func LoadTrustedIssuersFromFile(filePath string) (TrustedIssuers, error) {
+	d, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		glog.Errorf("Failed to read trusted issuers file: %v", err)
+		return nil, err
+	}
+	var t TrustedIssuers
+	if err := json.Unmarshal(d, &t); err != nil {
+		return nil, fmt.Errorf("Fail to parse trusted issuers file %v: %v", filePath, err)
+	}
+	for _, ti := range t {
+		if _, err := parseIssuerPattern(ti.Pattern); err != nil {
+			return nil, fmt.Errorf("Invalid trusted issuer pattern %q in %v: %v", ti.Pattern, filePath, err)
+		}
+	}
+	return t, nil
+}
@@ -2,25 +2,38 @@ package utils
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/x509"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/golang/glog"
 	"gopkg.in/square/go-jose.v2"
-	"io/ioutil"
 	"k8s.io/apiserver/pkg/authentication/user"
-	"strings"
+	"time"
 
 	// The New(opts Options) interface in the original oidc library
 	// will wait 10 seconds before initializing the verifier.
 	oidc "github.com/lei-tang/dev/tests/go/group-demo-2/oidc_library"
+	"github.com/lei-tang/dev/tests/go/group-demo-2/unverified_jwt"
 	"text/template"
 )
 
+//ErrNoDistributedClaims is returned when a JWT has none of the distributed
+//claims to resolve.
+var ErrNoDistributedClaims = errors.New("There is no distributed claim in the JWT")
+
+//SigningAlgs are the signing algorithms of the JWTs, and of the JWTs of the
+//distributed claims, that the authenticators accept. The keys of the issuers
+//decide which of them verify.
+var SigningAlgs = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "PS384", "PS512",
+	oidc.EdDSA}
+
+//verifierWaitTimeout is how long an authenticator waits for the verifiers of
+//the issuer and of the claim issuers.
+const verifierWaitTimeout = 30 * time.Second
+
 //CreateGroupAuthenticator() creates an OIDC authenticator for a distributed group
 //claim.
 //issuerUrl: the issuer for the JWT token
@@ -37,57 +50,59 @@ import (
 //	pubKeys []*jose.JSONWebKey) (*oidc.Authenticator, error) {
 func CreateGroupAuthenticator(issuerUrl, clientId, groupsClaim, groupsPrefix, userNameClaim,
 	rootCaFilePath string, requiredClaims map[string]string) (*oidc.Authenticator, error) {
-	//This is needed to avoid the error of "verifier not initialized for issuer"
-	oidc.SetSynchronizeTokenIDVerifier(true)
-	options := oidc.Options{
-		IssuerURL:      issuerUrl,
-		ClientID:       clientId,
-		GroupsClaim:    groupsClaim,
-		GroupsPrefix:   groupsPrefix,
-		UsernameClaim:  userNameClaim,
-		CAFile:         rootCaFilePath,
-		RequiredClaims: requiredClaims,
-	}
-
-	authenticator, err := oidc.NewAuthenticatorWithIssuerURL(options)
-	if err != nil {
-		glog.Errorf("Failed to create an oidc authenticator: %v", err)
-		return nil, err
-	}
+	return CreateClaimsAuthenticator(issuerUrl, clientId, nil, groupsClaim, groupsPrefix, userNameClaim,
+		rootCaFilePath, requiredClaims)
+}
 
-	return authenticator, nil
+//CreateClaimsAuthenticator() creates an OIDC authenticator that resolves a set of
+//distributed claims in addition to the groups claim.
+//distributedClaims: the names of the distributed claims to resolve, e.g., "roles".
+//oidc.AllDistributedClaims resolves all distributed claims in a JWT.
+//The other parameters are the same as those of CreateGroupAuthenticator().
+func CreateClaimsAuthenticator(issuerUrl, clientId string, distributedClaims []string, groupsClaim,
+	groupsPrefix, userNameClaim, rootCaFilePath string, requiredClaims map[string]string) (*oidc.Authenticator, error) {
+	return newReadyAuthenticator(claimsAuthenticatorOptions(issuerUrl, clientId, distributedClaims, groupsClaim,
+		groupsPrefix, userNameClaim, rootCaFilePath, requiredClaims))
 }
 
-// LoadJSONWebPrivateKeyFromFile creates a JSONWebKey from the private key
-// in the file.
-// path: the path to the private key file
-// alg: the signature algorithm
-func LoadJSONWebPrivateKeyFromFile(path string, alg jose.SignatureAlgorithm) (*jose.JSONWebKey, error) {
-	d, err := ioutil.ReadFile(path)
-	if err != nil {
-		glog.Errorf("Failed to read key file: %v", err)
-		return nil, err
-	}
-	p, _ := pem.Decode(d)
-	if p == nil {
-		glog.Errorf("Failed to decode the PEM file.")
-		return nil, fmt.Errorf("Failed to decode the PEM file.")
+//claimsAuthenticatorOptions() returns the options of the authenticator created
+//by CreateClaimsAuthenticator().
+func claimsAuthenticatorOptions(issuerUrl, clientId string, distributedClaims []string, groupsClaim,
+	groupsPrefix, userNameClaim, rootCaFilePath string, requiredClaims map[string]string) oidc.Options {
+	return oidc.Options{
+		IssuerURL:            issuerUrl,
+		ClientID:             clientId,
+		GroupsClaim:          groupsClaim,
+		GroupsPrefix:         groupsPrefix,
+		UsernameClaim:        userNameClaim,
+		CAFile:               rootCaFilePath,
+		DistributedClaims:    distributedClaims,
+		RequiredClaims:       requiredClaims,
+		SupportedSigningAlgs: SigningAlgs,
+		//Wait for the verifiers of the claim issuers to avoid the error of
+		//"verifier not initialized for issuer"
+		VerifierWaitTimeout: verifierWaitTimeout,
 	}
-	priv, err := x509.ParsePKCS1PrivateKey(p.Bytes)
+}
+
+//newReadyAuthenticator() creates an OIDC authenticator and waits until the
+//verifier of the issuer is initialized.
+func newReadyAuthenticator(options oidc.Options) (*oidc.Authenticator, error) {
+	authenticator, err := oidc.NewAuthenticatorWithIssuerURL(options)
 	if err != nil {
-		glog.Errorf("Failed to parse private key: %v", err)
+		glog.Errorf("Failed to create an oidc authenticator: %v", err)
 		return nil, err
 	}
-	key := &jose.JSONWebKey{Key: priv, Algorithm: string(alg)}
-	hash, err := key.Thumbprint(crypto.SHA256)
-	if err != nil {
-		glog.Errorf("Failed to compute a SHA256 hash for the key: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), verifierWaitTimeout)
+	defer cancel()
+	if err := authenticator.WaitReady(ctx); err != nil {
+		authenticator.Close()
+		glog.Errorf("The oidc authenticator is not ready: %v", err)
 		return nil, err
 	}
-	key.KeyID = hex.EncodeToString(hash)
-	return key, nil
-}
 
+	return authenticator, nil
+}
 
 func CreateTestJwt(claimJson, issuerURL string, signer jose.Signer) (string, error) {
 	value := struct{ ISSUER_URL string }{ISSUER_URL: issuerURL}
@@ -137,82 +152,155 @@ func ConvertWebKeyArrayToWebKeySet(keyArray []*jose.JSONWebKey) jose.JSONWebKeyS
 
 // Get the iss claim from a JWT
 func GetJwtIss(jwt string) (string, error) {
-	// Decoded JWT payload
-	var d []byte
-	var err error
-	s := strings.Split(jwt, ".")
-	if len(s) != 3 {
-		return "", fmt.Errorf("Invalid JWT with %v components", len(s))
-	}
-	if len(s[1]) == 0 {
-		return "", fmt.Errorf("The payload of the JWT is empty")
-	}
-	if d, err = base64.RawURLEncoding.DecodeString(s[1]); err != nil {
-		return "", fmt.Errorf("Fail to decode the JWT payload: %v", err)
-	}
-	issuer := struct {
-		Iss string `json:"iss"`
-	}{}
-	// Extract iss claim from the payload
-	if err = json.Unmarshal(d, &issuer); err != nil {
-		return "", fmt.Errorf("Fail to parse json: %v", err)
-	}
-	return issuer.Iss, nil
+	t, err := unverified_jwt.ParseUnverified(jwt)
+	if err != nil {
+		return "", err
+	}
+	return t.Issuer()
 }
 
 // Check whether the JWT contains a distributed groups claim
 func ContainDistributedGroupsClaim(jwt, groupKey string) (bool, error) {
-	// The claim key for the claims (OIDC Connect Core 1.0, section 5.6.2).
-	claimNamesKey := "_claim_names"
-	// Decoded JWT payload
-	var d []byte
-	var err error
-	s := strings.Split(jwt, ".")
-	if len(s) != 3 {
-		return false, fmt.Errorf("Invalid JWT with %v components", len(s))
-	}
-	if len(s[1]) == 0 {
-		return false, fmt.Errorf("The payload of the JWT is empty")
-	}
-	if d, err = base64.RawURLEncoding.DecodeString(s[1]); err != nil {
-		return false, fmt.Errorf("Fail to on to decode JWT payload: %v", err)
-	}
+	return ContainDistributedClaims(jwt, []string{groupKey})
+}
 
-	m := map[string]json.RawMessage{}
-	if err := json.Unmarshal(d, &m); err != nil {
-		return false, fmt.Errorf("Fail to unmarshal the JWT: %v", err)
-	}
-	if _, ok := m[claimNamesKey]; !ok {
-		return false, nil
+// Check whether the JWT contains any of the distributed claims
+// jwt: the JWT to check
+// claimNames: the names of the distributed claims. oidc.AllDistributedClaims
+// matches any distributed claim.
+func ContainDistributedClaims(jwt string, claimNames []string) (bool, error) {
+	t, err := unverified_jwt.ParseUnverified(jwt)
+	if err != nil {
+		return false, err
 	}
+	return containDistributedClaims(t, claimNames)
+}
 
-	claims := map[string]json.RawMessage{}
-	if err := json.Unmarshal(m[claimNamesKey], &claims); err != nil {
-		return false, fmt.Errorf("Fail to unmarshal %v: %v", claimNamesKey, err)
+func containDistributedClaims(t *unverified_jwt.Token, claimNames []string) (bool, error) {
+	d, err := t.DistributedClaims()
+	if err != nil {
+		return false, err
 	}
-	if _, ok := claims[groupKey]; !ok {
-		return false, nil
-	} else {
-		return true, nil
+	for _, name := range claimNames {
+		if d.Has(name) || (name == oidc.AllDistributedClaims && d != nil && len(d.Names) > 0) {
+			return true, nil
+		}
 	}
+	return false, nil
 }
 
+// NewJwtSigner creates a signer whose signatures have the protected headers
+// "kid", the key id of key, and "typ" JWT.
+// key: the private key, whose Algorithm is the signature algorithm
+func NewJwtSigner(key *jose.JSONWebKey) (jose.Signer, error) {
+	if len(key.KeyID) == 0 {
+		return nil, fmt.Errorf("The signing key has no key id.")
+	}
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	return jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(key.Algorithm), Key: key}, opts)
+}
+
+// JwtOptions are the options of a JWT re-issued by CreateJwtWithOptions.
+// The zero value keeps the iat, exp, aud and jti of the claims.
+type JwtOptions struct {
+	// Issuer is the iss of the JWT.
+	Issuer string
+	// Audience, if not empty, replaces the aud of the claims.
+	Audience []string
+	// MaxLifetime, if positive, caps the exp of the JWT at MaxLifetime from
+	// now. The exp is never after the exp of the claims.
+	MaxLifetime time.Duration
+	// ResetIssuedAt sets the iat and the nbf of the JWT to now.
+	ResetIssuedAt bool
+	// NewID sets a fresh random jti.
+	NewID bool
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
 
 // Create a JWT from the claims
-// issuer: issuer for the JWT
+// issuer: the JSON encoded issuer for the JWT
 // signer: the signer for the JWT
 // claims: the claims in the JWT
 func CreateJwtWithClaims(issuer string, signer jose.Signer, claims map[string]json.RawMessage) (string, error) {
-	// Set the issuer
-	if _,ok := claims["iss"]; ok {
-		claims["iss"] = []byte(issuer)
-	} else {
-		return "", fmt.Errorf("No issuer in the claims.")
+	var iss string
+	if err := json.Unmarshal([]byte(issuer), &iss); err != nil {
+		return "", fmt.Errorf("Invalid issuer %v: %v", issuer, err)
 	}
+	return CreateJwtWithOptions(signer, claims, JwtOptions{Issuer: iss})
+}
+
+// Create a JWT from the claims, re-issued according to the options. The claims
+// are updated in place to the claims of the JWT.
+// signer: the signer for the JWT, e.g., of NewJwtSigner() or of a signer backend
+// claims: the claims in the JWT
+// opts: the issuer, audience, lifetime and id of the JWT
+func CreateJwtWithOptions(signer jose.Signer, claims map[string]json.RawMessage, opts JwtOptions) (string, error) {
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	issuedAt := now().Unix()
+	set := func(name string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("Failed to encode the %v claim: %v", name, err)
+		}
+		claims[name] = b
+		return nil
+	}
+
+	if err := set("iss", opts.Issuer); err != nil {
+		return "", err
+	}
+	switch len(opts.Audience) {
+	case 0:
+	case 1:
+		if err := set("aud", opts.Audience[0]); err != nil {
+			return "", err
+		}
+	default:
+		if err := set("aud", opts.Audience); err != nil {
+			return "", err
+		}
+	}
+	if opts.MaxLifetime > 0 {
+		exp := issuedAt + int64(opts.MaxLifetime/time.Second)
+		if raw, ok := claims["exp"]; ok {
+			var sourceExp float64
+			if err := json.Unmarshal(raw, &sourceExp); err != nil {
+				return "", &oidc.InvalidClaimError{Claim: "exp", Err: err}
+			}
+			if int64(sourceExp) < exp {
+				exp = int64(sourceExp)
+			}
+		}
+		if err := set("exp", exp); err != nil {
+			return "", err
+		}
+	}
+	if opts.ResetIssuedAt {
+		if err := set("iat", issuedAt); err != nil {
+			return "", err
+		}
+		if err := set("nbf", issuedAt); err != nil {
+			return "", err
+		}
+	}
+	if opts.NewID {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return "", fmt.Errorf("Failed to generate a jti: %v", err)
+		}
+		if err := set("jti", base64.RawURLEncoding.EncodeToString(id)); err != nil {
+			return "", err
+		}
+	}
+
 	jwtByte, err := json.Marshal(claims)
 	if err != nil {
 		glog.Errorf("Failed to convert claims to JSON: %v", err)
-		return "", nil
+		return "", err
 	}
 	// Sign the resolved JWT
 	signed, err := signer.Sign(jwtByte)
@@ -229,36 +317,58 @@ func CreateJwtWithClaims(issuer string, signer jose.Signer, claims map[string]js
 	return jwt, nil
 }
 
-
 // Resolve the distributed group claim in a JWT
 // clientId: oidc client id
 // groupClaimName: the name of the distributed group claim
 // groupPrefixToAdd: the prefix to be added to a resolved distributed group claim value
 // userNameClaimName: the name of the user name claim (e.g., email, username, etc)
-// tlsCertPath: the path to the TLS certificate of the OIDC server
+// trustedIssuers: the issuers whose JWTs may be resolved and their root CA certificates
 // jwt: the JWT to resolve
+// An authenticator of the issuer is created and closed for every JWT, so a
+// long-running service should use a DistributedClaimsResolver instead.
 func ResolveDistributedGroupToken(clientId, groupClaimName, groupPrefixToAdd,
-     userNameClaimName, tlsCertPath, jwt string) (user.Info, map[string]json.RawMessage, error) {
+	userNameClaimName string, trustedIssuers TrustedIssuers, jwt string) (user.Info, map[string]json.RawMessage, error) {
 	glog.V(5).Infof("Enter ResolveDistributedGroupToken")
+	return ResolveDistributedClaimsToken(clientId, []string{groupClaimName}, groupClaimName,
+		groupPrefixToAdd, userNameClaimName, trustedIssuers, jwt)
+}
 
-	// Check whether the JWT contains a distributed groups claim
-	// If not, no need to resolve the distributed groups claim
-	containDistGroupClaim, err := ContainDistributedGroupsClaim(jwt, "groups")
+// Resolve a set of distributed claims in a JWT
+// clientId: oidc client id
+// distributedClaims: the names of the distributed claims to resolve.
+// oidc.AllDistributedClaims resolves all distributed claims in the JWT.
+// groupClaimName: the name of the group claim, may be empty
+// groupPrefixToAdd: the prefix to be added to a resolved distributed group claim value
+// userNameClaimName: the name of the user name claim (e.g., email, username, etc)
+// trustedIssuers: the issuers whose JWTs may be resolved and their root CA certificates.
+// A JWT of another issuer is rejected before any network I/O.
+// jwt: the JWT to resolve
+// Like ResolveDistributedGroupToken, it creates an authenticator per JWT.
+func ResolveDistributedClaimsToken(clientId string, distributedClaims []string, groupClaimName,
+	groupPrefixToAdd, userNameClaimName string, trustedIssuers TrustedIssuers,
+	jwt string) (user.Info, map[string]json.RawMessage, error) {
+	glog.V(5).Infof("Enter ResolveDistributedClaimsToken")
+	t, err := unverified_jwt.ParseUnverified(jwt)
 	if err != nil {
 		return nil, nil, err
 	}
-	if !containDistGroupClaim {
-		return nil, nil, fmt.Errorf("There is no distributed groups claim in the JWT")
-	}
+	return ResolveDistributedClaimsParsedToken(clientId, distributedClaims, groupClaimName, groupPrefixToAdd,
+		userNameClaimName, trustedIssuers, t)
+}
 
-	// Parse the JWT issuer
-	issuerUrl, err := GetJwtIss(jwt)
+// Resolve a set of distributed claims in a JWT already parsed with
+// unverified_jwt.ParseUnverified, so that it is not parsed again. The
+// parameters are those of ResolveDistributedClaimsToken.
+func ResolveDistributedClaimsParsedToken(clientId string, distributedClaims []string, groupClaimName,
+	groupPrefixToAdd, userNameClaimName string, trustedIssuers TrustedIssuers,
+	t *unverified_jwt.Token) (user.Info, map[string]json.RawMessage, error) {
+	issuerUrl, trustedIssuer, err := matchTrustedIssuer(distributedClaims, trustedIssuers, t)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	authenticator, err := CreateGroupAuthenticator(issuerUrl, clientId,
-		groupClaimName, groupPrefixToAdd, userNameClaimName, tlsCertPath, map[string]string{})
+	authenticator, err := CreateClaimsAuthenticator(issuerUrl, clientId, distributedClaims,
+		groupClaimName, groupPrefixToAdd, userNameClaimName, trustedIssuer.CAFile, map[string]string{})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -266,13 +376,51 @@ func ResolveDistributedGroupToken(clientId, groupClaimName, groupPrefixToAdd,
 	// Close the authenticator
 	defer authenticator.Close()
 
-	// Authenticate the group JWT token and return the resolved group info
-	userInfo, claims, verified, err := authenticator.AuthenticateToken(jwt)
+	return authenticateParsedToken(context.Background(), authenticator, t)
+}
+
+// Check that a JWT has a distributed claim to resolve and that its issuer is
+// trusted, and return the issuer, which is not verified yet.
+func matchTrustedIssuer(distributedClaims []string, trustedIssuers TrustedIssuers,
+	t *unverified_jwt.Token) (string, TrustedIssuer, error) {
+	// Check whether the JWT contains a distributed claim to resolve
+	// If not, no need to resolve the distributed claims
+	containDistClaim, err := containDistributedClaims(t, distributedClaims)
+	if err != nil {
+		return "", TrustedIssuer{}, err
+	}
+	if !containDistClaim {
+		return "", TrustedIssuer{}, fmt.Errorf("%w: %v", ErrNoDistributedClaims, distributedClaims)
+	}
+	return trustedIssuerOf(trustedIssuers, t)
+}
+
+// Check that the issuer of a JWT is trusted, and return the issuer, which is
+// not verified yet.
+func trustedIssuerOf(trustedIssuers TrustedIssuers, t *unverified_jwt.Token) (string, TrustedIssuer, error) {
+	// Parse the JWT issuer, which is not verified yet
+	issuerUrl, err := t.Issuer()
+	if err != nil {
+		return "", TrustedIssuer{}, err
+	}
+	// Only contact the issuer if it is trusted
+	trustedIssuer, ok := trustedIssuers.Match(issuerUrl)
+	if !ok {
+		return "", TrustedIssuer{}, &oidc.UntrustedIssuerError{Issuer: issuerUrl}
+	}
+	return issuerUrl, trustedIssuer, nil
+}
+
+// Authenticate a JWT and return the resolved user info and claims. ctx bounds
+// the requests of the distributed claims.
+func authenticateParsedToken(ctx context.Context, authenticator *oidc.Authenticator,
+	t *unverified_jwt.Token) (user.Info, map[string]json.RawMessage, error) {
+	userInfo, claims, verified, err := authenticator.AuthenticateParsedToken(ctx, t)
 	if err != nil {
 		return nil, nil, err
 	}
 	if !verified {
-		return nil, nil, fmt.Errorf("The JWT failed to pass the authentication.")
+		return nil, nil, fmt.Errorf("%w: The JWT failed to pass the authentication.", oidc.ErrWrongIssuer)
 	}
 	return userInfo, claims, nil
 }
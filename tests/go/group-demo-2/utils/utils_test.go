@@ -0,0 +1,902 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	oidc "github.com/lei-tang/dev/tests/go/group-demo-2/oidc_library"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const testDistributedGroupsClaims = `{
+  "iss": "{{.ISSUER_URL}}",
+  "aud": "test-client-id",
+  "username": "test-user-name",
+  "_claim_names": {
+    "groups": "group_source_1"
+  },
+  "_claim_sources": {
+    "group_source_1": {
+      "endpoint": "{{.ISSUER_URL}}/groups",
+      "access_token": "group_access_token"
+    }
+  },
+  "exp": 10413792000
+}`
+
+// newTestSigner creates a signer with a freshly generated RSA key.
+func newTestSigner(t *testing.T) jose.Signer {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: priv}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	return signer
+}
+
+func TestTrustedIssuersMatch(t *testing.T) {
+	trusted, err := ParseTrustedIssuers("https://login.example.com, https://*.corp.example.com,https://127.0.0.1:*,"+
+		"https://tenants.example.com/tenants/*", "ca.pem")
+	if err != nil {
+		t.Fatalf("ParseTrustedIssuers() failed: %v", err)
+	}
+
+	testCases := []struct {
+		iss  string
+		want bool
+	}{
+		{iss: "https://login.example.com", want: true},
+		{iss: "https://a.corp.example.com", want: true},
+		{iss: "https://127.0.0.1:34445", want: true},
+		{iss: "https://login.example.com.evil.com", want: false},
+		{iss: "https://a.corp.example.com/path", want: false},
+		{iss: "http://login.example.com", want: false},
+		{iss: "https://example.com", want: false},
+		{iss: "", want: false},
+		{iss: "https://LOGIN.example.com", want: true},
+		{iss: "https://tenants.example.com/tenants/a", want: true},
+		// The user info, the query and the fragment can't hide the host
+		{iss: "https://127.0.0.1:1@evil.com", want: false},
+		{iss: "https://login.example.com@evil.com", want: false},
+		{iss: "https://attacker.com?.corp.example.com", want: false},
+		{iss: "https://attacker.com#.corp.example.com", want: false},
+		{iss: "https://login.example.com?", want: false},
+		{iss: "https://login.example.com#", want: false},
+		// A wildcard doesn't span a "." or a "/"
+		{iss: "https://a.b.corp.example.com", want: false},
+		{iss: "https://evil.com/.corp.example.com", want: false},
+		{iss: "https://127.0.0.1:34445/path", want: false},
+		{iss: "https://tenants.example.com/tenants/a/b", want: false},
+		{iss: "https://tenants.example.com/tenants/a%2Fb", want: false},
+	}
+	for _, tc := range testCases {
+		ti, ok := trusted.Match(tc.iss)
+		if ok != tc.want {
+			t.Errorf("Match(%q) = %v, want %v", tc.iss, ok, tc.want)
+		}
+		if ok && ti.CAFile != "ca.pem" {
+			t.Errorf("Match(%q) returned CA file %q, want ca.pem", tc.iss, ti.CAFile)
+		}
+	}
+
+	for _, pattern := range []string{"https://[", "login.example.com", "https://", "https://a@login.example.com",
+		"https://*.example.com?", "https://*.example.com#"} {
+		if _, err := ParseTrustedIssuers(pattern, ""); err == nil {
+			t.Errorf("ParseTrustedIssuers(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestLoadTrustedIssuersFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "trusted_issuers.json")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"pattern": "https://a.example.com", "caFile": "a.pem"}, {"pattern": "https://*.b.example.com"}]`)
+	f.Close()
+
+	trusted, err := LoadTrustedIssuersFromFile(f.Name())
+	if err != nil {
+		t.Fatalf("LoadTrustedIssuersFromFile() failed: %v", err)
+	}
+	if ti, ok := trusted.Match("https://a.example.com"); !ok || ti.CAFile != "a.pem" {
+		t.Errorf("Match() = %+v, %v; want the issuer with CA file a.pem", ti, ok)
+	}
+	if ti, ok := trusted.Match("https://x.b.example.com"); !ok || ti.CAFile != "" {
+		t.Errorf("Match() = %+v, %v; want the issuer without a CA file", ti, ok)
+	}
+}
+
+func TestResolveDistributedGroupTokenUntrustedIssuer(t *testing.T) {
+	var requests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		resp.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	jwt, err := CreateTestJwt(testDistributedGroupsClaims, server.URL, newTestSigner(t))
+	if err != nil {
+		t.Fatalf("Failed to create a test JWT: %v", err)
+	}
+
+	for _, trusted := range []TrustedIssuers{
+		nil,
+		{{Pattern: "https://login.example.com"}},
+	} {
+		_, _, err := ResolveDistributedGroupToken("test-client-id", "groups", "", "username", trusted, jwt)
+		var untrustedErr *oidc.UntrustedIssuerError
+		if !errors.Is(err, oidc.ErrUntrustedIssuer) || !errors.As(err, &untrustedErr) || untrustedErr.Issuer != server.URL {
+			t.Errorf("ResolveDistributedGroupToken() with trusted issuers %+v = %v, want %v", trusted, err, oidc.ErrUntrustedIssuer)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("the untrusted issuer received %v requests, want 0", n)
+	}
+}
+
+func TestResolveDistributedClaimsTokenErrors(t *testing.T) {
+	trusted := TrustedIssuers{{Pattern: "https://login.example.com"}}
+	noDistributedClaims, err := CreateTestJwt(`{"iss": "{{.ISSUER_URL}}", "username": "test-user-name"}`,
+		"https://login.example.com", newTestSigner(t))
+	if err != nil {
+		t.Fatalf("Failed to create a test JWT: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		jwt     string
+		wantErr error
+	}{
+		{name: "malformed JWT", jwt: "malformed.jwt", wantErr: oidc.ErrMalformedToken},
+		{name: "undecodable payload", jwt: "a.!!!.c", wantErr: oidc.ErrMalformedToken},
+		{name: "no distributed claims", jwt: noDistributedClaims, wantErr: ErrNoDistributedClaims},
+	}
+	for _, tc := range testCases {
+		_, _, err := ResolveDistributedClaimsToken("test-client-id", []string{"groups"}, "groups", "", "username",
+			trusted, tc.jwt)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%v: ResolveDistributedClaimsToken() = %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+const testGroupsResp = `{
+  "iss": "{{.ISSUER_URL}}",
+  "aud": "test-client-id",
+  "groups": ["group1", "group2"],
+  "exp": 10413792000
+}`
+
+// testIssuer is an OIDC provider serving distributed groups. It counts the
+// discovery requests, which an authenticator sends for the issuer of the JWT
+// and for the issuer of the groups JWT.
+type testIssuer struct {
+	server      *httptest.Server
+	signer      jose.Signer
+	caFile      string
+	discoveries int32
+}
+
+func newTestIssuer(tb testing.TB) *testIssuer {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tb.Fatalf("Failed to generate a key: %v", err)
+	}
+	key := jose.JSONWebKey{Key: priv, KeyID: "test-key", Algorithm: string(jose.RS256), Use: "sig"}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		tb.Fatalf("Failed to create a signer: %v", err)
+	}
+	iss := &testIssuer{signer: signer}
+	iss.server = httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			atomic.AddInt32(&iss.discoveries, 1)
+			fmt.Fprintf(resp, `{"issuer": %q, "jwks_uri": "%v/jwks"}`, iss.server.URL, iss.server.URL)
+		case "/jwks":
+			json.NewEncoder(resp).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+		case "/groups":
+			if req.Header.Get("Authorization") != "Bearer group_access_token" {
+				resp.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			jwt, err := CreateTestJwt(testGroupsResp, iss.server.URL, iss.signer)
+			if err != nil {
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			resp.Write([]byte(jwt))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	caFile, err := ioutil.TempFile("", "temp_ca.cert")
+	if err != nil {
+		tb.Fatalf("Failed to create a temporary file: %v", err)
+	}
+	defer caFile.Close()
+	pemBlock := &pem.Block{Type: "CERTIFICATE", Bytes: iss.server.TLS.Certificates[0].Certificate[0]}
+	if err := pem.Encode(caFile, pemBlock); err != nil {
+		tb.Fatalf("Failed to encode the CA certificate: %v", err)
+	}
+	iss.caFile = caFile.Name()
+	return iss
+}
+
+func (iss *testIssuer) close() {
+	iss.server.Close()
+	os.Remove(iss.caFile)
+}
+
+func (iss *testIssuer) jwt(tb testing.TB, claims string) string {
+	jwt, err := CreateTestJwt(claims, iss.server.URL, iss.signer)
+	if err != nil {
+		tb.Fatalf("Failed to create a test JWT: %v", err)
+	}
+	return jwt
+}
+
+func (iss *testIssuer) trustedIssuers() TrustedIssuers {
+	return TrustedIssuers{{Pattern: iss.server.URL, CAFile: iss.caFile}}
+}
+
+// checkGroups checks that the groups of the issuer are resolved.
+func checkGroups(tb testing.TB, claims map[string]json.RawMessage, err error) {
+	if err != nil {
+		tb.Fatalf("Failed to resolve the distributed groups: %v", err)
+	}
+	var groups []string
+	if err := json.Unmarshal(claims["groups"], &groups); err != nil ||
+		!reflect.DeepEqual(groups, []string{"group1", "group2"}) {
+		tb.Fatalf("groups = %s, want [group1 group2]", claims["groups"])
+	}
+}
+
+func TestDistributedClaimsResolver(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.close()
+	jwt := iss.jwt(t, testDistributedGroupsClaims)
+	r := NewDistributedClaimsResolver(ResolverOptions{
+		ClientID:          "test-client-id",
+		DistributedClaims: []string{"groups"},
+		GroupsClaim:       "groups",
+		UsernameClaim:     "username",
+		TrustedIssuers:    iss.trustedIssuers(),
+	})
+	defer r.Close()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	// The concurrent JWTs of an issuer wait for the same authenticator
+	var wg sync.WaitGroup
+	results := make([]struct {
+		claims map[string]json.RawMessage
+		err    error
+	}, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, results[i].claims, results[i].err = r.Resolve(context.Background(), jwt)
+		}(i)
+	}
+	wg.Wait()
+	for _, res := range results {
+		checkGroups(t, res.claims, res.err)
+	}
+	created := atomic.LoadInt32(&iss.discoveries)
+	_, claims, err := r.Resolve(context.Background(), jwt)
+	checkGroups(t, claims, err)
+	if n := atomic.LoadInt32(&iss.discoveries); n != created {
+		t.Errorf("the issuer is discovered %v times, want %v of an authenticator", n, created)
+	}
+
+	// An authenticator is evicted after the idle timeout
+	now = now.Add(DefaultAuthenticatorIdleTimeout - time.Second)
+	r.evictIdle()
+	if len(r.authenticators) != 1 {
+		t.Errorf("the authenticator is evicted before the idle timeout")
+	}
+	now = now.Add(time.Second)
+	r.evictIdle()
+	if len(r.authenticators) != 0 {
+		t.Errorf("the authenticator is not evicted after the idle timeout")
+	}
+	_, claims, err = r.Resolve(context.Background(), jwt)
+	checkGroups(t, claims, err)
+	if n := atomic.LoadInt32(&iss.discoveries); n != 2*created {
+		t.Errorf("the issuer is discovered %v times, want %v of two authenticators", n, 2*created)
+	}
+
+	r.Close()
+	if _, _, err := r.Resolve(context.Background(), jwt); !errors.Is(err, ErrResolverClosed) {
+		t.Errorf("Resolve() of a closed resolver = %v, want %v", err, ErrResolverClosed)
+	}
+}
+
+func TestDistributedClaimsResolverErrors(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.close()
+	r := NewDistributedClaimsResolver(ResolverOptions{
+		ClientID:          "test-client-id",
+		DistributedClaims: []string{"groups"},
+		GroupsClaim:       "groups",
+		UsernameClaim:     "username",
+		TrustedIssuers:    TrustedIssuers{{Pattern: "https://login.example.com"}},
+	})
+	defer r.Close()
+
+	testCases := []struct {
+		name    string
+		jwt     string
+		wantErr error
+	}{
+		{name: "malformed JWT", jwt: "malformed.jwt", wantErr: oidc.ErrMalformedToken},
+		{name: "no distributed claims", jwt: iss.jwt(t, `{"iss": "{{.ISSUER_URL}}", "username": "test-user-name"}`),
+			wantErr: ErrNoDistributedClaims},
+		{name: "untrusted issuer", jwt: iss.jwt(t, testDistributedGroupsClaims), wantErr: oidc.ErrUntrustedIssuer},
+	}
+	for _, tc := range testCases {
+		if _, _, err := r.Resolve(context.Background(), tc.jwt); !errors.Is(err, tc.wantErr) {
+			t.Errorf("%v: Resolve() = %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+	if n := atomic.LoadInt32(&iss.discoveries); n != 0 || len(r.authenticators) != 0 {
+		t.Errorf("the issuer is discovered %v times, want 0", n)
+	}
+}
+
+func TestDistributedClaimsResolverShortIdleTimeout(t *testing.T) {
+	// The eviction interval of a tiny IdleTimeout must not panic
+	r := NewDistributedClaimsResolver(ResolverOptions{ClientID: "test-client-id", IdleTimeout: time.Nanosecond})
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+}
+
+func TestDistributedClaimsResolverWarmUp(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.close()
+	unreachable := "https://127.0.0.1:1"
+	newResolver := func(trusted TrustedIssuers) *DistributedClaimsResolver {
+		return NewDistributedClaimsResolver(ResolverOptions{
+			ClientID:          "test-client-id",
+			DistributedClaims: []string{"groups"},
+			GroupsClaim:       "groups",
+			UsernameClaim:     "username",
+			// The authenticators of the patterns with a wildcard are not warmed up
+			TrustedIssuers: append(trusted, TrustedIssuer{Pattern: "https://*.example.com"}),
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	r := newResolver(iss.trustedIssuers())
+	defer r.Close()
+	if err := r.Check(nil); err != nil {
+		t.Errorf("Check() before WarmUp() = %v, want ready", err)
+	}
+	r.WarmUp()
+	if err := r.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady() failed: %v", err)
+	}
+	if err := r.Check(nil); err != nil {
+		t.Errorf("Check() after the warm-up = %v, want ready", err)
+	}
+	warm, ok := r.authenticators[iss.server.URL]
+	if !ok || len(r.authenticators) != 1 || atomic.LoadInt32(&iss.discoveries) == 0 {
+		t.Fatalf("the warm-up created %v authenticators, want the authenticator of %v",
+			len(r.authenticators), iss.server.URL)
+	}
+	_, claims, err := r.Resolve(ctx, iss.jwt(t, testDistributedGroupsClaims))
+	checkGroups(t, claims, err)
+	if r.authenticators[iss.server.URL] != warm {
+		t.Errorf("the JWT is not resolved by the authenticator of the warm-up")
+	}
+	r.Close()
+	if err := r.Check(nil); !errors.Is(err, ErrResolverClosed) {
+		t.Errorf("Check() of a closed resolver = %v, want %v", err, ErrResolverClosed)
+	}
+
+	r = newResolver(TrustedIssuers{{Pattern: unreachable}})
+	defer r.Close()
+	r.WarmUp()
+	if err := r.Check(nil); !errors.Is(err, oidc.ErrVerifierNotReady) || !strings.Contains(err.Error(), unreachable) {
+		t.Errorf("Check() while %v is discovered = %v, want %v", unreachable, err, oidc.ErrVerifierNotReady)
+	}
+	// A JWT does not wait for the discovery beyond its context
+	jwt, err := CreateTestJwt(testDistributedGroupsClaims, unreachable, iss.signer)
+	if err != nil {
+		t.Fatalf("Failed to create a test JWT: %v", err)
+	}
+	shortCtx, shortCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer shortCancel()
+	if _, _, err := r.Resolve(shortCtx, jwt); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Resolve() while %v is discovered = %v, want %v", unreachable, err, context.DeadlineExceeded)
+	}
+}
+
+// BenchmarkResolveDistributedClaimsToken measures the cost of resolving a JWT
+// with a new authenticator, i.e., a discovery and a JWKS fetch per JWT.
+func BenchmarkResolveDistributedClaimsToken(b *testing.B) {
+	iss := newTestIssuer(b)
+	defer iss.close()
+	jwt := iss.jwt(b, testDistributedGroupsClaims)
+	trusted := iss.trustedIssuers()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, claims, err := ResolveDistributedClaimsToken("test-client-id", []string{"groups"}, "groups", "",
+			"username", trusted, jwt)
+		checkGroups(b, claims, err)
+	}
+}
+
+// BenchmarkDistributedClaimsResolver measures the cost of resolving a JWT with
+// the cached authenticator of the issuer.
+func BenchmarkDistributedClaimsResolver(b *testing.B) {
+	iss := newTestIssuer(b)
+	defer iss.close()
+	jwt := iss.jwt(b, testDistributedGroupsClaims)
+	r := NewDistributedClaimsResolver(ResolverOptions{
+		ClientID:          "test-client-id",
+		DistributedClaims: []string{"groups"},
+		GroupsClaim:       "groups",
+		UsernameClaim:     "username",
+		TrustedIssuers:    iss.trustedIssuers(),
+	})
+	defer r.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, claims, err := r.Resolve(context.Background(), jwt)
+		checkGroups(b, claims, err)
+	}
+}
+
+func TestLoadJSONWebPrivateKeyFromFileKeyID(t *testing.T) {
+	key, err := LoadJSONWebPrivateKeyFromFile("../testdata/token_service_signing_key.pem", jose.RS256)
+	if err != nil {
+		t.Fatalf("Failed to load private key from file: %v", err)
+	}
+	data, err := ioutil.ReadFile("../testdata/token_service_signing_key_jwks.json")
+	if err != nil {
+		t.Fatalf("Failed to read the JWKS: %v", err)
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		t.Fatalf("Failed to parse the JWKS: %v", err)
+	}
+	// The key id must be the RFC 7638 thumbprint published in the JWKS.
+	if len(jwks.Keys) != 1 || key.KeyID != jwks.Keys[0].KeyID {
+		t.Errorf("key id = %q, want the key id of the JWKS %+v", key.KeyID, jwks.Keys)
+	}
+}
+
+func TestCreateJwtWithOptions(t *testing.T) {
+	key, err := LoadJSONWebPrivateKeyFromFile("../testdata/token_service_signing_key.pem", jose.RS256)
+	if err != nil {
+		t.Fatalf("Failed to load private key from file: %v", err)
+	}
+	signer, err := NewJwtSigner(key)
+	if err != nil {
+		t.Fatalf("Failed to create a signer: %v", err)
+	}
+	const sourceClaims = `{"iss":"https://example.com","aud":"test-client-id","iat":1000,"exp":10000,"jti":"source"}`
+	now := func() time.Time { return time.Unix(2000, 0) }
+
+	testCases := []struct {
+		name   string
+		claims string
+		opts   JwtOptions
+		// want are the claims of the JWT that differ from the source claims.
+		want map[string]string
+	}{
+		{
+			name:   "issuer only",
+			claims: sourceClaims,
+			opts:   JwtOptions{Issuer: "token-service", Now: now},
+			want:   map[string]string{"iss": `"token-service"`},
+		},
+		{
+			name:   "no issuer in the claims",
+			claims: `{"sub":"test-user-name"}`,
+			opts:   JwtOptions{Issuer: "token-service", Now: now},
+			want:   map[string]string{"iss": `"token-service"`},
+		},
+		{
+			name:   "reset issued at",
+			claims: sourceClaims,
+			opts:   JwtOptions{Issuer: "token-service", ResetIssuedAt: true, Now: now},
+			want:   map[string]string{"iss": `"token-service"`, "iat": "2000", "nbf": "2000"},
+		},
+		{
+			name:   "max lifetime caps exp",
+			claims: sourceClaims,
+			opts:   JwtOptions{Issuer: "token-service", MaxLifetime: time.Hour, Now: now},
+			want:   map[string]string{"iss": `"token-service"`, "exp": "5600"},
+		},
+		{
+			name:   "max lifetime never extends exp",
+			claims: sourceClaims,
+			opts:   JwtOptions{Issuer: "token-service", MaxLifetime: 24 * time.Hour, Now: now},
+			want:   map[string]string{"iss": `"token-service"`, "exp": "10000"},
+		},
+		{
+			name:   "max lifetime without exp",
+			claims: `{"sub":"test-user-name"}`,
+			opts:   JwtOptions{Issuer: "token-service", MaxLifetime: time.Hour, Now: now},
+			want:   map[string]string{"iss": `"token-service"`, "exp": "5600"},
+		},
+		{
+			name:   "one audience",
+			claims: sourceClaims,
+			opts:   JwtOptions{Issuer: "token-service", Audience: []string{"httpbin"}, Now: now},
+			want:   map[string]string{"iss": `"token-service"`, "aud": `"httpbin"`},
+		},
+		{
+			name:   "audiences",
+			claims: sourceClaims,
+			opts:   JwtOptions{Issuer: "token-service", Audience: []string{"httpbin", "sleep"}, Now: now},
+			want:   map[string]string{"iss": `"token-service"`, "aud": `["httpbin","sleep"]`},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := map[string]json.RawMessage{}
+			if err := json.Unmarshal([]byte(tc.claims), &claims); err != nil {
+				t.Fatalf("Failed to parse the claims: %v", err)
+			}
+			want := map[string]string{}
+			for k, v := range claims {
+				want[k] = string(v)
+			}
+			for k, v := range tc.want {
+				want[k] = v
+			}
+
+			jwt, err := CreateJwtWithOptions(signer, claims, tc.opts)
+			if err != nil {
+				t.Fatalf("CreateJwtWithOptions() failed: %v", err)
+			}
+			jws, err := jose.ParseSigned(jwt)
+			if err != nil {
+				t.Fatalf("Failed to parse the JWT: %v", err)
+			}
+			header := jws.Signatures[0].Protected
+			if header.KeyID != key.KeyID || header.ExtraHeaders[jose.HeaderType] != "JWT" {
+				t.Errorf("JWT header = %+v, want the kid %q and the typ JWT", header, key.KeyID)
+			}
+			payload, err := jws.Verify(key.Public())
+			if err != nil {
+				t.Fatalf("Failed to verify the JWT: %v", err)
+			}
+			got := map[string]json.RawMessage{}
+			if err := json.Unmarshal(payload, &got); err != nil {
+				t.Fatalf("Failed to parse the JWT claims: %v", err)
+			}
+			if len(got) != len(want) {
+				t.Errorf("JWT claims = %s, want %v", payload, want)
+			}
+			for k, v := range want {
+				if string(got[k]) != v {
+					t.Errorf("JWT claim %v = %s, want %s", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateJwtWithOptionsNewID(t *testing.T) {
+	signer := newTestSigner(t)
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		claims := map[string]json.RawMessage{"jti": json.RawMessage(`"source"`)}
+		if _, err := CreateJwtWithOptions(signer, claims, JwtOptions{Issuer: "token-service", NewID: true}); err != nil {
+			t.Fatalf("CreateJwtWithOptions() failed: %v", err)
+		}
+		var id string
+		if err := json.Unmarshal(claims["jti"], &id); err != nil || id == "" || id == "source" {
+			t.Fatalf("jti = %s, want a fresh id", claims["jti"])
+		}
+		ids[id] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("jti = %v, want a different id for each JWT", ids)
+	}
+}
+
+// testKeyFile is a private key in one of the formats of
+// LoadJSONWebPrivateKeyFromFile.
+type testKeyFile struct {
+	name       string
+	key        interface{}
+	data       []byte
+	passphrase []byte
+	alg        jose.SignatureAlgorithm
+	// wantAlg is the algorithm of the loaded key, or "" if the key fails to
+	// load.
+	wantAlg jose.SignatureAlgorithm
+	wantKid string
+}
+
+// encodePEM PEM encodes der, encrypted if passphrase is not nil.
+func encodePEM(t *testing.T, blockType string, der, passphrase []byte) []byte {
+	block := &pem.Block{Type: blockType, Bytes: der}
+	if passphrase != nil {
+		var err error
+		block, err = x509.EncryptPEMBlock(rand.Reader, blockType, der, passphrase, x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatalf("Failed to encrypt the PEM block: %v", err)
+		}
+	}
+	return pem.EncodeToMemory(block)
+}
+
+// encodePKCS8 PEM encodes key in PKCS#8.
+func encodePKCS8(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal the key: %v", err)
+	}
+	return encodePEM(t, "PRIVATE KEY", der, nil)
+}
+
+// encodeJWK JSON encodes jwk.
+func encodeJWK(t *testing.T, jwk interface{}) []byte {
+	data, err := json.Marshal(jwk)
+	if err != nil {
+		t.Fatalf("Failed to marshal the JWK: %v", err)
+	}
+	return data
+}
+
+func TestLoadJSONWebPrivateKeyFromFileFormats(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	ecKeys := map[elliptic.Curve]*ecdsa.PrivateKey{}
+	for _, curve := range []elliptic.Curve{elliptic.P224(), elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if ecKeys[curve], err = ecdsa.GenerateKey(curve, rand.Reader); err != nil {
+			t.Fatalf("Failed to generate a key: %v", err)
+		}
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKeys[elliptic.P256()])
+	if err != nil {
+		t.Fatalf("Failed to marshal the key: %v", err)
+	}
+	passphrase := []byte("test-passphrase")
+
+	testCases := []testKeyFile{
+		{
+			name:    "PKCS#1 RSA",
+			key:     rsaKey,
+			data:    encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil),
+			wantAlg: jose.RS256,
+		},
+		{
+			name:    "PKCS#1 RSA forced to PS256",
+			key:     rsaKey,
+			data:    encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil),
+			alg:     jose.PS256,
+			wantAlg: jose.PS256,
+		},
+		{
+			name: "PKCS#1 RSA forced to ES256",
+			key:  rsaKey,
+			data: encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil),
+			alg:  jose.ES256,
+		},
+		{
+			name:    "PKCS#8 RSA",
+			key:     rsaKey,
+			data:    encodePKCS8(t, rsaKey),
+			wantAlg: jose.RS256,
+		},
+		{
+			name:    "PKCS#8 ECDSA P-256",
+			key:     ecKeys[elliptic.P256()],
+			data:    encodePKCS8(t, ecKeys[elliptic.P256()]),
+			wantAlg: jose.ES256,
+		},
+		{
+			name:    "PKCS#8 ECDSA P-384",
+			key:     ecKeys[elliptic.P384()],
+			data:    encodePKCS8(t, ecKeys[elliptic.P384()]),
+			wantAlg: jose.ES384,
+		},
+		{
+			name:    "PKCS#8 ECDSA P-521",
+			key:     ecKeys[elliptic.P521()],
+			data:    encodePKCS8(t, ecKeys[elliptic.P521()]),
+			wantAlg: jose.ES512,
+		},
+		{
+			name: "PKCS#8 ECDSA P-224",
+			key:  ecKeys[elliptic.P224()],
+			data: encodePKCS8(t, ecKeys[elliptic.P224()]),
+		},
+		{
+			name: "PKCS#8 ECDSA P-256 forced to ES384",
+			key:  ecKeys[elliptic.P256()],
+			data: encodePKCS8(t, ecKeys[elliptic.P256()]),
+			alg:  jose.ES384,
+		},
+		{
+			name:    "PKCS#8 Ed25519",
+			key:     edKey,
+			data:    encodePKCS8(t, edKey),
+			wantAlg: jose.EdDSA,
+		},
+		{
+			name:    "SEC1 EC",
+			key:     ecKeys[elliptic.P256()],
+			data:    encodePEM(t, "EC PRIVATE KEY", sec1, nil),
+			wantAlg: jose.ES256,
+		},
+		{
+			name:       "encrypted PKCS#1 RSA",
+			key:        rsaKey,
+			data:       encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), passphrase),
+			passphrase: passphrase,
+			wantAlg:    jose.RS256,
+		},
+		{
+			name:       "encrypted SEC1 EC",
+			key:        ecKeys[elliptic.P256()],
+			data:       encodePEM(t, "EC PRIVATE KEY", sec1, passphrase),
+			passphrase: passphrase,
+			wantAlg:    jose.ES256,
+		},
+		{
+			name:       "encrypted with a wrong passphrase",
+			key:        rsaKey,
+			data:       encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), passphrase),
+			passphrase: []byte("wrong-passphrase"),
+		},
+		{
+			name: "encrypted without a passphrase",
+			key:  rsaKey,
+			data: encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), passphrase),
+		},
+		{
+			name:    "JWK Ed25519",
+			key:     edKey,
+			data:    encodeJWK(t, &jose.JSONWebKey{Key: edKey}),
+			wantAlg: jose.EdDSA,
+		},
+		{
+			name:    "JWK ECDSA with a key id and an algorithm",
+			key:     ecKeys[elliptic.P384()],
+			data:    encodeJWK(t, &jose.JSONWebKey{Key: ecKeys[elliptic.P384()], KeyID: "ec-key", Algorithm: "ES384"}),
+			wantAlg: jose.ES384,
+			wantKid: "ec-key",
+		},
+		{
+			name: "JWK with an algorithm other than the forced one",
+			key:  rsaKey,
+			data: encodeJWK(t, &jose.JSONWebKey{Key: rsaKey, Algorithm: "PS256"}),
+			alg:  jose.RS256,
+		},
+		{
+			name: "JWK of a public key",
+			key:  rsaKey,
+			data: encodeJWK(t, &jose.JSONWebKey{Key: rsaKey.Public()}),
+		},
+		{
+			name: "JWKS RSA",
+			key:  rsaKey,
+			data: encodeJWK(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: rsaKey, KeyID: "rsa-key"},
+			}}),
+			wantAlg: jose.RS256,
+			wantKid: "rsa-key",
+		},
+		{
+			name: "JWKS of two keys",
+			key:  rsaKey,
+			data: encodeJWK(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: rsaKey}, {Key: edKey},
+			}}),
+		},
+		{
+			name: "not a key",
+			key:  rsaKey,
+			data: []byte("not a key"),
+		},
+		{
+			name: "unsupported PEM block",
+			key:  rsaKey,
+			data: encodePEM(t, "CERTIFICATE", []byte("not a certificate"), nil),
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("key_%v", i))
+			if err := ioutil.WriteFile(path, tc.data, 0600); err != nil {
+				t.Fatalf("Failed to write the key file: %v", err)
+			}
+			key, err := LoadEncryptedJSONWebPrivateKeyFromFile(path, tc.alg, tc.passphrase)
+			if tc.wantAlg == "" {
+				if err == nil {
+					t.Fatalf("LoadEncryptedJSONWebPrivateKeyFromFile() = %+v, want an error", key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadEncryptedJSONWebPrivateKeyFromFile() failed: %v", err)
+			}
+			if key.Algorithm != string(tc.wantAlg) {
+				t.Errorf("key algorithm = %v, want %v", key.Algorithm, tc.wantAlg)
+			}
+			want := &jose.JSONWebKey{Key: tc.key}
+			wantKid := tc.wantKid
+			if wantKid == "" {
+				hash, err := want.Thumbprint(crypto.SHA256)
+				if err != nil {
+					t.Fatalf("Failed to compute the thumbprint: %v", err)
+				}
+				wantKid = base64.RawURLEncoding.EncodeToString(hash)
+			}
+			if key.KeyID != wantKid {
+				t.Errorf("key id = %q, want %q", key.KeyID, wantKid)
+			}
+
+			// The key signs with its algorithm and the kid.
+			signer, err := NewJwtSigner(key)
+			if err != nil {
+				t.Fatalf("Failed to create a signer: %v", err)
+			}
+			jwt, err := CreateJwtWithOptions(signer, map[string]json.RawMessage{}, JwtOptions{Issuer: "token-service"})
+			if err != nil {
+				t.Fatalf("Failed to sign: %v", err)
+			}
+			jws, err := jose.ParseSigned(jwt)
+			if err != nil {
+				t.Fatalf("Failed to parse the JWT: %v", err)
+			}
+			if _, err := jws.Verify(want.Public()); err != nil {
+				t.Errorf("Failed to verify the signature with the public key: %v", err)
+			}
+			if h := jws.Signatures[0].Protected; h.KeyID != wantKid || h.Algorithm != string(tc.wantAlg) {
+				t.Errorf("JWS header = %+v, want the kid %q and the alg %v", h, wantKid, tc.wantAlg)
+			}
+		})
+	}
+}